@@ -15,6 +15,7 @@ package component
 
 import (
 	"context"
+	"errors"
 
 	"github.com/dapr/components-contrib/state"
 	"github.com/dapr/kit/logger"
@@ -27,6 +28,11 @@ type SQLiteStore struct {
 	dbaccess DBAccess
 }
 
+var (
+	defaultFeatures  = []state.Feature{state.FeatureETag, state.FeatureTransactional}
+	readOnlyFeatures = []state.Feature{state.FeatureETag}
+)
+
 // NewSQLiteStateStore creates a new instance of the SQLite state store.
 func NewSQLiteStateStore(logger logger.Logger) state.Store {
 	dba := newSqliteDBAccess(logger)
@@ -38,6 +44,7 @@ func NewSQLiteStateStore(logger logger.Logger) state.Store {
 // This unexported constructor allows injecting a dbAccess instance for unit testing.
 func newSQLiteStateStore(logger logger.Logger, dba DBAccess) *SQLiteStore {
 	return &SQLiteStore{
+		features: defaultFeatures,
 		logger:   logger,
 		dbaccess: dba,
 	}
@@ -45,6 +52,36 @@ func newSQLiteStateStore(logger logger.Logger, dba DBAccess) *SQLiteStore {
 
 // Init initializes the Sql server state store.
 func (s *SQLiteStore) Init(metadata state.Metadata) error {
+	// Errors are reported by dbaccess.Init
+	if readOnly, _ := parseBool(metadata, readOnlyKey); readOnly {
+		s.features = readOnlyFeatures
+	}
+
+	if local, ok := s.dbaccess.(*sqliteDBAccess); ok {
+		tenantIsolation, err := parseBool(metadata, tenantIsolationKey)
+		if err != nil {
+			return err
+		}
+		sharded := metadata.Properties[shardsKey] != ""
+		clustered := metadata.Properties[raftNodeIDKey] != ""
+
+		switch {
+		case tenantIsolation:
+			if sharded || clustered {
+				return errors.New("tenant isolation is not supported with sharding or in clustered mode")
+			}
+			s.dbaccess = newTenantDBAccess(s.logger)
+		case sharded:
+			if clustered {
+				return errors.New("sharding is not supported in clustered mode")
+			}
+			s.dbaccess = newShardedDBAccess(s.logger)
+		case clustered:
+			// In clustered mode, the local database is wrapped by the Raft node
+			s.dbaccess = newRaftDBAccess(s.logger, local)
+		}
+	}
+
 	return s.dbaccess.Init(metadata)
 }
 
@@ -54,10 +91,7 @@ func (s *SQLiteStore) Ping() error {
 
 // Features returns the features available in this state store.
 func (s *SQLiteStore) Features() []state.Feature {
-	return []state.Feature{
-		state.FeatureETag,
-		state.FeatureTransactional,
-	}
+	return s.features
 }
 
 // Delete removes an entity from the store.
@@ -74,7 +108,7 @@ func (s *SQLiteStore) BulkDelete(req []state.DeleteRequest) error {
 			Request:   r,
 		})
 	}
-	return s.dbaccess.ExecuteMulti(context.TODO(), ops)
+	return s.executeBulk(ops)
 }
 
 // Get returns an entity from store.
@@ -102,6 +136,16 @@ func (s *SQLiteStore) BulkSet(req []state.SetRequest) error {
 			Request:   r,
 		})
 	}
+	return s.executeBulk(ops)
+}
+
+// Executes the operations of BulkSet and BulkDelete, which don't need to be atomic.
+func (s *SQLiteStore) executeBulk(ops []state.TransactionalStateOperation) error {
+	if b, ok := s.dbaccess.(interface {
+		executeBulk(ctx context.Context, reqs []state.TransactionalStateOperation) error
+	}); ok {
+		return b.executeBulk(context.TODO(), ops)
+	}
 	return s.dbaccess.ExecuteMulti(context.TODO(), ops)
 }
 
@@ -0,0 +1,295 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// Operation recorded in the audit log when a soft-deleted key is restored.
+const auditOperationUndelete state.OperationType = "undelete"
+
+// AuditEntry is a write recorded in the audit log.
+type AuditEntry struct {
+	// ID of the entry, which increases with every write to the database.
+	ID int64
+	// Key that was written.
+	Key string
+	// Operation: "upsert", "delete" or "undelete".
+	Operation string
+	// ETag of the key before the write, which is empty if the key didn't exist.
+	OldETag string
+	// ETag of the key after the write, which is empty for deletions.
+	NewETag string
+	// Time of the write.
+	Time time.Time
+	// Request metadata included in the allow-list.
+	Metadata map[string]string
+}
+
+// AuditQuery selects the entries returned by QueryAuditLog.
+// Fields with a zero value are ignored.
+type AuditQuery struct {
+	// Only return the entries of this key.
+	Key string
+	// Only return entries written at or after this time.
+	Since time.Time
+	// Only return entries written before this time.
+	Until time.Time
+	// Maximum number of entries to return.
+	Limit int
+}
+
+// auditSettings contains which request metadata is recorded in the audit log, and for how long entries are kept.
+type auditSettings struct {
+	metadataKeys []string
+	// Maximum age of entries, or 0 for no limit.
+	retention time.Duration
+}
+
+// auditDBAccess is implemented by DBAccess objects that can query the audit log.
+type auditDBAccess interface {
+	queryAudit(ctx context.Context, q AuditQuery) ([]AuditEntry, error)
+}
+
+// Returns the audit settings in the metadata, or nil if the audit log is disabled.
+func parseAuditSettings(metadata state.Metadata) (*auditSettings, error) {
+	enabled, err := parseBool(metadata, auditLogKey)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	res := &auditSettings{}
+	for _, k := range strings.Split(metadata.Properties[auditMetadataKeysKey], ",") {
+		k = strings.TrimSpace(k)
+		if k != "" {
+			res.metadataKeys = append(res.metadataKeys, k)
+		}
+	}
+
+	res.retention, err = parseDurationProperty(metadata, auditRetentionKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (a *sqliteDBAccess) auditTableName() string {
+	return a.tableName + auditTableSuffix
+}
+
+// Creates the audit table if it doesn't exist.
+func (a *sqliteDBAccess) ensureAuditTable(parentCtx context.Context) error {
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	table := a.auditTableName()
+	_, err := a.db.ExecContext(ctx, fmt.Sprintf(createAuditTableTpl, table, table, table, table, table))
+	return err
+}
+
+// Returns the ETag of a key before it's written, or nil if the key doesn't exist.
+func (a *sqliteDBAccess) currentETag(tx *sql.Tx, key string) (*string, error) {
+	tpl := getETagTpl
+	if a.softDeleteGracePeriod > 0 {
+		tpl = getETagSoftDeleteTpl
+	}
+
+	var etag string
+	err := tx.QueryRow(fmt.Sprintf(tpl, a.tableName), key).Scan(&etag)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &etag, nil
+}
+
+// Adds an entry to the audit log, with the request metadata that is in the allow-list.
+func (a *sqliteDBAccess) appendAudit(tx *sql.Tx, key string, operation state.OperationType, oldETag *string, newETag *string, reqMetadata map[string]string, now time.Time) error {
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var md *string
+	selected := make(map[string]string, len(a.audit.metadataKeys))
+	for _, k := range a.audit.metadataKeys {
+		if v, ok := reqMetadata[k]; ok {
+			selected[k] = v
+		}
+	}
+	if len(selected) > 0 {
+		b, err := json.Marshal(selected)
+		if err != nil {
+			return err
+		}
+		s := string(b)
+		md = &s
+	}
+
+	_, err := tx.Exec(fmt.Sprintf(insertAuditTpl, a.auditTableName()),
+		key, operation, oldETag, newETag, now.UTC().Format(timestampFormat), md)
+	if err != nil {
+		return fmt.Errorf("failed to add entry to audit log: %w", err)
+	}
+	return nil
+}
+
+// Removes the audit entries that are older than the retention period.
+func (a *sqliteDBAccess) pruneAudit(tx *sql.Tx, now time.Time) error {
+	if a.audit == nil || a.audit.retention == 0 {
+		return nil
+	}
+	_, err := tx.Exec(fmt.Sprintf(pruneAuditTpl, a.auditTableName()), timestampBefore(now, a.audit.retention))
+	if err != nil {
+		return fmt.Errorf("failed to prune audit log: %w", err)
+	}
+	return nil
+}
+
+func (a *sqliteDBAccess) queryAudit(parentCtx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	if a.audit == nil {
+		return nil, errors.New("the audit log is not enabled")
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	var since, until string
+	if !q.Since.IsZero() {
+		since = q.Since.UTC().Format(timestampFormat)
+	}
+	if !q.Until.IsZero() {
+		until = q.Until.UTC().Format(timestampFormat)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		// No limit
+		limit = -1
+	}
+
+	rows, err := a.db.QueryContext(ctx, fmt.Sprintf(queryAuditTpl, a.auditTableName()),
+		q.Key, q.Key, since, since, until, until, limit)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer rows.Close()
+
+	res := []AuditEntry{}
+	for rows.Next() {
+		var (
+			e                AuditEntry
+			oldETag, newETag sql.NullString
+			md               sql.NullString
+		)
+		err = rows.Scan(&e.ID, &e.Key, &e.Operation, &oldETag, &newETag, &e.Time, &md)
+		if err != nil {
+			return nil, err
+		}
+		e.OldETag = oldETag.String
+		e.NewETag = newETag.String
+		if md.Valid {
+			err = json.Unmarshal([]byte(md.String), &e.Metadata)
+			if err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+func (r *raftDBAccess) queryAudit(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	return r.local.queryAudit(ctx, q)
+}
+
+func (s *shardedDBAccess) queryAudit(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	if q.Key != "" {
+		return s.shardFor(q.Key).queryAudit(ctx, q)
+	}
+
+	var res []AuditEntry
+	for _, shard := range s.shards {
+		entries, err := shard.queryAudit(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, entries...)
+	}
+	return mergeAuditEntries(res, q.Limit), nil
+}
+
+func (t *tenantDBAccess) queryAudit(ctx context.Context, q AuditQuery) (res []AuditEntry, err error) {
+	if q.Key != "" {
+		err = t.withTenant(q.Key, func(a *sqliteDBAccess) error {
+			res, err = a.queryAudit(ctx, q)
+			return err
+		})
+		return res, err
+	}
+
+	tenants, err := t.listTenants()
+	if err != nil {
+		return nil, err
+	}
+	for _, tenant := range tenants {
+		a, err := t.acquire(tenant)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := a.queryAudit(ctx, q)
+		t.release(tenant)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, entries...)
+	}
+	return mergeAuditEntries(res, q.Limit), nil
+}
+
+// Sorts the entries read from multiple databases by time, and returns up to limit entries.
+// IDs are only ordered within each database.
+func mergeAuditEntries(entries []AuditEntry, limit int) []AuditEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	return entries
+}
+
+// QueryAuditLog returns the entries of the audit log that match the query, oldest first.
+func (s *SQLiteStore) QueryAuditLog(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	a, ok := s.dbaccess.(auditDBAccess)
+	if !ok {
+		return nil, errors.New("the audit log is not supported")
+	}
+	return a.queryAudit(ctx, q)
+}
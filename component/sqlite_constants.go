@@ -20,13 +20,130 @@ import "time"
 const (
 	connectionStringKey         = "connectionString"
 	metadataTTLKey              = "ttlInSeconds"
+	metadataContentTypeKey      = "contentType"
+	persistMetadataKeysKey      = "persistMetadataKeys"
+	metadataSlidingTTLKey       = "slidingTTL"
+	slidingTTLRefreshKey        = "slidingTTLRefreshFraction"
+	defaultSlidingTTLRefresh    = 0.5
+	metadataExpireAtKey         = "ttlExpireTime"
+	defaultTTLKey               = "defaultTTLInSeconds"
+	maxTTLKey                   = "maxTTLInSeconds"
+	ttlPoliciesKey              = "ttlPolicies"
 	errMissingConnectionString  = "missing connection string"
 	errInvalidIdentifier        = "invalid identifier: %s" // specify identifier type, e.g. "table name"
 	tableNameKey                = "tableName"
 	cleanupIntervalKey          = "cleanupIntervalInSeconds"
+	timeoutKey                  = "timeoutInSeconds"
+	busyTimeoutKey              = "busyTimeout"
+	busyRetryPrefix             = "busyRetry"
+	profileKey                  = "profile"
+	journalModeKey              = "journalMode"
+	synchronousKey              = "synchronous"
+	cacheSizeKey                = "cacheSize"
+	mmapSizeKey                 = "mmapSize"
+	tempStoreKey                = "tempStore"
+	walAutocheckpointKey        = "walAutocheckpoint"
+	modeKey                     = "mode"
+	modeFile                    = "file"
+	modeMemory                  = "memory"
+	persistFileKey              = "persistFile"
+	persistIntervalKey          = "persistIntervalInSeconds"
+	defaultPersistIntervalInSec = 60
+	readOnlyKey                 = "readOnly"
+	errReadOnly                 = "the state store is in read-only mode"
+
+	replicaTypeKey                 = "replicaType"
+	replicaPathKey                 = "replicaPath"
+	replicaSyncIntervalKey         = "replicaSyncInterval"
+	replicaSnapshotIntervalKey     = "replicaSnapshotInterval"
+	replicaRestoreKey              = "replicaRestore"
+	replicaS3EndpointKey           = "replicaS3Endpoint"
+	replicaS3BucketKey             = "replicaS3Bucket"
+	replicaS3RegionKey             = "replicaS3Region"
+	replicaS3AccessKeyKey          = "replicaS3AccessKey"
+	replicaS3SecretKeyKey          = "replicaS3SecretKey"
+	replicaS3UseSSLKey             = "replicaS3UseSSL"
+	defaultReplicaSyncInterval     = time.Second
+	defaultReplicaSnapshotInterval = 24 * time.Hour
+	defaultReplicaCheckpointPages  = 1000
+	defaultReplicaS3Endpoint       = "s3.amazonaws.com"
+	defaultReplicaS3Region         = "us-east-1"
+
+	shardsKey                = "shards"
+	shardPlaceholder         = "{shard}"
+	defaultShardVirtualNodes = 128
+
+	tenantIsolationKey        = "tenantIsolation"
+	tenantKeySeparatorKey     = "tenantKeySeparator"
+	tenantKeySegmentKey       = "tenantKeySegment"
+	tenantIdleTimeoutKey      = "tenantIdleTimeout"
+	tenantMaxSizeKey          = "tenantMaxSize"
+	tenantPlaceholder         = "{tenant}"
+	defaultTenantKeySeparator = "||"
+	defaultTenantIdleTimeout  = 10 * time.Minute
+
+	historyLimitKey     = "historyLimit"
+	historyRetentionKey = "historyRetention"
+	historyTableSuffix  = "_history"
+
+	auditLogKey          = "auditLog"
+	auditMetadataKeysKey = "auditMetadataKeys"
+	auditRetentionKey    = "auditRetention"
+	auditTableSuffix     = "_audit"
+
+	jsonIndexesKey = "jsonIndexes"
+
+	fullTextSearchKey       = "fullTextSearch"
+	fullTextSearchFieldsKey = "fullTextSearchFields"
+	ftsTableSuffix          = "_fts"
+	defaultSearchLimit      = 100
+
+	expirationNotificationsKey = "expirationNotifications"
+	expiredTableSuffix         = "_expired"
+	expirationBatchSize        = 100
+	expirationRetryInterval    = 5 * time.Second
+
+	cacheMaxRowsKey          = "cacheMaxRows"
+	cacheMaxBytesKey         = "cacheMaxBytes"
+	cacheEvictionIntervalKey = "cacheEvictionInterval"
+	cacheTableSuffix         = "_cache"
+	// Number of reads whose access time is buffered before it's written to the database.
+	maxPendingAccesses = 1000
+
+	readCacheMaxEntriesKey = "readCacheMaxEntries"
+	readCacheMaxBytesKey   = "readCacheMaxBytes"
+	// Approximate memory used by an entry of the read cache besides the key and the row.
+	readCacheEntryOverhead = 128
+
+	groupCommitMaxDelayKey     = "groupCommitMaxDelay"
+	groupCommitMaxBatchKey     = "groupCommitMaxBatch"
+	defaultGroupCommitMaxDelay = 2 * time.Millisecond
+	defaultGroupCommitMaxBatch = 100
+
+	// Format of the times stored as text in the history and audit tables, which can be compared as strings.
+	timestampFormat = "2006-01-02 15:04:05.000"
+
+	softDeleteKey                = "softDelete"
+	softDeleteGracePeriodKey     = "softDeleteGracePeriod"
+	defaultSoftDeleteGracePeriod = 24 * time.Hour
+
+	raftNodeIDKey               = "raftNodeID"
+	raftBindAddressKey          = "raftBindAddress"
+	raftPeersKey                = "raftPeers"
+	raftDataDirKey              = "raftDataDir"
+	raftTLSCertFileKey          = "raftTLSCertFile"
+	raftTLSKeyFileKey           = "raftTLSKeyFile"
+	raftTLSCAFileKey            = "raftTLSCAFile"
+	defaultRaftSnapshotRetain   = 2
+	defaultRaftLogCacheSize     = 512
+	defaultRaftMaxPool          = 3
+	raftHandshakeTimeout        = 10 * time.Second
 	defaultTableName            = "state"
 	defaultCleanupInternalInSec = 1200
-	operationTimeout            = 15 * time.Second
+	defaultTimeout              = 15 * time.Second
+	defaultBusyTimeout          = 2 * time.Second
+	defaultBusyRetryInterval    = 10 * time.Millisecond
+	defaultBusyRetryMaxInterval = time.Second
 
 	createTableTpl = `
       	CREATE TABLE %s (
@@ -53,30 +170,325 @@ const (
 			expiration_time IS NOT NULL
 			AND expiration_time < CURRENT_TIMESTAMP`
 
+	cleanupExpiredBeforeStmtTpl = `
+		DELETE FROM %s
+		WHERE
+			expiration_time IS NOT NULL
+			AND expiration_time < DATETIME(?, 'unixepoch')`
+
+	// IDs aren't AUTOINCREMENT so that they only depend on the content of the table, which is the same on every node of a cluster.
+	createExpiredTableTpl = `
+		CREATE TABLE IF NOT EXISTS %s (
+			id INTEGER PRIMARY KEY,
+			key TEXT NOT NULL,
+			value TEXT NOT NULL,
+			is_binary BOOLEAN NOT NULL,
+			metadata TEXT,
+			expiration_time TIMESTAMP NOT NULL
+		)`
+
+	// Copies the rows that are about to be removed by the cleanup, with the same condition.
+	captureExpiredTpl = `
+		INSERT INTO %[1]s (key, value, is_binary, metadata, expiration_time)
+		SELECT key, value, is_binary, metadata, expiration_time
+		FROM %[2]s
+		WHERE
+			expiration_time IS NOT NULL
+			AND expiration_time < %[3]s%[4]s
+		ORDER BY expiration_time`
+
+	listExpiredTpl = `
+		SELECT id, key, value, is_binary, metadata, expiration_time
+		FROM %s
+		ORDER BY id
+		LIMIT ?`
+
+	deleteExpiredKeyTpl = "DELETE FROM %s WHERE id = ?"
+
+	addLastAccessColumnTpl   = "ALTER TABLE %s ADD COLUMN last_access INTEGER NOT NULL DEFAULT 0"
+	createLastAccessIndexTpl = "CREATE INDEX IF NOT EXISTS idx_%s_last_access ON %s(last_access)"
+	setLastAccessTpl         = "UPDATE %s SET last_access = ? WHERE key = ?"
+
+	// The table of the cache has a single row, with the size of the state table kept up to date by triggers.
+	createCacheTableTpl = `
+		CREATE TABLE IF NOT EXISTS %s (
+			id INTEGER PRIMARY KEY CHECK (id = 0),
+			row_count INTEGER NOT NULL,
+			byte_count INTEGER NOT NULL,
+			evicted_rows INTEGER NOT NULL DEFAULT 0,
+			evicted_bytes INTEGER NOT NULL DEFAULT 0
+		)`
+	resetCacheSizeTpl = `
+		INSERT INTO %[1]s (id, row_count, byte_count)
+		SELECT 0, COUNT(*), IFNULL(SUM(%[3]s), 0) FROM %[2]s
+		WHERE true
+		ON CONFLICT (id) DO UPDATE SET row_count = excluded.row_count, byte_count = excluded.byte_count`
+	// INSERT OR REPLACE doesn't fire delete triggers, so the size of the row being replaced is subtracted before the insert.
+	createCacheInsertBeforeTriggerTpl = `CREATE TRIGGER %[1]s BEFORE INSERT ON %[2]s BEGIN
+			UPDATE %[3]s SET row_count = row_count - 1, byte_count = byte_count - (SELECT %[4]s FROM %[2]s WHERE key = new.key)
+			WHERE EXISTS (SELECT 1 FROM %[2]s WHERE key = new.key);
+		END`
+	createCacheInsertTriggerTpl = `CREATE TRIGGER %[1]s AFTER INSERT ON %[2]s BEGIN
+			UPDATE %[3]s SET row_count = row_count + 1, byte_count = byte_count + %[4]s;
+		END`
+	createCacheUpdateTriggerTpl = `CREATE TRIGGER %[1]s AFTER UPDATE OF value ON %[2]s BEGIN
+			UPDATE %[3]s SET byte_count = byte_count - %[4]s + %[5]s;
+		END`
+	createCacheDeleteTriggerTpl = `CREATE TRIGGER %[1]s AFTER DELETE ON %[2]s BEGIN
+			UPDATE %[3]s SET row_count = row_count - 1, byte_count = byte_count - %[4]s;
+		END`
+	getCacheStatsTpl         = "SELECT row_count, byte_count, evicted_rows, evicted_bytes FROM %s"
+	listLeastRecentlyUsedTpl = "SELECT key, %s FROM %s ORDER BY last_access, key"
+	deleteKeyTpl             = "DELETE FROM %s WHERE key = ?"
+	addEvictedTpl            = "UPDATE %s SET evicted_rows = evicted_rows + ?, evicted_bytes = evicted_bytes + ?"
+
+	dataVersionStmt = "PRAGMA data_version"
+
+	savepointStmt           = "SAVEPOINT group_write"
+	rollbackToSavepointStmt = "ROLLBACK TO group_write"
+	releaseSavepointStmt    = "RELEASE group_write"
+
+	deleteOlderThanTpl = `
+		DELETE FROM %s
+		WHERE
+			%s
+			AND creation_time < DATETIME(?, 'unixepoch')`
+
+	createHistoryTableTpl = `
+		CREATE TABLE IF NOT EXISTS %s (
+			version INTEGER PRIMARY KEY AUTOINCREMENT,
+			key TEXT NOT NULL,
+			value TEXT,
+			is_binary BOOLEAN NOT NULL,
+			etag TEXT NOT NULL,
+			deleted BOOLEAN NOT NULL,
+			version_time TIMESTAMP NOT NULL,
+			metadata TEXT
+		);
+		CREATE INDEX IF NOT EXISTS idx_%s_key ON %s(key, version);`
+
+	// The metadata is copied from the row just written to the state table, unless the version is a deletion.
+	insertHistoryTpl = `
+		INSERT INTO %[1]s
+			(key, value, is_binary, etag, deleted, version_time, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, CASE WHEN ? THEN NULL ELSE (SELECT metadata FROM %[2]s WHERE key = ?) END)`
+
+	pruneHistoryLimitTpl = `
+		DELETE FROM %s
+		WHERE
+			key = ?
+			AND version NOT IN (
+				SELECT version FROM %s WHERE key = ? ORDER BY version DESC LIMIT ?
+			)`
+
+	pruneHistoryRetentionTpl = "DELETE FROM %s WHERE key = ? AND version_time < ?"
+
+	pruneAllHistoryRetentionTpl = "DELETE FROM %s WHERE version_time < ?"
+
+	listHistoryTpl = `
+		SELECT version, etag, deleted, version_time FROM %s
+		WHERE key = ?
+		ORDER BY version DESC`
+
+	getHistoryTpl = `
+		SELECT version, value, is_binary, etag, deleted, version_time, metadata FROM %s
+		WHERE key = ? AND version = ?`
+
+	columnExistsStmt = "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+
+	addMetadataColumnTpl = `
+		ALTER TABLE %s ADD COLUMN metadata TEXT DEFAULT NULL`
+
+	addSlidingTTLColumnTpl = `
+		ALTER TABLE %s ADD COLUMN sliding_ttl INTEGER DEFAULT NULL`
+
+	refreshExpirationTpl = `
+		UPDATE %s SET
+			expiration_time = DATETIME(?, 'unixepoch', '+' || sliding_ttl || ' seconds')
+		WHERE
+			key = ?
+			AND etag = ?
+			AND sliding_ttl IS NOT NULL`
+
+	addDeletionTimeColumnTpl = `
+		ALTER TABLE %s ADD COLUMN deletion_time TIMESTAMP DEFAULT NULL`
+
+	createTableDeletionTimeIdx = `
+		CREATE INDEX IF NOT EXISTS idx_%s_deletion_time ON %s(deletion_time)`
+
+	softDelValueTpl = `
+		UPDATE %s SET deletion_time = DATETIME(?, 'unixepoch')
+		WHERE key = ? AND deletion_time IS NULL`
+	softDelValueWithETagTpl = `
+		UPDATE %s SET deletion_time = DATETIME(?, 'unixepoch')
+		WHERE key = ? AND deletion_time IS NULL AND etag = ?`
+
+	undeleteValueTpl = `
+		UPDATE %s SET
+			deletion_time = NULL,
+			etag = ?,
+			update_time = CURRENT_TIMESTAMP
+		WHERE key = ? AND deletion_time IS NOT NULL
+		RETURNING value, is_binary`
+
+	purgeDeletedTpl = `
+		DELETE FROM %s
+		WHERE
+			deletion_time IS NOT NULL
+			AND deletion_time < DATETIME(?, 'unixepoch')`
+
+	createAuditTableTpl = `
+		CREATE TABLE IF NOT EXISTS %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			key TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			old_etag TEXT,
+			new_etag TEXT,
+			audit_time TIMESTAMP NOT NULL,
+			metadata TEXT
+		);
+		CREATE INDEX IF NOT EXISTS idx_%s_key ON %s(key, audit_time);
+		CREATE INDEX IF NOT EXISTS idx_%s_audit_time ON %s(audit_time);`
+
+	insertAuditTpl = `
+		INSERT INTO %s
+			(key, operation, old_etag, new_etag, audit_time, metadata)
+		VALUES (?, ?, ?, ?, ?, ?)`
+
+	pruneAuditTpl = "DELETE FROM %s WHERE audit_time < ?"
+
+	queryAuditTpl = `
+		SELECT id, key, operation, old_etag, new_etag, audit_time, metadata FROM %s
+		WHERE
+			(? = '' OR key = ?)
+			AND (? = '' OR audit_time >= ?)
+			AND (? = '' OR audit_time < ?)
+		ORDER BY id
+		LIMIT ?`
+
+	getETagTpl           = "SELECT etag FROM %s WHERE key = ?"
+	getETagSoftDeleteTpl = "SELECT etag FROM %s WHERE key = ? AND deletion_time IS NULL"
+
+	createJSONIndexTpl = "CREATE INDEX IF NOT EXISTS %s ON %s(json_extract(value, '%s'))"
+	dropIndexTpl       = "DROP INDEX IF EXISTS %s"
+	listIndexesStmt    = "SELECT name, sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name LIKE ? ORDER BY name"
+
+	createFTSTableTpl = "CREATE VIRTUAL TABLE %s USING fts5(key UNINDEXED, content)"
+	dropTableTpl      = "DROP TABLE IF EXISTS %s"
+	dropTriggerTpl    = "DROP TRIGGER IF EXISTS %s"
+	getTriggerStmt    = "SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name = ?"
+	fts5AvailableStmt = "SELECT sqlite_compileoption_used('ENABLE_FTS5')"
+
+	// The rows in the FTS table are linked to the rows in the state table by key, since VACUUM may change the rowids of the state table.
+	// INSERT OR REPLACE doesn't fire delete triggers, so the row being replaced is removed from the FTS table before the insert.
+	createFTSInsertBeforeTriggerTpl = `CREATE TRIGGER %s BEFORE INSERT ON %s BEGIN
+			DELETE FROM %s WHERE key = new.key;
+		END`
+	createFTSInsertTriggerTpl = `CREATE TRIGGER %s AFTER INSERT ON %s BEGIN
+			INSERT INTO %s (key, content) VALUES (new.key, %s);
+		END`
+	createFTSUpdateTriggerTpl = `CREATE TRIGGER %s AFTER UPDATE OF value, is_binary ON %s BEGIN
+			UPDATE %s SET content = %s WHERE key = new.key;
+		END`
+	createFTSDeleteTriggerTpl = `CREATE TRIGGER %s AFTER DELETE ON %s BEGIN
+			DELETE FROM %s WHERE key = old.key;
+		END`
+	rebuildFTSTpl = "INSERT INTO %s (key, content) SELECT key, %s FROM %s"
+
+	searchTpl = `
+		SELECT s.key, %[1]s.rank, snippet(%[1]s, 1, '<b>', '</b>', '…', 16)
+		FROM %[1]s
+		JOIN %[2]s AS s ON s.key = %[1]s.key
+		WHERE
+			%[1]s MATCH ?
+			AND substr(s.key, 1, length(?)) = ?
+			AND (s.expiration_time IS NULL OR s.expiration_time > CURRENT_TIMESTAMP)
+			%[3]s
+		ORDER BY %[1]s.rank
+		LIMIT ?`
+
+	// Returns the type of a JSON document, and the type and value of one of its fields.
+	getJSONFieldStmt = "SELECT json_type(?), json_type(?, ?), json_extract(?, ?)"
+	setJSONFieldStmt = "SELECT json_set(?, ?, json(?))"
+
+	createRaftTablesStmt = `
+		CREATE TABLE IF NOT EXISTS raft_log (
+			idx INTEGER NOT NULL PRIMARY KEY,
+			term INTEGER NOT NULL,
+			type INTEGER NOT NULL,
+			data BLOB,
+			extensions BLOB,
+			appended_at INTEGER NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS raft_stable (
+			key BLOB NOT NULL PRIMARY KEY,
+			value BLOB NOT NULL
+		);`
+	truncateTableTpl       = "DELETE FROM %s"
+	attachSnapshotStmt     = "ATTACH DATABASE ? AS raft_snapshot"
+	detachSnapshotStmt     = "DETACH DATABASE raft_snapshot"
+	restoreFromSnapshotTpl = "INSERT INTO %s SELECT * FROM raft_snapshot.%s"
+
+	raftFirstIndexStmt  = "SELECT IFNULL(MIN(idx), 0) FROM raft_log"
+	raftLastIndexStmt   = "SELECT IFNULL(MAX(idx), 0) FROM raft_log"
+	raftGetLogStmt      = "SELECT term, type, data, extensions, appended_at FROM raft_log WHERE idx = ?"
+	raftStoreLogStmt    = "INSERT OR REPLACE INTO raft_log (idx, term, type, data, extensions, appended_at) VALUES (?, ?, ?, ?, ?, ?)"
+	raftDeleteRangeStmt = "DELETE FROM raft_log WHERE idx BETWEEN ? AND ?"
+	raftSetStableStmt   = "INSERT OR REPLACE INTO raft_stable (key, value) VALUES (?, ?)"
+	raftGetStableStmt   = "SELECT value FROM raft_stable WHERE key = ?"
+
+	statsTpl = `
+		SELECT
+			COUNT(*),
+			COUNT(CASE WHEN expiration_time IS NOT NULL AND expiration_time <= CURRENT_TIMESTAMP THEN 1 END)
+		FROM %s`
+
 	getValueTpl = `
-		SELECT value, is_binary, etag FROM %s
+		SELECT %[2]s FROM %[1]s
 	  	WHERE
 			key = ?
 	    	AND (expiration_time IS NULL OR expiration_time > CURRENT_TIMESTAMP)`
 
+	getValueSoftDeleteTpl = `
+		SELECT %[2]s FROM %[1]s
+		WHERE
+			key = ?
+			AND deletion_time IS NULL
+			AND (expiration_time IS NULL OR expiration_time > CURRENT_TIMESTAMP)`
+
 	delValueTpl         = "DELETE FROM %s WHERE key = ?"
 	delValueWithETagTpl = "DELETE FROM %s WHERE key = ? and etag = ?"
 
-	expirationTpl = "DATETIME(CURRENT_TIMESTAMP, '+%d seconds')"
-
+	// Times are UNIX timestamps, so the statements only depend on the table name and can be prepared once.
 	setValueTpl = `
-		INSERT OR REPLACE INTO %s
-			(key, value, is_binary, etag, update_time, expiration_time, creation_time)
-		VALUES(?, ?, ?, ?, CURRENT_TIMESTAMP, %s,
-			(SELECT creation_time FROM %s WHERE key=?));`
+		INSERT OR REPLACE INTO %[1]s
+			(key, value, is_binary, etag, metadata, sliding_ttl, update_time, expiration_time, creation_time)
+		VALUES(?, ?, ?, ?, ?, ?, DATETIME(?, 'unixepoch'), DATETIME(?, 'unixepoch'),
+			IFNULL((SELECT creation_time FROM %[1]s WHERE key=?), DATETIME(?, 'unixepoch')));`
+	// The boolean parameters keep the existing expiration time, metadata and sliding TTL instead of replacing them.
 	setValueWithETagTpl = `
 		UPDATE %s SET
 			value = ?,
 			etag = ?,
 			is_binary = ?,
-			update_time = CURRENT_TIMESTAMP,
-			expiration_time = %s
+			update_time = DATETIME(?, 'unixepoch'),
+			expiration_time = CASE WHEN ? THEN expiration_time ELSE DATETIME(?, 'unixepoch') END,
+			metadata = IFNULL(?, CASE WHEN ? THEN metadata END),
+			sliding_ttl = IFNULL(?, CASE WHEN ? THEN sliding_ttl END)
 		WHERE
 			key = ?
 			AND eTag = ?;`
+	setValueWithETagSoftDeleteTpl = `
+		UPDATE %s SET
+			value = ?,
+			etag = ?,
+			is_binary = ?,
+			update_time = DATETIME(?, 'unixepoch'),
+			expiration_time = CASE WHEN ? THEN expiration_time ELSE DATETIME(?, 'unixepoch') END,
+			metadata = IFNULL(?, CASE WHEN ? THEN metadata END),
+			sliding_ttl = IFNULL(?, CASE WHEN ? THEN sliding_ttl END)
+		WHERE
+			key = ?
+			AND eTag = ?
+			AND deletion_time IS NULL;`
 )
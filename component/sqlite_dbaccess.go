@@ -20,15 +20,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/dapr/components-contrib/state"
 	"github.com/dapr/kit/logger"
-
-	// Blank import for the underlying SQLite Driver.
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/dapr/kit/retry"
 )
 
 // DBAccess is a private interface which enables unit testing of SQLite.
@@ -45,14 +44,56 @@ type DBAccess interface {
 // sqliteDBAccess implements DBAccess.
 type sqliteDBAccess struct {
 	logger           logger.Logger
+	name             string
 	metadata         state.Metadata
 	connectionString string
 	tableName        string
 	db               *sql.DB
 	cleanupInterval  *time.Duration
+	timeout          time.Duration
+	busyTimeout      time.Duration
+	busyRetry        retry.Config
+	pragmas          pragmaSettings
+	inMemory         bool
+	persistFile      string
+	persistInterval  *time.Duration
+	memConn          *sql.Conn
+	readOnly         bool
+	replicator       *replicator
+	history          *historySettings
+	audit            *auditSettings
+	jsonIndexPaths   []string
+	fts              *ftsSettings
 	ctx              context.Context
 	cancel           context.CancelFunc
 
+	// If greater than zero, deleted rows are kept for this duration before they're purged.
+	softDeleteGracePeriod time.Duration
+
+	// Default and maximum TTLs of the keys, and the policies of the keys that match a pattern.
+	ttlLimits   ttlLimits
+	ttlPolicies []ttlPolicy
+	// Fraction of the window of sliding TTLs that must pass before a read renews the expiration.
+	slidingTTLRefresh float64
+	// Keys of the request metadata that are persisted with the values, besides contentType.
+	persistMetadataKeys []string
+	// False if the state table was created before metadata was persisted, and it can't be altered because it's read-only.
+	hasMetadataColumn bool
+	// If set, expired keys are captured by the cleanup and delivered to the handler.
+	expirations *expirationDispatcher
+	// If set, the store is in cache mode, and the least recently used rows are evicted when the state table exceeds the limits.
+	eviction *evictionSettings
+	// If set, rows read by Get are cached in memory.
+	readCache *readCache
+	// If set, concurrent writes are committed together.
+	groupCommit *groupCommitter
+	// Keys changed by the write in progress, whose side effects are applied once it's committed.
+	written []writtenKey
+	// Statements of the hot paths, prepared at Init.
+	stmts *preparedStatements
+	// Maximum size of the database in bytes, which is set before Init with tenant isolation, or 0 for no limit.
+	maxSize int64
+
 	// Lock only on public write API. Any public API's implementation should not call other public write APIs.
 	lock *sync.Mutex
 }
@@ -78,39 +119,264 @@ func (a *sqliteDBAccess) Init(metadata state.Metadata) error {
 	}
 	a.tableName = tableName
 
-	cleanupInterval, err := a.parseCleanupInterval(metadata)
+	cleanupInterval, err := parseCleanupInterval(metadata)
 	if err != nil {
 		return err
 	}
 	a.cleanupInterval = cleanupInterval
 
-	if val, ok := metadata.Properties[connectionStringKey]; ok && val != "" {
-		a.connectionString = val
+	a.timeout, err = parseTimeout(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.busyTimeout, err = parseBusyTimeout(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.busyRetry, err = parseBusyRetryConfig(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.readOnly, err = parseBool(metadata, readOnlyKey)
+	if err != nil {
+		return err
+	}
+
+	a.history, err = parseHistorySettings(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.softDeleteGracePeriod, err = parseSoftDelete(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.audit, err = parseAuditSettings(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.jsonIndexPaths, err = parseJSONIndexes(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.fts, err = parseFTSSettings(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.persistMetadataKeys, err = parsePersistMetadataKeys(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.slidingTTLRefresh, err = parseSlidingTTLRefresh(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.ttlLimits, err = parseTTLLimits(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.ttlPolicies, err = parseTTLPolicies(metadata)
+	if err != nil {
+		return err
+	}
+
+	notifyExpirations, err := parseExpirationNotifications(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.eviction, err = parseEvictionSettings(metadata)
+	if err != nil {
+		return err
+	}
+	if a.eviction != nil && a.readOnly {
+		return errors.New("cache mode is not supported in read-only mode")
+	}
+
+	a.readCache, err = parseReadCache(metadata)
+	if err != nil {
+		return err
+	}
+
+	a.groupCommit, err = parseGroupCommit(metadata)
+	if err != nil {
+		return err
+	}
+
+	profile, pragmas, err := parsePragmaSettings(metadata)
+	if err != nil {
+		return err
+	}
+	if a.readOnly {
+		if pragmas.journalMode != "" {
+			// Changing the journal mode requires writing to the database
+			a.logger.Warnf("Ignoring journal_mode=%s in read-only mode", pragmas.journalMode)
+			pragmas.journalMode = ""
+		}
+		pragmas.queryOnly = true
+	}
+	pragmas.maxSize = a.maxSize
+	a.pragmas = pragmas
+
+	a.inMemory, err = parseMode(metadata)
+	if err != nil {
+		return err
+	}
+
+	if a.inMemory {
+		a.persistFile = metadata.Properties[persistFileKey]
+		a.persistInterval, err = parsePersistInterval(metadata)
+		if err != nil {
+			return err
+		}
+		if metadata.Properties[connectionStringKey] != "" {
+			a.logger.Warnf("Ignoring the connection string in %s mode", modeMemory)
+		}
+		a.connectionString = connectionStringWithBusyTimeout(memoryConnectionString(), a.busyTimeout)
+	} else if val, ok := metadata.Properties[connectionStringKey]; ok && val != "" {
+		a.connectionString = connectionStringWithBusyTimeout(val, a.busyTimeout)
 	} else {
 		a.logger.Error("Missing SQLite connection string")
 
 		return errors.New(errMissingConnectionString)
 	}
 
-	db, err := sql.Open("sqlite3", a.connectionString)
+	err = a.initReplication(metadata)
 	if err != nil {
-		a.logger.Error(err)
 		return err
 	}
 
-	a.db = db
+	if profile == "" {
+		profile = "none"
+	}
+	a.logger.Infof("Using SQLite profile '%s': %s", profile, a.pragmas)
+
+	a.db = sql.OpenDB(newSqliteConnector(a.connectionString, a.pragmas))
 	a.ctx, a.cancel = context.WithCancel(context.Background())
 
 	if pingErr := a.Ping(a.ctx); pingErr != nil {
 		return pingErr
 	}
 
+	if a.inMemory {
+		err = a.initMemoryMode(a.ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.readCache != nil {
+		err = a.readCache.open(a.ctx, a.db)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.readOnly {
+		// In read-only mode, the state table must exist already and nothing is ever written
+		a.logger.Info("State store is in read-only mode")
+		err = a.checkStateTable(a.ctx, tableName)
+		if err != nil {
+			return err
+		}
+		a.hasMetadataColumn, err = columnExists(a.ctx, a.db, tableName, "metadata")
+		if err != nil {
+			return err
+		}
+		return a.prepareStatements(a.ctx)
+	}
+
 	err = a.ensureStateTable(a.ctx, tableName)
 	if err != nil {
 		return err
 	}
 
+	err = a.ensureColumn(a.ctx, "metadata", addMetadataColumnTpl)
+	if err != nil {
+		return err
+	}
+	a.hasMetadataColumn = true
+
+	err = a.ensureColumn(a.ctx, "sliding_ttl", addSlidingTTLColumnTpl)
+	if err != nil {
+		return err
+	}
+
+	err = a.syncCacheTable(a.ctx)
+	if err != nil {
+		return err
+	}
+
+	if a.softDeleteGracePeriod > 0 {
+		err = a.ensureDeletionTimeColumn(a.ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = a.syncJSONIndexes(a.ctx, a.jsonIndexPaths)
+	if err != nil {
+		return err
+	}
+
+	err = a.syncFullTextSearch(a.ctx)
+	if err != nil {
+		return err
+	}
+
+	if a.history != nil {
+		err = a.ensureHistoryTable(a.ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.audit != nil {
+		err = a.ensureAuditTable(a.ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = a.prepareStatements(a.ctx)
+	if err != nil {
+		return err
+	}
+
+	if notifyExpirations {
+		err = a.ensureExpiredTable(a.ctx)
+		if err != nil {
+			return err
+		}
+		a.expirations = newExpirationDispatcher(a.logger)
+		a.expirations.read = a.readExpired
+		a.expirations.ack = a.ackExpired
+	}
+
+	if a.replicator != nil {
+		err = a.replicator.start(a.ctx, a.db)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.groupCommit != nil {
+		a.groupCommit.start(a.ctx, a)
+	}
+
 	a.scheduleCleanupExpiredData()
+	a.scheduleEviction()
+	a.schedulePersist()
 
 	return nil
 }
@@ -119,148 +385,223 @@ func (a *sqliteDBAccess) Ping(parentCtx context.Context) error {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	ctx, cancel := context.WithTimeout(parentCtx, operationTimeout)
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
 	err := a.db.PingContext(ctx)
 	cancel()
-	return err
+	return classifyError(err)
 }
 
 func (a *sqliteDBAccess) Get(parentCtx context.Context, req *state.GetRequest) (*state.GetResponse, error) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-
-	if req.Key == "" {
-		return nil, errors.New("missing key in get operation")
-	}
-	var (
-		value    []byte
-		isBinary bool
-		etag     string
-	)
-
-	// Sprintf is required for table name because sql.DB does not substitute parameters for table names.
-	stmt := fmt.Sprintf(getValueTpl, a.tableName)
-	ctx, cancel := context.WithTimeout(parentCtx, operationTimeout)
-	err := a.db.QueryRowContext(ctx, stmt, req.Key).
-		Scan(&value, &isBinary, &etag)
-	cancel()
+	res, refresh, err := a.get(parentCtx, req)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return &state.GetResponse{
-				Metadata: req.Metadata,
-			}, nil
-		}
 		return nil, err
 	}
-	if isBinary {
-		var (
-			s    string
-			data []byte
-		)
-		if err = json.Unmarshal(value, &s); err != nil {
-			return nil, err
-		}
-		if data, err = base64.StdEncoding.DecodeString(s); err != nil {
-			return nil, err
+	if refresh {
+		// The value was read successfully, so failing to renew its expiration doesn't fail the request
+		err = a.refreshExpiration(parentCtx, req.Key, *res.ETag, writeContext{})
+		if err != nil {
+			a.logger.Warnf("Failed to renew the expiration of key '%s': %v", req.Key, err)
 		}
-		return &state.GetResponse{
-			Data:     data,
-			ETag:     &etag,
-			Metadata: req.Metadata,
-		}, nil
 	}
-	return &state.GetResponse{
-		Data:     value,
-		ETag:     &etag,
-		Metadata: req.Metadata,
-	}, nil
+	return res, nil
 }
 
-func (a *sqliteDBAccess) Set(parentCtx context.Context, req *state.SetRequest) error {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-
-	ctx, cancel := context.WithTimeout(parentCtx, operationTimeout)
-	defer cancel()
+// Reads a key, and returns true too if the expiration of the key should be renewed because it has a sliding TTL.
+func (a *sqliteDBAccess) get(parentCtx context.Context, req *state.GetRequest) (*state.GetResponse, bool, error) {
+	if req.Key == "" {
+		return nil, false, errors.New("missing key in get operation")
+	}
 
-	tx, err := a.db.BeginTx(ctx, nil)
+	row, err := a.readRow(parentCtx, req.Key)
 	if err != nil {
-		return err
+		return nil, false, err
+	}
+	if row == nil {
+		return &state.GetResponse{
+			Metadata: req.Metadata,
+		}, false, nil
 	}
-	defer tx.Rollback()
 
-	err = state.SetWithOptions(
-		func(req *state.SetRequest) error {
-			return a.setValue(tx, req)
-		},
-		req,
-	)
+	res := &state.GetResponse{
+		Data: row.value,
+		ETag: &row.etag,
+	}
+	if row.isBinary {
+		var s string
+		if err = json.Unmarshal(row.value, &s); err != nil {
+			return nil, false, err
+		}
+		if res.Data, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, false, err
+		}
+	}
+	err = setResponseMetadata(res, req.Metadata, row.metadata)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-
-	return tx.Commit()
+	return res, a.needsExpirationRefresh(row.slidingTTL, row.expiration, time.Now()), nil
 }
 
-func (a *sqliteDBAccess) Delete(parentCtx context.Context, req *state.DeleteRequest) error {
+// Returns the row of a key, or nil if it doesn't exist or it expired.
+// Rows in the read cache are returned without taking the lock, unless the access must be recorded for the cache mode.
+func (a *sqliteDBAccess) readRow(parentCtx context.Context, key string) (*currentValue, error) {
+	var version int64
+	if a.readCache != nil {
+		row, v, err := a.readCache.get(parentCtx, key, a.timeout)
+		if err != nil {
+			return nil, classifyError(err)
+		}
+		if row != nil {
+			if a.eviction != nil {
+				a.lock.Lock()
+				a.touch(parentCtx, key)
+				a.lock.Unlock()
+			}
+			return row, nil
+		}
+		version = v
+	}
+
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	ctx, cancel := context.WithTimeout(parentCtx, operationTimeout)
-	defer cancel()
-
-	tx, err := a.db.BeginTx(ctx, nil)
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	var row currentValue
+	err := a.stmts.get.QueryRowContext(ctx, key).
+		Scan(&row.value, &row.isBinary, &row.etag, &row.metadata, &row.slidingTTL, &row.expiration)
+	cancel()
 	if err != nil {
-		return err
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, classifyError(err)
 	}
-	defer tx.Rollback()
 
-	err = a.deleteValue(tx, req)
-	if err != nil {
-		return err
+	if a.readCache != nil {
+		a.readCache.put(key, row, version)
 	}
+	a.touch(parentCtx, key)
+	return &row, nil
+}
 
-	return tx.Commit()
+// Returns the columns selected by the prepared get statement.
+// Tables opened in read-only mode may have been created before the metadata column was added; their expiration is never renewed either.
+func (a *sqliteDBAccess) valueColumns() string {
+	metadata, slidingTTL := "metadata", "sliding_ttl"
+	if !a.hasMetadataColumn {
+		metadata = "NULL"
+	}
+	if a.readOnly {
+		slidingTTL = "NULL"
+	}
+	return "value, is_binary, etag, " + metadata + ", " + slidingTTL + ", expiration_time"
 }
 
-func (a *sqliteDBAccess) ExecuteMulti(parentCtx context.Context, reqs []state.TransactionalStateOperation) error {
-	a.lock.Lock()
-	defer a.lock.Unlock()
+func (a *sqliteDBAccess) Set(parentCtx context.Context, req *state.SetRequest) error {
+	if a.readOnly {
+		return NewStoreError(StoreErrorReadOnly, errors.New(errReadOnly))
+	}
 
-	ctx, cancel := context.WithTimeout(parentCtx, operationTimeout)
-	defer cancel()
+	return a.executeWrite(parentCtx, func(tx *sql.Tx) error {
+		err := state.SetWithOptions(
+			func(req *state.SetRequest) error {
+				return a.setValue(parentCtx, tx, req, writeContext{})
+			},
+			req,
+		)
+		if err != nil {
+			return err
+		}
+		return a.evictAfterWrite(tx)
+	})
+}
 
-	tx, err := a.db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
+func (a *sqliteDBAccess) Delete(parentCtx context.Context, req *state.DeleteRequest) error {
+	if a.readOnly {
+		return NewStoreError(StoreErrorReadOnly, errors.New(errReadOnly))
 	}
-	defer tx.Rollback()
 
-	for _, req := range reqs {
-		switch req.Operation {
-		case state.Upsert:
-			if setReq, ok := req.Request.(state.SetRequest); ok {
-				err = a.setValue(tx, &setReq)
-				if err != nil {
-					return err
-				}
-			} else {
-				return fmt.Errorf("expecting set request")
+	return a.executeWrite(parentCtx, func(tx *sql.Tx) error {
+		return a.deleteValue(parentCtx, tx, req, writeContext{})
+	})
+}
+
+func (a *sqliteDBAccess) ExecuteMulti(parentCtx context.Context, reqs []state.TransactionalStateOperation) error {
+	return a.executeMulti(parentCtx, reqs, nil)
+}
+
+// Executes the operations in a transaction.
+// If wcs is not nil, it contains the writeContext of each operation.
+func (a *sqliteDBAccess) executeMulti(parentCtx context.Context, reqs []state.TransactionalStateOperation, wcs []writeContext) error {
+	if a.readOnly {
+		return NewStoreError(StoreErrorReadOnly, errors.New(errReadOnly))
+	}
+
+	return a.executeWrite(parentCtx, func(tx *sql.Tx) error {
+		for i, req := range reqs {
+			var wc writeContext
+			if wcs != nil {
+				wc = wcs[i]
 			}
-		case state.Delete:
-			if delReq, ok := req.Request.(state.DeleteRequest); ok {
-				err = a.deleteValue(tx, &delReq)
-				if err != nil {
-					return err
+			switch req.Operation {
+			case state.Upsert:
+				if setReq, ok := req.Request.(state.SetRequest); ok {
+					err := a.setValue(parentCtx, tx, &setReq, wc)
+					if err != nil {
+						return err
+					}
+				} else {
+					return fmt.Errorf("expecting set request")
+				}
+			case state.Delete:
+				if delReq, ok := req.Request.(state.DeleteRequest); ok {
+					err := a.deleteValue(parentCtx, tx, &delReq, wc)
+					if err != nil {
+						return err
+					}
+				} else {
+					return fmt.Errorf("expecting delete request")
+				}
+			case OperationPatch:
+				if patchReq, ok := req.Request.(PatchRequest); ok {
+					err := a.patchValue(parentCtx, tx, &patchReq, wc)
+					if err != nil {
+						return err
+					}
+				} else {
+					return fmt.Errorf("expecting patch request")
 				}
-			} else {
-				return fmt.Errorf("expecting delete request")
+			case OperationIncrement:
+				if incrReq, ok := req.Request.(IncrementRequest); ok {
+					err := a.incrementValue(parentCtx, tx, &incrReq, wc)
+					if err != nil {
+						return err
+					}
+				} else {
+					return fmt.Errorf("expecting increment request")
+				}
+			default:
+				// Do nothing
 			}
-		default:
-			// Do nothing
 		}
+		return a.evictAfterWrite(tx)
+	})
+}
+
+// Returns the key of an operation in a transaction, or false if the operation has no key.
+func operationKey(req state.TransactionalStateOperation) (string, bool) {
+	switch r := req.Request.(type) {
+	case state.SetRequest:
+		return r.Key, true
+	case state.DeleteRequest:
+		return r.Key, true
+	case PatchRequest:
+		return r.Key, true
+	case IncrementRequest:
+		return r.Key, true
+	default:
+		return "", false
 	}
-	return tx.Commit()
 }
 
 // Close implements io.Close.
@@ -268,83 +609,215 @@ func (a *sqliteDBAccess) Close() error {
 	if a.cancel != nil {
 		a.cancel()
 	}
+	if a.expirations != nil {
+		a.expirations.stop()
+	}
+	if a.groupCommit != nil {
+		a.groupCommit.wait()
+	}
+
+	if evictionErr := a.closeEviction(); evictionErr != nil {
+		a.logger.Warnf("Failed to record the access time of keys: %v", evictionErr)
+	}
+
+	var err error
+	if a.replicator != nil {
+		err = a.replicator.stop()
+		if err != nil {
+			err = fmt.Errorf("failed to replicate database: %w", err)
+		}
+		a.replicator = nil
+	}
+	if a.memConn != nil {
+		if a.persistFile != "" && !a.readOnly {
+			err = a.persist()
+			if err != nil {
+				err = fmt.Errorf("failed to persist in-memory database: %w", err)
+			}
+		}
+		_ = a.memConn.Close()
+		a.memConn = nil
+	}
+	if a.readCache != nil {
+		a.readCache.close()
+	}
+	if a.stmts != nil {
+		a.stmts.close()
+	}
 	if a.db != nil {
 		_ = a.db.Close()
 	}
-	return nil
+	return err
 }
 
 // Create table if not exists.
 func (a *sqliteDBAccess) ensureStateTable(parentCtx context.Context, stateTableName string) error {
-	exists, err := tableExists(parentCtx, a.db, stateTableName)
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	exists, err := tableExists(ctx, a.db, stateTableName)
 	if err != nil || exists {
 		return err
 	}
 
 	a.logger.Infof("Creating SQLite state table '%s'", stateTableName)
 
-	ctx, cancel := context.WithTimeout(parentCtx, operationTimeout)
-	defer cancel()
+	return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		stmt := fmt.Sprintf(createTableTpl, stateTableName)
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
 
-	tx, err := a.db.BeginTx(ctx, nil)
-	if err != nil {
+		stmt = fmt.Sprintf(createTableExpirationTimeIdx, stateTableName, stateTableName)
+		_, err = tx.Exec(stmt)
 		return err
+	})
+}
+
+// Sets up replication if it's enabled in the metadata, restoring the database from the replica first if requested.
+func (a *sqliteDBAccess) initReplication(metadata state.Metadata) error {
+	if metadata.Properties[replicaTypeKey] == "" {
+		return nil
+	}
+	if a.inMemory || a.readOnly {
+		return errors.New("replication is not supported in memory or read-only mode")
 	}
-	defer tx.Rollback()
 
-	stmt := fmt.Sprintf(createTableTpl, stateTableName)
-	_, err = tx.Exec(stmt)
+	client, err := parseReplicaClient(metadata)
 	if err != nil {
 		return err
 	}
 
-	stmt = fmt.Sprintf(createTableExpirationTimeIdx, stateTableName, stateTableName)
-	_, err = tx.Exec(stmt)
+	a.replicator, err = a.newReplicator(metadata, client)
 	if err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	restore, err := parseReplicaRestore(metadata)
+	if err != nil || restore == nil {
+		return err
+	}
+	_, err = os.Stat(a.replicator.dbPath)
+	if err == nil {
+		a.logger.Infof("Database file '%s' exists already; skipping restore from replica", a.replicator.dbPath)
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = restoreReplica(context.Background(), a.logger, client, a.replicator.dbPath, *restore)
+	if errors.Is(err, errNoSnapshot) {
+		a.logger.Warn("No snapshot found in the replica; starting with an empty database")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to restore database from replica: %w", err)
+	}
+	return nil
 }
 
-// Check if table exists.
-func tableExists(parentCtx context.Context, db *sql.DB, tableName string) (bool, error) {
-	ctx, cancel := context.WithTimeout(parentCtx, operationTimeout)
+// Returns an error if the table does not exist.
+func (a *sqliteDBAccess) checkStateTable(parentCtx context.Context, stateTableName string) error {
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
 	defer cancel()
 
+	exists, err := tableExists(ctx, a.db, stateTableName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("state table '%s' does not exist", stateTableName)
+	}
+	return nil
+}
+
+// Adds a column to state tables created before it was introduced.
+func (a *sqliteDBAccess) ensureColumn(parentCtx context.Context, column string, addTpl string) error {
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	exists, err := columnExists(ctx, a.db, a.tableName, column)
+	if err != nil || exists {
+		return err
+	}
+
+	a.logger.Infof("Adding the %s column to the state table '%s'", column, a.tableName)
+	return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec(fmt.Sprintf(addTpl, a.tableName))
+		return err
+	})
+}
+
+// Check if table exists.
+func tableExists(ctx context.Context, db *sql.DB, tableName string) (bool, error) {
 	var exists string
 	// Returns 1 or 0 as a string if the table exists or not.
 	err := db.QueryRowContext(ctx, tableExistsStmt, tableName).Scan(&exists)
 	return exists == "1", err
 }
 
-func (a *sqliteDBAccess) setValue(tx *sql.Tx, req *state.SetRequest) error {
+func (a *sqliteDBAccess) setValue(ctx context.Context, tx *sql.Tx, req *state.SetRequest, wc writeContext) error {
 	r, err := prepareSetRequest(a, tx, req)
 	if err != nil {
 		return err
 	}
+	return a.executeSetRequest(ctx, tx, r, req, wc)
+}
+
+// Writes a parsed set request, with its side effects such as the history and the audit log.
+func (a *sqliteDBAccess) executeSetRequest(ctx context.Context, tx *sql.Tx, r *setRequest, req *state.SetRequest, wc writeContext) (err error) {
+	r.newEtag = wc.newETag
+	r.now = wc.now
+
+	var oldETag *string
+	if a.audit != nil {
+		oldETag, err = a.currentETag(tx, r.key)
+		if err != nil {
+			return err
+		}
+	}
 
-	hasUpdate, err := r.setValue()
+	hasUpdate, err := r.setValue(ctx)
 	if err != nil {
-		if req.ETag != nil && *req.ETag != "" {
-			return state.NewETagError(state.ETagMismatch, err)
-		}
 		return err
 	}
 
 	if !hasUpdate {
-		return fmt.Errorf("no item was updated")
+		if req.ETag != nil && *req.ETag != "" {
+			return state.NewETagError(state.ETagMismatch, nil)
+		}
+		return NewStoreError(StoreErrorConflict, errors.New("no item was updated"))
+	}
+	a.markWritten(r.key, true)
+
+	if a.history != nil {
+		err = a.appendHistory(tx, r.key, &r.value, r.isBinary, r.newEtag, wc.now)
+		if err != nil {
+			return err
+		}
+	}
+	if a.audit != nil {
+		return a.appendAudit(tx, r.key, state.Upsert, oldETag, &r.newEtag, req.Metadata, wc.now)
 	}
 	return nil
 }
 
-func (a *sqliteDBAccess) deleteValue(tx *sql.Tx, req *state.DeleteRequest) error {
+func (a *sqliteDBAccess) deleteValue(ctx context.Context, tx *sql.Tx, req *state.DeleteRequest, wc writeContext) error {
 	r, err := prepareDeleteRequest(a, tx, req)
 	if err != nil {
 		return err
 	}
+	r.now = wc.now
+
+	var oldETag *string
+	if a.audit != nil {
+		oldETag, err = a.currentETag(tx, r.key)
+		if err != nil {
+			return err
+		}
+	}
 
-	hasUpdate, err := r.deleteValue()
+	hasUpdate, err := r.deleteValue(ctx)
 	if err != nil {
 		return err
 	}
@@ -352,6 +825,20 @@ func (a *sqliteDBAccess) deleteValue(tx *sql.Tx, req *state.DeleteRequest) error
 	if !hasUpdate && req.ETag != nil && *req.ETag != "" {
 		return state.NewETagError(state.ETagMismatch, nil)
 	}
+
+	if !hasUpdate {
+		return nil
+	}
+	a.markWritten(r.key, false)
+	if a.history != nil {
+		err = a.appendHistory(tx, r.key, nil, false, "", wc.now)
+		if err != nil {
+			return err
+		}
+	}
+	if a.audit != nil {
+		return a.appendAudit(tx, r.key, state.Delete, oldETag, nil, req.Metadata, wc.now)
+	}
 	return nil
 }
 
@@ -380,40 +867,72 @@ func (a *sqliteDBAccess) cleanupTimeout() {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	ctx, cancel := context.WithTimeout(a.ctx, operationTimeout)
+	ctx, cancel := context.WithTimeout(a.ctx, a.timeout)
 	defer cancel()
 
-	tx, err := a.db.BeginTx(ctx, nil)
+	cleaned, err := a.deleteExpired(ctx, time.Time{})
 	if err != nil {
-		a.logger.Errorf("Error removing expired data: failed to begin transaction: %v", err)
+		a.logger.Errorf("Error removing expired data: %v", err)
 		return
 	}
-	defer tx.Rollback()
-
-	stmt := fmt.Sprintf(cleanupTimeoutStmtTpl, a.tableName)
-	res, err := tx.Exec(stmt)
-	if err != nil {
-		a.logger.Errorf("Error removing expired data: failed to execute query: %v", err)
-		return
+	if cleaned > 0 && a.expirations != nil {
+		a.expirations.notify()
 	}
 
-	cleaned, err := res.RowsAffected()
-	if err != nil {
-		a.logger.Errorf("Error removing expired data: failed to count affected rows: %v", err)
-		return
-	}
+	a.logger.Debugf("Removed %d expired rows", cleaned)
+}
 
-	err = tx.Commit()
-	if err != nil {
-		a.logger.Errorf("Error removing expired data: failed to commit transaction: %v", err)
-		return
-	}
+// Deletes the rows that expired before the given time, or before the current time if it's zero.
+func (a *sqliteDBAccess) deleteExpired(ctx context.Context, before time.Time) (cleaned int64, err error) {
+	err = a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		_, err = a.captureExpired(tx, before)
+		if err != nil {
+			return err
+		}
 
-	a.logger.Debugf("Removed %d expired rows", cleaned)
+		var res sql.Result
+		if before.IsZero() {
+			res, err = tx.Exec(fmt.Sprintf(cleanupTimeoutStmtTpl, a.tableName))
+		} else {
+			res, err = tx.Exec(fmt.Sprintf(cleanupExpiredBeforeStmtTpl, a.tableName), before.Unix())
+		}
+		if err != nil {
+			return fmt.Errorf("failed to execute query: %w", err)
+		}
+
+		cleaned, err = res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to count affected rows: %w", err)
+		}
+
+		now := before
+		if now.IsZero() {
+			now = time.Now()
+		}
+
+		removed, err := a.enforceMaxAge(tx, now)
+		if err != nil {
+			return err
+		}
+		cleaned += removed
+
+		purged, err := a.purgeDeleted(tx, now)
+		if err != nil {
+			return err
+		}
+		cleaned += purged
+
+		err = a.pruneHistory(tx, now)
+		if err != nil {
+			return err
+		}
+		return a.pruneAudit(tx, now)
+	})
+	return cleaned, err
 }
 
 // Returns nil duration means never cleanup expired data.
-func (a *sqliteDBAccess) parseCleanupInterval(metadata state.Metadata) (*time.Duration, error) {
+func parseCleanupInterval(metadata state.Metadata) (*time.Duration, error) {
 	s, ok := metadata.Properties[cleanupIntervalKey]
 	if ok && s != "" {
 		cleanupIntervalInSec, err := strconv.ParseInt(s, 10, 0)
@@ -434,6 +953,20 @@ func (a *sqliteDBAccess) parseCleanupInterval(metadata state.Metadata) (*time.Du
 	return nil, nil
 }
 
+// Returns the value of a boolean metadata property, which is false if not set.
+func parseBool(metadata state.Metadata, key string) (bool, error) {
+	s, ok := metadata.Properties[key]
+	if !ok || s == "" {
+		return false, nil
+	}
+
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("illegal %s value: %s", key, s)
+	}
+	return v, nil
+}
+
 // Validates an identifier, such as table or DB name.
 func validIdentifier(v string) bool {
 	if v == "" {
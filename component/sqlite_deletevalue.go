@@ -14,20 +14,27 @@ limitations under the License.
 package component
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/dapr/components-contrib/state"
 )
 
 // Parsed DeleteRequest.
 type deleteRequest struct {
-	tx        *sql.Tx
-	tableName string
+	tx    *sql.Tx
+	stmts *preparedStatements
 
 	key         string
 	concurrency *string
 	etag        *string
+
+	// If true, the row is marked as deleted instead of being removed.
+	softDelete bool
+	// If set, used as the deletion time instead of the current time.
+	now time.Time
 }
 
 func prepareDeleteRequest(a *sqliteDBAccess, tx *sql.Tx, req *state.DeleteRequest) (*deleteRequest, error) {
@@ -45,29 +52,58 @@ func prepareDeleteRequest(a *sqliteDBAccess, tx *sql.Tx, req *state.DeleteReques
 		return nil, fmt.Errorf("when FirstWrite is to be enforced, a value must be provided for the ETag")
 	}
 	return &deleteRequest{
-		tx:        tx,
-		tableName: a.tableName,
+		tx:    tx,
+		stmts: a.stmts,
 
 		key:         req.Key,
 		concurrency: &req.Options.Concurrency,
 		etag:        req.ETag,
+		softDelete:  a.softDeleteGracePeriod > 0,
 	}, nil
 }
 
 // Returns if any value deleted, or an execution error.
-func (req *deleteRequest) deleteValue() (bool, error) {
+func (req *deleteRequest) deleteValue(ctx context.Context) (bool, error) {
+	var (
+		result sql.Result
+		err    error
+	)
+	if req.softDelete {
+		return req.softDeleteValue(ctx)
+	}
+	if req.etag == nil || *req.etag == "" {
+		result, err = req.stmts.bind(ctx, req.tx, req.stmts.delete).Exec(req.key)
+	} else {
+		result, err = req.stmts.bind(ctx, req.tx, req.stmts.deleteWithETag).Exec(req.key, *req.etag)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+// Marks the row as deleted, and returns if any row was marked.
+func (req *deleteRequest) softDeleteValue(ctx context.Context) (bool, error) {
+	now := req.now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
 	var (
 		result sql.Result
 		err    error
 	)
+	// The statements prepared in soft delete mode mark the row as deleted
 	if req.etag == nil || *req.etag == "" {
-		// Sprintf is required for table name because sql.DB does not substitute parameters for table names.
-		stmt := fmt.Sprintf(delValueTpl, req.tableName)
-		result, err = req.tx.Exec(stmt, req.key)
+		result, err = req.stmts.bind(ctx, req.tx, req.stmts.delete).Exec(now.Unix(), req.key)
 	} else {
-		// Sprintf is required for table name because sql.DB does not substitute parameters for table names.
-		stmt := fmt.Sprintf(delValueWithETagTpl, req.tableName)
-		result, err = req.tx.Exec(stmt, req.key, *req.etag)
+		result, err = req.stmts.bind(ctx, req.tx, req.stmts.deleteWithETag).Exec(now.Unix(), req.key, *req.etag)
 	}
 
 	if err != nil {
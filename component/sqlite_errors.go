@@ -0,0 +1,135 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// StoreErrorKind is the kind of a StoreError.
+type StoreErrorKind string
+
+const (
+	// StoreErrorUnavailable is used when the database is temporarily unavailable, for example because it's locked by another connection.
+	// The operation can be retried.
+	StoreErrorUnavailable StoreErrorKind = "unavailable"
+	// StoreErrorResourceExhausted is used when the disk is full, the database reached its maximum size, or SQLite ran out of memory.
+	StoreErrorResourceExhausted StoreErrorKind = "resource exhausted"
+	// StoreErrorReadOnly is used when attempting to write to a database that is read-only.
+	StoreErrorReadOnly StoreErrorKind = "read-only"
+	// StoreErrorConflict is used when a write conflicts with the data already in the database.
+	StoreErrorConflict StoreErrorKind = "conflict"
+	// StoreErrorIO is used when the database file can't be opened, read or written, for example because of a disk fault or a missing file.
+	// These faults are not transient, so the operation is not retried.
+	StoreErrorIO StoreErrorKind = "I/O error"
+)
+
+// StoreError is a custom error type for errors returned by the state store.
+type StoreError struct {
+	err  error
+	kind StoreErrorKind
+}
+
+// NewStoreError returns a StoreError wrapping an existing error.
+func NewStoreError(kind StoreErrorKind, err error) *StoreError {
+	return &StoreError{
+		err:  err,
+		kind: kind,
+	}
+}
+
+func (e *StoreError) Kind() StoreErrorKind {
+	return e.kind
+}
+
+func (e *StoreError) Error() string {
+	if e.err != nil {
+		return string(e.kind) + ": " + e.err.Error()
+	}
+	return string(e.kind)
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.err
+}
+
+// Retryable returns true if the operation that returned the error can be retried as-is.
+func (e *StoreError) Retryable() bool {
+	return e.kind == StoreErrorUnavailable
+}
+
+// GRPCStatus returns the gRPC status for the error.
+// This is used by the gRPC server when the error is returned to the Dapr runtime.
+func (e *StoreError) GRPCStatus() *status.Status {
+	var code codes.Code
+	switch e.kind {
+	case StoreErrorUnavailable:
+		code = codes.Unavailable
+	case StoreErrorResourceExhausted:
+		code = codes.ResourceExhausted
+	case StoreErrorReadOnly:
+		code = codes.FailedPrecondition
+	case StoreErrorConflict:
+		code = codes.Aborted
+	case StoreErrorIO:
+		code = codes.Internal
+	default:
+		code = codes.Unknown
+	}
+	return status.New(code, e.Error())
+}
+
+// IsRetryableError returns true if err is a StoreError that can be retried.
+func IsRetryableError(err error) bool {
+	var storeErr *StoreError
+	return errors.As(err, &storeErr) && storeErr.Retryable()
+}
+
+// Converts errors returned by SQLite into StoreError objects.
+// Errors that are already classified, and errors that are not known, are returned as-is.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var (
+		storeErr  *StoreError
+		etagErr   *state.ETagError
+		sqliteErr sqlite3.Error
+	)
+	if errors.As(err, &storeErr) || errors.As(err, &etagErr) || !errors.As(err, &sqliteErr) {
+		return err
+	}
+
+	switch sqliteErr.Code {
+	case sqlite3.ErrBusy, sqlite3.ErrLocked:
+		return NewStoreError(StoreErrorUnavailable, err)
+	case sqlite3.ErrIoErr, sqlite3.ErrCantOpen:
+		return NewStoreError(StoreErrorIO, err)
+	case sqlite3.ErrFull, sqlite3.ErrNomem, sqlite3.ErrTooBig:
+		return NewStoreError(StoreErrorResourceExhausted, err)
+	case sqlite3.ErrReadonly, sqlite3.ErrPerm:
+		return NewStoreError(StoreErrorReadOnly, err)
+	case sqlite3.ErrConstraint:
+		return NewStoreError(StoreErrorConflict, err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,415 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// CacheStats contains the size and the evictions of one of the databases used by the state store in cache mode.
+type CacheStats struct {
+	// Name of the database, which is empty unless the store uses multiple databases.
+	Name string
+	// Number of rows in the state table, and their size in bytes (keys and values).
+	Rows  int64
+	Bytes int64
+	// Limits of the cache, where 0 means no limit.
+	MaxRows  int64
+	MaxBytes int64
+	// Number of rows evicted since the cache was created, and their size in bytes.
+	EvictedRows  int64
+	EvictedBytes int64
+}
+
+// cacheDBAccess is implemented by DBAccess objects that can report the statistics of the cache mode.
+type cacheDBAccess interface {
+	cacheStats(ctx context.Context) ([]CacheStats, error)
+}
+
+// evictionSettings are the limits of the state table in cache mode, in which the least recently used rows are evicted.
+type evictionSettings struct {
+	maxRows  int64
+	maxBytes int64
+	// If greater than zero, rows are evicted in the background at this interval, rather than in the transaction of each write.
+	interval time.Duration
+	// Time of the last access to keys, in nanoseconds, which hasn't been written to the database yet.
+	// Protected by the lock of the sqliteDBAccess.
+	accesses map[string]int64
+}
+
+// Returns the settings of the cache mode, or nil if it's not enabled.
+func parseEvictionSettings(metadata state.Metadata) (*evictionSettings, error) {
+	res := &evictionSettings{
+		accesses: map[string]int64{},
+	}
+	var err error
+	res.maxRows, err = parseLimitProperty(metadata, cacheMaxRowsKey)
+	if err != nil {
+		return nil, err
+	}
+	res.maxBytes, err = parseLimitProperty(metadata, cacheMaxBytesKey)
+	if err != nil {
+		return nil, err
+	}
+	if res.maxRows == 0 && res.maxBytes == 0 {
+		if metadata.Properties[cacheEvictionIntervalKey] != "" {
+			return nil, fmt.Errorf("%s requires %s or %s", cacheEvictionIntervalKey, cacheMaxRowsKey, cacheMaxBytesKey)
+		}
+		return nil, nil
+	}
+	res.interval, err = parseDurationProperty(metadata, cacheEvictionIntervalKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Returns the value of a metadata property with a positive limit, or 0 if not set.
+func parseLimitProperty(metadata state.Metadata, key string) (int64, error) {
+	s := metadata.Properties[key]
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("illegal %s value: %s", key, s)
+	}
+	return v, nil
+}
+
+func (a *sqliteDBAccess) cacheTableName() string {
+	return a.tableName + cacheTableSuffix
+}
+
+func (a *sqliteDBAccess) cacheTriggerNames() []string {
+	prefix := a.cacheTableName()
+	return []string{prefix + "_insert_before", prefix + "_insert", prefix + "_update", prefix + "_delete"}
+}
+
+// Returns the SQL expression for the size of a row in bytes.
+// row is the prefix of the columns, such as "new.", or empty.
+func rowSizeExpr(row string) string {
+	return "(LENGTH(CAST(" + row + "key AS BLOB)) + LENGTH(CAST(" + row + "value AS BLOB)))"
+}
+
+// Creates or removes the table of the cache mode and its triggers, depending on whether it's enabled.
+// When it's enabled, the size of the state table is recomputed, since it may have changed while it wasn't.
+func (a *sqliteDBAccess) syncCacheTable(parentCtx context.Context) error {
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	cacheTable := a.cacheTableName()
+	triggers := a.cacheTriggerNames()
+
+	if a.eviction == nil {
+		exists, err := tableExists(ctx, a.db, cacheTable)
+		if err != nil || !exists {
+			return err
+		}
+		a.logger.Infof("Removing cache table '%s'", cacheTable)
+		return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+			for _, name := range triggers {
+				_, err := tx.Exec(fmt.Sprintf(dropTriggerTpl, name))
+				if err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(fmt.Sprintf(dropTableTpl, cacheTable))
+			return err
+		})
+	}
+
+	err := a.ensureColumn(ctx, "last_access", addLastAccessColumnTpl)
+	if err != nil {
+		return err
+	}
+
+	stmts := []string{
+		fmt.Sprintf(createCacheInsertBeforeTriggerTpl, triggers[0], a.tableName, cacheTable, rowSizeExpr("")),
+		fmt.Sprintf(createCacheInsertTriggerTpl, triggers[1], a.tableName, cacheTable, rowSizeExpr("new.")),
+		fmt.Sprintf(createCacheUpdateTriggerTpl, triggers[2], a.tableName, cacheTable, rowSizeExpr("old."), rowSizeExpr("new.")),
+		fmt.Sprintf(createCacheDeleteTriggerTpl, triggers[3], a.tableName, cacheTable, rowSizeExpr("old.")),
+	}
+	return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec(fmt.Sprintf(createLastAccessIndexTpl, a.tableName, a.tableName))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf(createCacheTableTpl, cacheTable))
+		if err != nil {
+			return err
+		}
+		for i, name := range triggers {
+			_, err = tx.Exec(fmt.Sprintf(dropTriggerTpl, name))
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(stmts[i])
+			if err != nil {
+				return fmt.Errorf("failed to create trigger '%s': %w", name, err)
+			}
+		}
+		_, err = tx.Exec(fmt.Sprintf(resetCacheSizeTpl, cacheTable, a.tableName, rowSizeExpr("")))
+		return err
+	})
+}
+
+// Records an access to a key in cache mode, which must be called with the lock held.
+// Access times are buffered and written when rows are evicted.
+func (a *sqliteDBAccess) recordAccess(key string) {
+	if a.eviction != nil {
+		a.eviction.accesses[key] = time.Now().UnixNano()
+	}
+}
+
+// Records a read of a key in cache mode, which must be called with the lock held.
+// Once maxPendingAccesses are buffered, they're written in a transaction.
+func (a *sqliteDBAccess) touch(ctx context.Context, key string) {
+	if a.eviction == nil {
+		return
+	}
+	a.recordAccess(key)
+	if len(a.eviction.accesses) < maxPendingAccesses {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	err := a.executeInTransaction(ctx, a.flushAccesses)
+	if err != nil {
+		a.logger.Warnf("Failed to record the access time of keys: %v", err)
+	}
+}
+
+// Writes the buffered access times to the database.
+// Keys set by the write in progress are the most recently used, even though their access is only buffered once the write is committed.
+func (a *sqliteDBAccess) flushAccesses(tx *sql.Tx) error {
+	stmt := fmt.Sprintf(setLastAccessTpl, a.tableName)
+	for key, t := range a.eviction.accesses {
+		_, err := tx.Exec(stmt, t, key)
+		if err != nil {
+			return fmt.Errorf("failed to record the access time of key '%s': %w", key, err)
+		}
+	}
+	a.eviction.accesses = map[string]int64{}
+
+	now := time.Now().UnixNano()
+	for _, k := range a.written {
+		if !k.set {
+			continue
+		}
+		_, err := tx.Exec(stmt, now, k.key)
+		if err != nil {
+			return fmt.Errorf("failed to record the access time of key '%s': %w", k.key, err)
+		}
+	}
+	return nil
+}
+
+// Evicts rows in the transaction of a write, unless they're evicted in the background.
+func (a *sqliteDBAccess) evictAfterWrite(tx *sql.Tx) error {
+	if a.eviction == nil || a.eviction.interval > 0 {
+		return nil
+	}
+	_, err := a.evict(tx)
+	return err
+}
+
+// Evicts the least recently used rows until the state table is within the limits, and returns how many were evicted.
+func (a *sqliteDBAccess) evict(tx *sql.Tx) (int64, error) {
+	err := a.flushAccesses(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	var rows, size, evictedRows, evictedBytes int64
+	err = tx.QueryRow(fmt.Sprintf(getCacheStatsTpl, a.cacheTableName())).Scan(&rows, &size, &evictedRows, &evictedBytes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the size of the cache: %w", err)
+	}
+	excessRows := rows - a.eviction.maxRows
+	if a.eviction.maxRows == 0 {
+		excessRows = 0
+	}
+	excessBytes := size - a.eviction.maxBytes
+	if a.eviction.maxBytes == 0 {
+		excessBytes = 0
+	}
+	if excessRows <= 0 && excessBytes <= 0 {
+		return 0, nil
+	}
+
+	var keys []string
+	var bytes int64
+	err = func() error {
+		res, err := tx.Query(fmt.Sprintf(listLeastRecentlyUsedTpl, rowSizeExpr(""), a.tableName))
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+		for (excessRows > int64(len(keys)) || excessBytes > bytes) && res.Next() {
+			var (
+				key string
+				n   int64
+			)
+			err = res.Scan(&key, &n)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			bytes += n
+		}
+		return res.Err()
+	}()
+	if err != nil {
+		return 0, fmt.Errorf("failed to select the rows to evict: %w", err)
+	}
+
+	for _, key := range keys {
+		_, err = tx.Exec(fmt.Sprintf(deleteKeyTpl, a.tableName), key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to evict key '%s': %w", key, err)
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf(addEvictedTpl, a.cacheTableName()), len(keys), bytes)
+	if err != nil {
+		return 0, err
+	}
+	a.logger.Debugf("Evicted %d rows (%d bytes)", len(keys), bytes)
+	return int64(len(keys)), nil
+}
+
+func (a *sqliteDBAccess) scheduleEviction() {
+	if a.eviction == nil || a.eviction.interval <= 0 {
+		return
+	}
+
+	a.logger.Infof("Schedule eviction of least recently used rows every %v", a.eviction.interval)
+
+	ticker := time.NewTicker(a.eviction.interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := a.evictInBackground()
+				if err != nil {
+					a.logger.Errorf("Error evicting rows: %v", err)
+				}
+			case <-a.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Writes the buffered access times when the database is closed.
+func (a *sqliteDBAccess) closeEviction() error {
+	if a.eviction == nil || len(a.eviction.accesses) == 0 {
+		return nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	return a.executeInTransaction(ctx, a.flushAccesses)
+}
+
+func (a *sqliteDBAccess) evictInBackground() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(a.ctx, a.timeout)
+	defer cancel()
+
+	return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		_, err := a.evict(tx)
+		return err
+	})
+}
+
+func (a *sqliteDBAccess) cacheStats(parentCtx context.Context) ([]CacheStats, error) {
+	if a.eviction == nil {
+		return nil, errors.New("cache mode is not enabled")
+	}
+
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	res := CacheStats{
+		Name:     a.name,
+		MaxRows:  a.eviction.maxRows,
+		MaxBytes: a.eviction.maxBytes,
+	}
+	err := a.db.QueryRowContext(ctx, fmt.Sprintf(getCacheStatsTpl, a.cacheTableName())).
+		Scan(&res.Rows, &res.Bytes, &res.EvictedRows, &res.EvictedBytes)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	return []CacheStats{res}, nil
+}
+
+func (s *shardedDBAccess) cacheStats(ctx context.Context) ([]CacheStats, error) {
+	res := make([]CacheStats, 0, len(s.shards))
+	for _, shard := range s.shards {
+		stats, err := shard.cacheStats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, stats...)
+	}
+	return res, nil
+}
+
+func (t *tenantDBAccess) cacheStats(ctx context.Context) ([]CacheStats, error) {
+	tenants, err := t.listTenants()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]CacheStats, 0, len(tenants))
+	for _, tenant := range tenants {
+		a, err := t.acquire(tenant)
+		if err != nil {
+			return nil, err
+		}
+		stats, err := a.cacheStats(ctx)
+		t.release(tenant)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, stats...)
+	}
+	return res, nil
+}
+
+// CacheStats returns the size and the evictions of each database used by the state store in cache mode.
+// The limits apply to each database separately.
+func (s *SQLiteStore) CacheStats(ctx context.Context) ([]CacheStats, error) {
+	a, ok := s.dbaccess.(cacheDBAccess)
+	if !ok {
+		return nil, errors.New("cache mode is not supported")
+	}
+	return a.cacheStats(ctx)
+}
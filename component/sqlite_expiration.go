@@ -0,0 +1,126 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// ttlLimits are the component-level TTLs, in seconds, where 0 means not set.
+type ttlLimits struct {
+	// TTL of keys written without one.
+	defaultTTL int64
+	// Maximum TTL of keys, which also applies to keys written without one.
+	maxTTL int64
+}
+
+func parseTTLLimits(metadata state.Metadata) (res ttlLimits, err error) {
+	res.defaultTTL, err = parseSecondsProperty(metadata, defaultTTLKey)
+	if err != nil {
+		return res, err
+	}
+	res.maxTTL, err = parseSecondsProperty(metadata, maxTTLKey)
+	if err != nil {
+		return res, err
+	}
+	if res.maxTTL > 0 && res.defaultTTL > res.maxTTL {
+		return res, fmt.Errorf("illegal %s value: %d is greater than %s", defaultTTLKey, res.defaultTTL, maxTTLKey)
+	}
+	return res, nil
+}
+
+// Returns the value of a metadata property with a positive number of seconds, or 0 if not set.
+func parseSecondsProperty(metadata state.Metadata, key string) (int64, error) {
+	s, ok := metadata.Properties[key]
+	if !ok || s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("illegal %s value: %s", key, s)
+	}
+	return v, nil
+}
+
+// Returns the absolute expiration time of a write, or nil if it has none.
+// The time is either in RFC 3339 format or a UNIX timestamp in seconds.
+func parseExpireAt(requestMetadata map[string]string) (*time.Time, error) {
+	val, ok := requestMetadata[metadataExpireAtKey]
+	if !ok || val == "" {
+		return nil, nil
+	}
+	if requestMetadata[metadataTTLKey] != "" || requestMetadata[metadataSlidingTTLKey] != "" {
+		return nil, fmt.Errorf("%s can't be used together with %s or %s", metadataExpireAtKey, metadataTTLKey, metadataSlidingTTLKey)
+	}
+
+	if epoch, err := strconv.ParseInt(val, 10, 64); err == nil {
+		t := time.Unix(epoch, 0)
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect value for %s: %s", metadataExpireAtKey, val)
+	}
+	return &t, nil
+}
+
+// Returns the expiration time of a row that is written as a UNIX timestamp, relative to req.now if set, or nil if it doesn't expire.
+// Keys written without a TTL get the default TTL, and no key can outlive the maximum TTL.
+func (req *setRequest) expiration() (*int64, error) {
+	now := time.Unix(req.timestamp(), 0)
+
+	var ttl int64
+	hasTTL := true
+	switch {
+	case req.expireAt != nil:
+		if !req.expireAt.After(now) {
+			return nil, fmt.Errorf("the value of %s is not in the future: %s", metadataExpireAtKey, req.expireAt.UTC().Format(time.RFC3339))
+		}
+		if req.ttlLimits.maxTTL == 0 || req.expireAt.Before(now.Add(time.Duration(req.ttlLimits.maxTTL)*time.Second)) {
+			exp := req.expireAt.Unix()
+			return &exp, nil
+		}
+		ttl = req.ttlLimits.maxTTL
+	case req.ttlSeconds != nil:
+		ttl = *req.ttlSeconds
+	case req.noExpiration:
+		// A TTL of -1 opts out of the default TTL, but not of the maximum one
+		hasTTL = false
+	default:
+		ttl = req.ttlLimits.defaultTTL
+		hasTTL = ttl > 0
+	}
+
+	if req.ttlLimits.maxTTL > 0 && (!hasTTL || ttl > req.ttlLimits.maxTTL) {
+		ttl = req.ttlLimits.maxTTL
+		hasTTL = true
+	}
+	if !hasTTL {
+		return nil, nil
+	}
+	exp := now.Unix() + ttl
+	return &exp, nil
+}
+
+// Returns the creation and update time of a row that is written as a UNIX timestamp, which is req.now if set.
+func (req *setRequest) timestamp() int64 {
+	if req.now.IsZero() {
+		return time.Now().Unix()
+	}
+	return req.now.Unix()
+}
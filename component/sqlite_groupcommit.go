@@ -0,0 +1,255 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// groupCommitter applies concurrent writes together in a single transaction, so they share the cost of the commit.
+// Each write runs in its own savepoint, so a write that fails is rolled back without affecting the others.
+type groupCommitter struct {
+	a *sqliteDBAccess
+	// Maximum time a write waits for others to join its transaction, and maximum number of writes in a transaction.
+	maxDelay time.Duration
+	maxBatch int
+
+	queue chan *groupWrite
+	// Closed when the committer stops.
+	stopped chan struct{}
+}
+
+// A write waiting to be committed.
+// Writes whose context is done before they're applied are skipped, so they're never committed after the caller gave up.
+type groupWrite struct {
+	ctx  context.Context
+	fn   func(tx *sql.Tx) error
+	done chan error
+}
+
+// Returns the group committer configured in the metadata, or nil if group commit is not enabled.
+func parseGroupCommit(metadata state.Metadata) (*groupCommitter, error) {
+	if metadata.Properties[groupCommitMaxDelayKey] == "" && metadata.Properties[groupCommitMaxBatchKey] == "" {
+		return nil, nil
+	}
+
+	maxDelay, err := parseDurationProperty(metadata, groupCommitMaxDelayKey, defaultGroupCommitMaxDelay)
+	if err != nil {
+		return nil, err
+	}
+	maxBatch, err := parseLimitProperty(metadata, groupCommitMaxBatchKey)
+	if err != nil {
+		return nil, err
+	}
+	if maxBatch == 0 {
+		maxBatch = defaultGroupCommitMaxBatch
+	}
+	return &groupCommitter{
+		maxDelay: maxDelay,
+		maxBatch: int(maxBatch),
+		queue:    make(chan *groupWrite),
+		stopped:  make(chan struct{}),
+	}, nil
+}
+
+// Starts committing writes until ctx is done.
+func (g *groupCommitter) start(ctx context.Context, a *sqliteDBAccess) {
+	g.a = a
+	a.logger.Infof("Group commit enabled with a maximum delay of %v and up to %d writes per transaction", g.maxDelay, g.maxBatch)
+	go g.run(ctx)
+}
+
+// Queues a write, and waits until it's committed or rolled back.
+func (g *groupCommitter) submit(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	w := &groupWrite{
+		ctx:  ctx,
+		fn:   fn,
+		done: make(chan error, 1),
+	}
+	select {
+	case g.queue <- w:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-g.stopped:
+		return errStoreClosed
+	}
+
+	// Once queued, the write is either committed or rolled back, so its result is awaited even if ctx is done
+	select {
+	case err := <-w.done:
+		return err
+	case <-g.stopped:
+		select {
+		case err := <-w.done:
+			return err
+		default:
+			return errStoreClosed
+		}
+	}
+}
+
+func (g *groupCommitter) run(ctx context.Context) {
+	defer close(g.stopped)
+
+	for {
+		var batch []*groupWrite
+		select {
+		case w := <-g.queue:
+			batch = appendWrite(batch, w)
+		case <-ctx.Done():
+			return
+		}
+
+		timer := time.NewTimer(g.maxDelay)
+	collect:
+		for len(batch) < g.maxBatch {
+			select {
+			case w := <-g.queue:
+				batch = appendWrite(batch, w)
+			case <-timer.C:
+				break collect
+			case <-ctx.Done():
+				break collect
+			}
+		}
+		timer.Stop()
+
+		if len(batch) > 0 {
+			g.commit(batch)
+		}
+	}
+}
+
+// Adds a write to the batch, unless its context is done already.
+func appendWrite(batch []*groupWrite, w *groupWrite) []*groupWrite {
+	if err := w.ctx.Err(); err != nil {
+		w.done <- err
+		return batch
+	}
+	return append(batch, w)
+}
+
+// Applies a batch of writes in a transaction, and sends each write its own result.
+// The side effects of the writes outside the database are only applied for those that were committed.
+func (g *groupCommitter) commit(batch []*groupWrite) {
+	a := g.a
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	results := make([]error, len(batch))
+	err := a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		// The transaction is retried as a whole if the database is busy
+		a.written = nil
+		for i, w := range batch {
+			results[i] = w.ctx.Err()
+			if results[i] != nil {
+				continue
+			}
+
+			_, err := tx.Exec(savepointStmt)
+			if err != nil {
+				return err
+			}
+			written := len(a.written)
+			err = w.fn(tx)
+			if err != nil {
+				if isBusyError(err) {
+					return err
+				}
+				results[i] = classifyError(err)
+				a.written = a.written[:written]
+				_, err = tx.Exec(rollbackToSavepointStmt)
+				if err != nil {
+					return err
+				}
+			}
+			_, err = tx.Exec(releaseSavepointStmt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	a.finishWrite(err == nil)
+
+	for i, w := range batch {
+		if err != nil && results[i] == nil {
+			results[i] = err
+		}
+		w.done <- results[i]
+	}
+}
+
+// Stops committing writes, and waits for the transaction in progress (if any) to end.
+func (g *groupCommitter) wait() {
+	if g.a != nil {
+		<-g.stopped
+	}
+}
+
+var errStoreClosed = NewStoreError(StoreErrorUnavailable, errors.New("the state store is closed"))
+
+// Runs a write in a transaction, which is shared with other concurrent writes if group commit is enabled.
+func (a *sqliteDBAccess) executeWrite(parentCtx context.Context, fn func(tx *sql.Tx) error) error {
+	if a.groupCommit != nil {
+		return a.groupCommit.submit(parentCtx, fn)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	err := a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		a.written = nil
+		return fn(tx)
+	})
+	a.finishWrite(err == nil)
+	return err
+}
+
+// A key changed by the write in progress.
+type writtenKey struct {
+	key string
+	// True if the key was set rather than deleted.
+	set bool
+}
+
+// Records a key changed by the write in progress, which must be called with the lock held.
+// Its access is recorded and its cached row invalidated only once the write is committed.
+func (a *sqliteDBAccess) markWritten(key string, set bool) {
+	a.written = append(a.written, writtenKey{key: key, set: set})
+}
+
+// Applies the side effects of the keys changed by the write if it was committed, and forgets them.
+func (a *sqliteDBAccess) finishWrite(committed bool) {
+	if committed {
+		for _, k := range a.written {
+			if k.set {
+				a.recordAccess(k.key)
+			}
+			a.invalidateCachedRow(k.key)
+		}
+	}
+	a.written = nil
+}
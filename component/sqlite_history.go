@@ -0,0 +1,320 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// KeyVersion is a version of a key kept in the history table.
+type KeyVersion struct {
+	// Version number, which increases with every write to the store.
+	Version int64
+	// ETag the key had in this version, which is empty for deletions.
+	ETag string
+	// Time of the write.
+	Time time.Time
+	// True if the key was deleted in this version.
+	Deleted bool
+	// Value of the key, which is only returned by GetVersion.
+	Data []byte
+	// Persisted metadata of the key, such as its content type, which is only returned by GetVersion.
+	Metadata map[string]string
+
+	isBinary bool
+}
+
+// historySettings contains how many versions of each key are kept, and for how long.
+type historySettings struct {
+	// Maximum number of versions per key, or 0 for no limit.
+	limit int
+	// Maximum age of versions, or 0 for no limit.
+	retention time.Duration
+}
+
+// historyDBAccess is implemented by DBAccess objects that can return previous versions of keys.
+type historyDBAccess interface {
+	listVersions(ctx context.Context, key string) ([]KeyVersion, error)
+	getVersion(ctx context.Context, key string, version int64) (*KeyVersion, error)
+}
+
+// Returns the history settings in the metadata, or nil if history is disabled.
+func parseHistorySettings(metadata state.Metadata) (*historySettings, error) {
+	res := &historySettings{}
+
+	if s := metadata.Properties[historyLimitKey]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("illegal %s value: %s", historyLimitKey, s)
+		}
+		res.limit = n
+	}
+
+	var err error
+	res.retention, err = parseDurationProperty(metadata, historyRetentionKey, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.limit == 0 && res.retention == 0 {
+		return nil, nil
+	}
+	return res, nil
+}
+
+func (a *sqliteDBAccess) historyTableName() string {
+	return a.tableName + historyTableSuffix
+}
+
+// Creates the history table if it doesn't exist.
+func (a *sqliteDBAccess) ensureHistoryTable(parentCtx context.Context) error {
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	table := a.historyTableName()
+	_, err := a.db.ExecContext(ctx, fmt.Sprintf(createHistoryTableTpl, table, table, table))
+	if err != nil {
+		return err
+	}
+
+	// History tables created before the metadata was recorded don't have the column
+	exists, err := columnExists(ctx, a.db, table, "metadata")
+	if err != nil || exists {
+		return err
+	}
+	a.logger.Infof("Adding the metadata column to the history table '%s'", table)
+	_, err = a.db.ExecContext(ctx, fmt.Sprintf(addMetadataColumnTpl, table))
+	return err
+}
+
+// Adds a version of the key to the history table, and removes the versions that exceed the limits.
+// A nil value records the deletion of the key.
+func (a *sqliteDBAccess) appendHistory(tx *sql.Tx, key string, value *string, isBinary bool, etag string, now time.Time) error {
+	if now.IsZero() {
+		now = time.Now()
+	}
+	table := a.historyTableName()
+
+	_, err := tx.Exec(fmt.Sprintf(insertHistoryTpl, table, a.tableName),
+		key, value, isBinary, etag, value == nil, now.UTC().Format(timestampFormat), value == nil, key)
+	if err != nil {
+		return fmt.Errorf("failed to add version to history: %w", err)
+	}
+
+	if a.history.limit > 0 {
+		_, err = tx.Exec(fmt.Sprintf(pruneHistoryLimitTpl, table, table), key, key, a.history.limit)
+		if err != nil {
+			return fmt.Errorf("failed to prune history: %w", err)
+		}
+	}
+	if a.history.retention > 0 {
+		_, err = tx.Exec(fmt.Sprintf(pruneHistoryRetentionTpl, table), key, timestampBefore(now, a.history.retention))
+		if err != nil {
+			return fmt.Errorf("failed to prune history: %w", err)
+		}
+	}
+	return nil
+}
+
+// Removes the versions of all keys that are older than the retention period.
+func (a *sqliteDBAccess) pruneHistory(tx *sql.Tx, now time.Time) error {
+	if a.history == nil || a.history.retention == 0 {
+		return nil
+	}
+	_, err := tx.Exec(fmt.Sprintf(pruneAllHistoryRetentionTpl, a.historyTableName()), timestampBefore(now, a.history.retention))
+	if err != nil {
+		return fmt.Errorf("failed to prune history: %w", err)
+	}
+	return nil
+}
+
+// Times are stored as text, so the cutoff is formatted the same way for the comparison to work.
+func timestampBefore(now time.Time, retention time.Duration) string {
+	return now.Add(-retention).UTC().Format(timestampFormat)
+}
+
+func (a *sqliteDBAccess) listVersions(parentCtx context.Context, key string) ([]KeyVersion, error) {
+	if a.history == nil {
+		return nil, errors.New("history is not enabled")
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	rows, err := a.db.QueryContext(ctx, fmt.Sprintf(listHistoryTpl, a.historyTableName()), key)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer rows.Close()
+
+	res := []KeyVersion{}
+	for rows.Next() {
+		var v KeyVersion
+		err = rows.Scan(&v.Version, &v.ETag, &v.Deleted, &v.Time)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, rows.Err()
+}
+
+func (a *sqliteDBAccess) getVersion(parentCtx context.Context, key string, version int64) (*KeyVersion, error) {
+	if a.history == nil {
+		return nil, errors.New("history is not enabled")
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	var (
+		v        KeyVersion
+		value    sql.NullString
+		metadata sql.NullString
+	)
+	err := a.db.QueryRowContext(ctx, fmt.Sprintf(getHistoryTpl, a.historyTableName()), key, version).
+		Scan(&v.Version, &value, &v.isBinary, &v.ETag, &v.Deleted, &v.Time, &metadata)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, classifyError(err)
+	}
+
+	if metadata.Valid && metadata.String != "" {
+		err = json.Unmarshal([]byte(metadata.String), &v.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("invalid persisted metadata: %w", err)
+		}
+	}
+
+	if !value.Valid {
+		return &v, nil
+	}
+	if v.isBinary {
+		var s string
+		if err = json.Unmarshal([]byte(value.String), &s); err != nil {
+			return nil, err
+		}
+		if v.Data, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, err
+		}
+	} else {
+		v.Data = []byte(value.String)
+	}
+	return &v, nil
+}
+
+func (r *raftDBAccess) listVersions(ctx context.Context, key string) ([]KeyVersion, error) {
+	return r.local.listVersions(ctx, key)
+}
+
+func (r *raftDBAccess) getVersion(ctx context.Context, key string, version int64) (*KeyVersion, error) {
+	return r.local.getVersion(ctx, key, version)
+}
+
+func (s *shardedDBAccess) listVersions(ctx context.Context, key string) ([]KeyVersion, error) {
+	return s.shardFor(key).listVersions(ctx, key)
+}
+
+func (s *shardedDBAccess) getVersion(ctx context.Context, key string, version int64) (*KeyVersion, error) {
+	return s.shardFor(key).getVersion(ctx, key, version)
+}
+
+func (t *tenantDBAccess) listVersions(ctx context.Context, key string) (res []KeyVersion, err error) {
+	err = t.withTenant(key, func(a *sqliteDBAccess) error {
+		res, err = a.listVersions(ctx, key)
+		return err
+	})
+	return res, err
+}
+
+func (t *tenantDBAccess) getVersion(ctx context.Context, key string, version int64) (res *KeyVersion, err error) {
+	err = t.withTenant(key, func(a *sqliteDBAccess) error {
+		res, err = a.getVersion(ctx, key, version)
+		return err
+	})
+	return res, err
+}
+
+// ListVersions returns the versions of a key kept in the history table, newest first.
+// The values of the versions aren't included; use GetVersion to retrieve them.
+func (s *SQLiteStore) ListVersions(ctx context.Context, key string) ([]KeyVersion, error) {
+	h, ok := s.dbaccess.(historyDBAccess)
+	if !ok {
+		return nil, errors.New("history is not supported")
+	}
+	if key == "" {
+		return nil, errors.New("missing key")
+	}
+	return h.listVersions(ctx, key)
+}
+
+// GetVersion returns a version of a key, including its value.
+// It returns nil if the version doesn't exist or has been pruned.
+func (s *SQLiteStore) GetVersion(ctx context.Context, key string, version int64) (*KeyVersion, error) {
+	h, ok := s.dbaccess.(historyDBAccess)
+	if !ok {
+		return nil, errors.New("history is not supported")
+	}
+	if key == "" {
+		return nil, errors.New("missing key")
+	}
+	return h.getVersion(ctx, key, version)
+}
+
+// RestoreVersion sets a key to the value and persisted metadata it had in a previous version, which creates a new version with a new ETag.
+// If etag is not nil, the key is only restored if its current ETag matches.
+func (s *SQLiteStore) RestoreVersion(ctx context.Context, key string, version int64, etag *string) error {
+	v, err := s.GetVersion(ctx, key, version)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return fmt.Errorf("version %d of key '%s' not found", version, key)
+	}
+	if v.Deleted {
+		return fmt.Errorf("version %d of key '%s' is a deletion", version, key)
+	}
+
+	req := &state.SetRequest{
+		Key:      key,
+		ETag:     etag,
+		Metadata: v.Metadata,
+	}
+	if v.isBinary {
+		req.Value = v.Data
+	} else {
+		req.Value = json.RawMessage(v.Data)
+	}
+	if etag != nil {
+		req.Options.Concurrency = state.FirstWrite
+	}
+	return s.dbaccess.Set(ctx, req)
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+var errNumberOutOfRange = errors.New("the number is out of range")
+
+// OperationIncrement is the operation type of IncrementRequest objects in transactions.
+const OperationIncrement state.OperationType = "increment"
+
+// IncrementRequest adds a number to a numeric value, or to a numeric field of a JSON value.
+// It can be executed with SQLiteStore.Increment or as part of a transaction, with the OperationIncrement operation type.
+type IncrementRequest struct {
+	Key string
+	// JSON path of the field to increment, such as "views" or "stats.views".
+	// If empty, the whole value must be a number.
+	Field string
+	// Amount to add, which is negative to decrement.
+	// If Delta, Initial and the stored value are all integers, the sum is computed exactly as a 64-bit integer.
+	Delta float64
+	// Value of the key or field if it doesn't exist, to which Delta is added.
+	Initial float64
+	// If set, the value is only incremented if the ETag of the key matches.
+	ETag *string
+	// Metadata of the write. If it contains ttlInSeconds, the expiration of the key is reset; otherwise, it's left unchanged.
+	// Likewise, the persisted metadata of the key is only replaced if the request has any.
+	Metadata map[string]string
+	Options  state.SetStateOption
+
+	// If not nil, receives the new value.
+	result *float64
+}
+
+// Increment adds req.Delta to a numeric value, or to a numeric field of a JSON value, and returns the new value.
+// The key gets a new ETag.
+func (s *SQLiteStore) Increment(ctx context.Context, req *IncrementRequest) (float64, error) {
+	var result float64
+	r := *req
+	r.result = &result
+	err := s.dbaccess.ExecuteMulti(ctx, []state.TransactionalStateOperation{
+		{Operation: OperationIncrement, Request: r},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// Increments a value inside the transaction.
+// The new value is written with setValue, so it's subject to the same ETag checks and side effects as a set.
+func (a *sqliteDBAccess) incrementValue(ctx context.Context, tx *sql.Tx, req *IncrementRequest, wc writeContext) error {
+	if req.Key == "" {
+		return errors.New("missing key in increment operation")
+	}
+	var path string
+	if req.Field != "" {
+		field := strings.TrimPrefix(req.Field, "$.")
+		if !jsonPathRegexp.MatchString(field) {
+			return fmt.Errorf("invalid JSON path: %s", req.Field)
+		}
+		path = "$." + field
+	}
+
+	cur, err := a.readValueForUpdate(ctx, tx, req.Key, req.ETag, req.Options.Concurrency)
+	if err != nil {
+		return err
+	}
+	if cur != nil && cur.isBinary {
+		return fmt.Errorf("the value of key '%s' is binary and can't be incremented", req.Key)
+	}
+
+	var (
+		value float64
+		doc   string
+	)
+	switch {
+	case path == "" && cur == nil:
+		value, doc, err = addNumber(toNumber(req.Initial), req.Delta)
+	case path == "":
+		var n json.Number
+		err = json.Unmarshal(cur.value, &n)
+		if err != nil {
+			return fmt.Errorf("the value of key '%s' is not a number", req.Key)
+		}
+		value, doc, err = addNumber(parseNumber(n), req.Delta)
+	default:
+		doc = "{}"
+		if cur != nil {
+			doc = string(cur.value)
+		}
+		value, doc, err = incrementJSONField(tx, doc, path, req.Initial, req.Delta)
+	}
+	if errors.Is(err, errNumberOutOfRange) {
+		return fmt.Errorf("the value of key '%s' is out of range", req.Key)
+	} else if err != nil {
+		return fmt.Errorf("failed to increment key '%s': %w", req.Key, err)
+	}
+
+	setReq := state.SetRequest{
+		Key:      req.Key,
+		Value:    json.RawMessage(doc),
+		Metadata: req.Metadata,
+	}
+	if cur != nil {
+		// The ETag that was read guarantees that the value wasn't changed in the meantime
+		setReq.ETag = &cur.etag
+		setReq.Options.Concurrency = state.FirstWrite
+	}
+	r, err := prepareSetRequest(a, tx, &setReq)
+	if err != nil {
+		return err
+	}
+	// A ttlInSeconds of -1 removes the expiration, so this checks if the key is present rather than the parsed TTL
+	_, hasTTL := req.Metadata[metadataTTLKey]
+	r.keepExpiration = !hasTTL
+	r.keepMetadata = true
+	err = a.executeSetRequest(ctx, tx, r, &setReq, wc)
+	if err != nil {
+		return err
+	}
+
+	if req.result != nil {
+		*req.result = value
+	}
+	return nil
+}
+
+// Adds delta to a field of a JSON object, using SQLite's JSON functions so paths behave as in the rest of the component.
+// It returns the new value of the field and the updated document.
+func incrementJSONField(tx *sql.Tx, doc string, path string, initial float64, delta float64) (float64, string, error) {
+	var (
+		docType, fieldType sql.NullString
+		// The driver returns an int64 for integers and a float64 for reals
+		field any
+	)
+	err := tx.QueryRow(getJSONFieldStmt, doc, doc, path, doc, path).Scan(&docType, &fieldType, &field)
+	if err != nil {
+		return 0, "", err
+	}
+	if docType.String != "object" {
+		return 0, "", errors.New("the value is not a JSON object")
+	}
+
+	var (
+		value  float64
+		number string
+	)
+	switch fieldType.String {
+	case "":
+		value, number, err = addNumber(toNumber(initial), delta)
+	case "integer", "real":
+		value, number, err = addNumber(field, delta)
+	default:
+		return 0, "", fmt.Errorf("the field %s is not a number", path)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	var res string
+	err = tx.QueryRow(setJSONFieldStmt, doc, path, number).Scan(&res)
+	if err != nil {
+		return 0, "", err
+	}
+	return value, res, nil
+}
+
+// Adds delta to v, which is an int64 or a float64.
+// If both are integers, the sum is exact and errNumberOutOfRange is returned if it overflows; otherwise, it's computed as a float64.
+// It returns the sum and its JSON representation.
+func addNumber(v any, delta float64) (float64, string, error) {
+	if i, ok := v.(int64); ok {
+		d, ok := floatToInt64(delta)
+		if ok {
+			sum := i + d
+			if (d > 0 && sum < i) || (d < 0 && sum > i) {
+				return 0, "", errNumberOutOfRange
+			}
+			return float64(sum), strconv.FormatInt(sum, 10), nil
+		}
+		v = float64(i)
+	}
+
+	f, ok := v.(float64)
+	if !ok {
+		return 0, "", fmt.Errorf("unexpected number type %T", v)
+	}
+	sum := f + delta
+	if math.IsInf(sum, 0) || math.IsNaN(sum) {
+		return 0, "", errNumberOutOfRange
+	}
+	return sum, formatNumber(sum), nil
+}
+
+// Returns a number stored as JSON as an int64 if it's an integer that fits, or as a float64 otherwise.
+func parseNumber(n json.Number) any {
+	i, err := n.Int64()
+	if err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
+
+// Returns v as an int64 if it's a whole number, or as a float64 otherwise.
+func toNumber(v float64) any {
+	i, ok := floatToInt64(v)
+	if ok {
+		return i
+	}
+	return v
+}
+
+// Converts v to an int64 if it's a whole number in the range of int64.
+func floatToInt64(v float64) (int64, bool) {
+	if v != math.Trunc(v) || v < math.MinInt64 || v >= -math.MinInt64 {
+		return 0, false
+	}
+	return int64(v), true
+}
+
+// Formats a number for JSON, without decimals if it's an integer.
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// JSONIndex is an index on a field of the JSON values, created from the component's metadata.
+type JSONIndex struct {
+	// Name of the database, which is empty unless the store uses multiple databases.
+	Database string
+	// Name of the index.
+	Name string
+	// JSON path of the field, such as "$.customer.id".
+	Path string
+}
+
+// indexDBAccess is implemented by DBAccess objects that can report the indexes on JSON fields.
+type indexDBAccess interface {
+	jsonIndexes(ctx context.Context) ([]JSONIndex, error)
+}
+
+var (
+	// Paths are embedded in the SQL statements, so only simple paths are allowed, such as "customer.id" or "items[0].sku".
+	jsonPathRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\[[0-9]+\])*(\.[A-Za-z_][A-Za-z0-9_]*(\[[0-9]+\])*)*$`)
+	// Extracts the path from the SQL of an index.
+	jsonIndexSQLRegexp = regexp.MustCompile(`json_extract\(value, '([^']*)'\)`)
+)
+
+// Returns the JSON paths to index, in the "$.path" format.
+func parseJSONIndexes(metadata state.Metadata) ([]string, error) {
+	var paths []string
+	for _, p := range strings.Split(metadata.Properties[jsonIndexesKey], ",") {
+		p = strings.TrimPrefix(strings.TrimSpace(p), "$.")
+		if p == "" {
+			continue
+		}
+		if !jsonPathRegexp.MatchString(p) {
+			return nil, fmt.Errorf("invalid JSON path in %s: %s", jsonIndexesKey, p)
+		}
+		paths = append(paths, "$."+p)
+	}
+	return paths, nil
+}
+
+// Prefix of the names of the indexes on JSON fields, which identifies the indexes managed by the component.
+func (a *sqliteDBAccess) jsonIndexPrefix() string {
+	return "idx_" + a.tableName + "_json_"
+}
+
+// Returns the name of the index for a path.
+// The name contains a hash of the path, as paths that only differ in punctuation would have the same name otherwise.
+func (a *sqliteDBAccess) jsonIndexName(path string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(path))
+	name := strings.NewReplacer(".", "_", "[", "_", "]", "").Replace(strings.TrimPrefix(path, "$."))
+	return fmt.Sprintf("%s%s_%08x", a.jsonIndexPrefix(), name, h.Sum32())
+}
+
+// Creates the indexes on the declared JSON paths, and drops the indexes on paths that aren't declared anymore.
+func (a *sqliteDBAccess) syncJSONIndexes(parentCtx context.Context, paths []string) error {
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	existing, err := a.listJSONIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
+	declared := make(map[string]string, len(paths))
+	for _, path := range paths {
+		declared[a.jsonIndexName(path)] = path
+	}
+
+	return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		for _, idx := range existing {
+			if _, ok := declared[idx.Name]; ok {
+				continue
+			}
+			a.logger.Infof("Dropping index '%s' on JSON path '%s'", idx.Name, idx.Path)
+			_, err := tx.Exec(fmt.Sprintf(dropIndexTpl, idx.Name))
+			if err != nil {
+				return fmt.Errorf("failed to drop index '%s': %w", idx.Name, err)
+			}
+		}
+
+		for name, path := range declared {
+			_, err := tx.Exec(fmt.Sprintf(createJSONIndexTpl, name, a.tableName, path))
+			if err != nil {
+				return fmt.Errorf("failed to create index on JSON path '%s': %w", path, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Returns the indexes on JSON fields that exist in the database.
+func (a *sqliteDBAccess) listJSONIndexes(ctx context.Context) ([]JSONIndex, error) {
+	prefix := a.jsonIndexPrefix()
+	rows, err := a.db.QueryContext(ctx, listIndexesStmt, a.tableName, prefix+"%")
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer rows.Close()
+
+	res := []JSONIndex{}
+	for rows.Next() {
+		var name, stmt string
+		err = rows.Scan(&name, &stmt)
+		if err != nil {
+			return nil, err
+		}
+		// LIKE treats "_" as a wildcard
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		idx := JSONIndex{
+			Database: a.name,
+			Name:     name,
+		}
+		if m := jsonIndexSQLRegexp.FindStringSubmatch(stmt); m != nil {
+			idx.Path = m[1]
+		}
+		res = append(res, idx)
+	}
+	return res, rows.Err()
+}
+
+func (a *sqliteDBAccess) jsonIndexes(parentCtx context.Context) ([]JSONIndex, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	return a.listJSONIndexes(ctx)
+}
+
+func (r *raftDBAccess) jsonIndexes(ctx context.Context) ([]JSONIndex, error) {
+	return r.local.jsonIndexes(ctx)
+}
+
+func (s *shardedDBAccess) jsonIndexes(ctx context.Context) ([]JSONIndex, error) {
+	var res []JSONIndex
+	for _, shard := range s.shards {
+		indexes, err := shard.jsonIndexes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, indexes...)
+	}
+	return res, nil
+}
+
+func (t *tenantDBAccess) jsonIndexes(ctx context.Context) ([]JSONIndex, error) {
+	tenants, err := t.listTenants()
+	if err != nil {
+		return nil, err
+	}
+
+	res := []JSONIndex{}
+	for _, tenant := range tenants {
+		a, err := t.acquire(tenant)
+		if err != nil {
+			return nil, err
+		}
+		indexes, err := a.jsonIndexes(ctx)
+		t.release(tenant)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, indexes...)
+	}
+	return res, nil
+}
+
+// JSONIndexes returns the indexes on JSON fields that exist in each database used by the state store.
+func (s *SQLiteStore) JSONIndexes(ctx context.Context) ([]JSONIndex, error) {
+	a, ok := s.dbaccess.(indexDBAccess)
+	if !ok {
+		return nil, errors.New("indexes are not supported")
+	}
+	return a.jsonIndexes(ctx)
+}
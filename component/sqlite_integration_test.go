@@ -14,15 +14,36 @@ limitations under the License.
 package component
 
 import (
+	"bytes"
+	"container/list"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/raft"
+	"github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/dapr/components-contrib/metadata"
@@ -374,6 +395,10 @@ func updateWithOldEtagFails(t *testing.T, s *SQLiteStore) {
 	}
 	err := s.Set(setReq)
 	assert.NotNil(t, err)
+	var etagErr *state.ETagError
+	if assert.ErrorAs(t, err, &etagErr) {
+		assert.Equal(t, state.ETagMismatch, etagErr.Kind())
+	}
 }
 
 func updateAndDeleteWithEtagSucceeds(t *testing.T, s *SQLiteStore) {
@@ -571,6 +596,305 @@ func setItemWithNoKey(t *testing.T, s *SQLiteStore) {
 	assert.NotNil(t, err)
 }
 
+func TestBusyRetry(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "busy.db")
+
+	// Disable SQLite's own busy handler so failures are returned to the component right away.
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey: dbPath,
+		timeoutKey:          "1",
+		busyTimeoutKey:      "0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Open a second connection to the same file and hold a write lock on it.
+	locker, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		locker.Close()
+	})
+	lockDatabase := func(t *testing.T) *sql.Conn {
+		conn, err := locker.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.ExecContext(context.Background(), "BEGIN IMMEDIATE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	t.Run("Write succeeds once the lock is released", func(t *testing.T) {
+		conn := lockDatabase(t)
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			conn.ExecContext(context.Background(), "COMMIT")
+			conn.Close()
+		}()
+
+		start := time.Now()
+		key := randomKey()
+		err := s.Set(&state.SetRequest{
+			Key:   key,
+			Value: randomJSON(),
+		})
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+		assert.True(t, storeItemExists(t, s, key))
+	})
+
+	t.Run("Write fails when the lock is held past the timeout", func(t *testing.T) {
+		conn := lockDatabase(t)
+		defer func() {
+			conn.ExecContext(context.Background(), "ROLLBACK")
+			conn.Close()
+		}()
+
+		start := time.Now()
+		err := s.Delete(&state.DeleteRequest{
+			Key: randomKey(),
+		})
+		assert.Error(t, err)
+		assert.True(t, isBusyError(err))
+		assert.True(t, IsRetryableError(err))
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+
+	t.Run("I/O errors are not retried", func(t *testing.T) {
+		var attempts int
+		err := s.dbaccess.(*sqliteDBAccess).executeInTransaction(context.Background(), func(tx *sql.Tx) error {
+			attempts++
+			return sqlite3.Error{Code: sqlite3.ErrIoErr}
+		})
+		assert.Equal(t, 1, attempts)
+		var storeErr *StoreError
+		if assert.ErrorAs(t, err, &storeErr) {
+			assert.Equal(t, StoreErrorIO, storeErr.Kind())
+		}
+		assert.False(t, IsRetryableError(err))
+	})
+}
+
+func TestProfiles(t *testing.T) {
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey: filepath.Join(t.TempDir(), "profiles.db"),
+		profileKey:          "balanced",
+		cacheSizeKey:        "-1000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Settings must be applied to every connection in the pool.
+	db := s.dbaccess.(*sqliteDBAccess).db
+	db.SetMaxIdleConns(0)
+	expect := map[string]string{
+		"journal_mode":       "wal",
+		"synchronous":        "1",
+		"cache_size":         "-1000",
+		"mmap_size":          "268435456",
+		"temp_store":         "2",
+		"wal_autocheckpoint": "1000",
+	}
+	for i := 0; i < 2; i++ {
+		for pragma, expectVal := range expect {
+			var val string
+			err = db.QueryRow("PRAGMA " + pragma).Scan(&val)
+			assert.NoError(t, err)
+			assert.Equal(t, expectVal, val, pragma)
+		}
+	}
+}
+
+func TestMemoryMode(t *testing.T) {
+	persistFile := filepath.Join(t.TempDir(), "persist.db")
+	memoryProps := map[string]string{
+		modeKey:            modeMemory,
+		persistFileKey:     persistFile,
+		persistIntervalKey: "1",
+	}
+
+	// Seed the persist file using a regular, file-backed store.
+	seedKey := randomKey()
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey: persistFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setItem(t, s, seedKey, &fakeItem{Color: "seed"}, nil)
+	assert.NoError(t, s.Close())
+
+	t.Run("Loads the persist file on init and persists on close", func(t *testing.T) {
+		s, err := initTestStore(t, memoryProps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, item := getItem(t, s, seedKey)
+		assert.Equal(t, "seed", item.Color)
+
+		key := randomKey()
+		setItem(t, s, key, &fakeItem{Color: "close"}, nil)
+		assert.NoError(t, s.Close())
+
+		s, err = initTestStore(t, map[string]string{
+			connectionStringKey: persistFile,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, item = getItem(t, s, key)
+		assert.Equal(t, "close", item.Color)
+	})
+
+	t.Run("Persists periodically", func(t *testing.T) {
+		s, err := initTestStore(t, memoryProps)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := randomKey()
+		setItem(t, s, key, &fakeItem{Color: "periodic"}, nil)
+		time.Sleep(1500 * time.Millisecond)
+
+		db, err := sql.Open("sqlite3", "file:"+persistFile+"?mode=ro")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		var count int
+		err = db.QueryRow("SELECT count(*) FROM state WHERE key = ?", key).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("Stores are isolated from each other", func(t *testing.T) {
+		s1, err := initTestStore(t, map[string]string{modeKey: modeMemory})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s2, err := initTestStore(t, map[string]string{modeKey: modeMemory})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := randomKey()
+		setItem(t, s1, key, randomJSON(), nil)
+		assert.False(t, storeItemExists(t, s2, key))
+	})
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "readonly.db")
+
+	// Create the database with some data first.
+	key := randomKey()
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey: dbPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setItem(t, s, key, &fakeItem{Color: "readonly"}, nil)
+	s.Close()
+
+	for name, props := range map[string]map[string]string{
+		"File":           {connectionStringKey: dbPath, readOnlyKey: "true", profileKey: "balanced"},
+		"Immutable file": {connectionStringKey: "file:" + dbPath + "?immutable=1", readOnlyKey: "true"},
+		"Memory":         {modeKey: modeMemory, persistFileKey: dbPath, readOnlyKey: "true"},
+	} {
+		props := props
+		t.Run(name, func(t *testing.T) {
+			s, err := initTestStore(t, props)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, []state.Feature{state.FeatureETag}, s.Features())
+
+			_, item := getItem(t, s, key)
+			assert.Equal(t, "readonly", item.Color)
+
+			assertReadOnlyError := func(err error) {
+				var storeErr *StoreError
+				if assert.ErrorAs(t, err, &storeErr) {
+					assert.Equal(t, StoreErrorReadOnly, storeErr.Kind())
+					assert.Equal(t, "read-only: "+errReadOnly, storeErr.Error())
+				}
+			}
+			assertReadOnlyError(s.Set(&state.SetRequest{Key: key, Value: randomJSON()}))
+			assertReadOnlyError(s.Delete(&state.DeleteRequest{Key: key}))
+			assertReadOnlyError(s.Multi(&state.TransactionalStateRequest{}))
+		})
+	}
+
+	t.Run("State table must exist", func(t *testing.T) {
+		_, err := initTestStore(t, map[string]string{
+			connectionStringKey: dbPath,
+			tableNameKey:        "missing",
+			readOnlyKey:         "true",
+		})
+		assert.EqualError(t, err, "state table 'missing' does not exist")
+	})
+
+	t.Run("Invalid value", func(t *testing.T) {
+		_, err := initTestStore(t, map[string]string{
+			connectionStringKey: dbPath,
+			readOnlyKey:         "maybe",
+		})
+		assert.EqualError(t, err, "illegal readOnly value: maybe")
+	})
+}
+
+func TestReadOnlyDatabaseErrors(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "readonly.db")
+
+	// Create the database and the state table first.
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey: dbPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = initTestStore(t, map[string]string{
+		connectionStringKey: "file:" + dbPath + "?mode=ro",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Set(&state.SetRequest{
+		Key:   randomKey(),
+		Value: randomJSON(),
+	})
+	var storeErr *StoreError
+	if assert.ErrorAs(t, err, &storeErr) {
+		assert.Equal(t, StoreErrorReadOnly, storeErr.Kind())
+		assert.False(t, storeErr.Retryable())
+	}
+}
+
+func TestConnectionStringWithBusyTimeout(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		"mydb.db":                         "mydb.db?_busy_timeout=2000",
+		":memory:":                        ":memory:?_busy_timeout=2000",
+		"file:mydb.db?immutable=1":        "file:mydb.db?immutable=1&_busy_timeout=2000",
+		"file:mydb.db?_busy_timeout=100":  "file:mydb.db?_busy_timeout=100",
+		"file:mydb.db?mode=ro&_timeout=1": "file:mydb.db?mode=ro&_timeout=1",
+	}
+	for in, expect := range tests {
+		assert.Equal(t, expect, connectionStringWithBusyTimeout(in, 2*time.Second))
+	}
+}
+
 func TestParseTTL(t *testing.T) {
 	log := logger.NewLogger("parseTTL")
 	t.Parallel()
@@ -686,6 +1010,75 @@ func testInitConfiguration(t *testing.T) {
 			},
 			expectedErr: "",
 		},
+		{
+			name: "Invalid timeout",
+			props: map[string]string{
+				connectionStringKey: getConnectionString(),
+				timeoutKey:          "0",
+			},
+			expectedErr: "illegal timeoutInSeconds value: 0",
+		},
+		{
+			name: "Invalid busy timeout",
+			props: map[string]string{
+				connectionStringKey: getConnectionString(),
+				busyTimeoutKey:      "soon",
+			},
+			expectedErr: "illegal busyTimeout value: soon",
+		},
+		{
+			name: "Invalid profile",
+			props: map[string]string{
+				connectionStringKey: getConnectionString(),
+				profileKey:          "reckless",
+			},
+			expectedErr: "invalid profile: reckless",
+		},
+		{
+			name: "Invalid pragma override",
+			props: map[string]string{
+				connectionStringKey: getConnectionString(),
+				synchronousKey:      "sometimes",
+			},
+			expectedErr: "invalid synchronous value: sometimes",
+		},
+		{
+			name: "Valid profile with overrides",
+			props: map[string]string{
+				connectionStringKey: getConnectionString(),
+				profileKey:          "Fast",
+				synchronousKey:      "normal",
+				cacheSizeKey:        "-1000",
+			},
+			expectedErr: "",
+		},
+		{
+			name: "Invalid mode",
+			props: map[string]string{
+				connectionStringKey: getConnectionString(),
+				modeKey:             "tape",
+			},
+			expectedErr: "invalid mode: tape",
+		},
+		{
+			name: "Memory mode without connection string",
+			props: map[string]string{
+				modeKey: modeMemory,
+			},
+			expectedErr: "",
+		},
+		{
+			name: "Valid timeouts and retry policy",
+			props: map[string]string{
+				connectionStringKey:            getConnectionString(),
+				timeoutKey:                     "30",
+				busyTimeoutKey:                 "500ms",
+				"busyRetryInitialInterval":     "5ms",
+				"busyRetryMaxInterval":         "100ms",
+				"busyRetryRandomizationFactor": "0.2",
+			},
+			expectedErr: "",
+		},
 	}
 
 	for _, tt := range tests {
@@ -738,6 +1131,20 @@ func setItem(t *testing.T, s *SQLiteStore, key string, value interface{}, etag *
 	assert.True(t, itemExists, "Item should exist after set has been executed ")
 }
 
+// Creates a store with the given properties, which is closed when the test ends.
+func initTestStore(t *testing.T, props map[string]string) (*SQLiteStore, error) {
+	s := NewSQLiteStateStore(logger.NewLogger("test")).(*SQLiteStore)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	err := s.Init(state.Metadata{
+		Base: metadata.Base{
+			Properties: props,
+		},
+	})
+	return s, err
+}
+
 func getItem(t *testing.T, s *SQLiteStore, key string) (*state.GetResponse, *fakeItem) {
 	getReq := &state.GetRequest{
 		Key:     key,
@@ -798,3 +1205,3013 @@ func getTimesForRow(t *testing.T, s *SQLiteStore, key string) (insertdate sql.Nu
 
 	return insertdate, updatedate, expirationtime
 }
+
+// Returns the time left until a row expires.
+func expiresIn(t *testing.T, s *SQLiteStore, key string) time.Duration {
+	_, _, expiration := getTimesForRow(t, s, key)
+	if !assert.True(t, expiration.Valid) {
+		return 0
+	}
+	exp, err := time.Parse(time.RFC3339, expiration.String)
+	assert.NoError(t, err)
+	return time.Until(exp)
+}
+
+func TestReplication(t *testing.T) {
+	replicatorOf := func(s *SQLiteStore) *replicator {
+		return s.dbaccess.(*sqliteDBAccess).replicator
+	}
+
+	t.Run("Restores the latest state from a local replica", func(t *testing.T) {
+		dir := t.TempDir()
+		props := map[string]string{
+			connectionStringKey:    filepath.Join(dir, "source.db"),
+			replicaTypeKey:         "local",
+			replicaPathKey:         filepath.Join(dir, "replica"),
+			replicaSyncIntervalKey: "20ms",
+			// Checkpoint often, so the replica spans multiple indexes
+			walAutocheckpointKey: "2",
+		}
+		s, err := initTestStore(t, props)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := make([]string, 20)
+		for i := range keys {
+			keys[i] = randomKey()
+			setItem(t, s, keys[i], &fakeItem{Color: strconv.Itoa(i)}, nil)
+			if i%5 == 0 {
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		deleteItem(t, s, keys[0], nil)
+		assert.Greater(t, replicatorOf(s).index, uint64(1))
+		assert.NoError(t, s.Close())
+
+		props[connectionStringKey] = filepath.Join(dir, "restored.db")
+		props[replicaRestoreKey] = "latest"
+		s, err = initTestStore(t, props)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, storeItemExists(t, s, keys[0]))
+		for i := 1; i < len(keys); i++ {
+			_, item := getItem(t, s, keys[i])
+			if assert.NotNil(t, item) {
+				assert.Equal(t, strconv.Itoa(i), item.Color)
+			}
+		}
+	})
+
+	t.Run("Restores to a point in time", func(t *testing.T) {
+		dir := t.TempDir()
+		props := map[string]string{
+			connectionStringKey:    filepath.Join(dir, "source.db"),
+			replicaTypeKey:         "local",
+			replicaPathKey:         filepath.Join(dir, "replica"),
+			replicaSyncIntervalKey: "1h",
+		}
+		s, err := initTestStore(t, props)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := randomKey()
+		setItem(t, s, before, &fakeItem{Color: "before"}, nil)
+		assert.NoError(t, replicatorOf(s).sync(context.Background()))
+		target := time.Now()
+		time.Sleep(1100 * time.Millisecond)
+		after := randomKey()
+		setItem(t, s, after, &fakeItem{Color: "after"}, nil)
+		assert.NoError(t, s.Close())
+
+		props[connectionStringKey] = filepath.Join(dir, "restored.db")
+		// RFC3339 has a resolution of seconds, so round the target up
+		props[replicaRestoreKey] = target.Add(time.Second).Truncate(time.Second).Format(time.RFC3339)
+		s, err = initTestStore(t, props)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, storeItemExists(t, s, before))
+		assert.False(t, storeItemExists(t, s, after))
+	})
+
+	t.Run("A busy checkpoint is retried at the next sync", func(t *testing.T) {
+		dir := t.TempDir()
+		dbPath := filepath.Join(dir, "source.db")
+		s, err := initTestStore(t, map[string]string{
+			connectionStringKey:        dbPath,
+			replicaTypeKey:             "local",
+			replicaPathKey:             filepath.Join(dir, "replica"),
+			replicaSyncIntervalKey:     "1h",
+			replicaSnapshotIntervalKey: "1ms",
+			busyTimeoutKey:             "10ms",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := replicatorOf(s)
+		setItem(t, s, randomKey(), &fakeItem{Color: "red"}, nil)
+
+		// A reader keeps the WAL from being truncated
+		reader, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		tx, err := reader.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		assert.NoError(t, tx.QueryRow("SELECT COUNT(*) FROM state").Scan(&count))
+
+		lastSnapshot := r.lastSnapshot
+		assert.NoError(t, r.sync(context.Background()))
+		assert.Equal(t, lastSnapshot, r.lastSnapshot)
+
+		assert.NoError(t, tx.Rollback())
+		assert.NoError(t, r.sync(context.Background()))
+		assert.True(t, r.lastSnapshot.After(lastSnapshot))
+	})
+
+	t.Run("Does not restore over an existing database", func(t *testing.T) {
+		dir := t.TempDir()
+		props := map[string]string{
+			connectionStringKey: filepath.Join(dir, "source.db"),
+			replicaTypeKey:      "local",
+			replicaPathKey:      filepath.Join(dir, "replica"),
+			replicaRestoreKey:   "latest",
+		}
+		// The replica is empty, so the first start creates a new database
+		s, err := initTestStore(t, props)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := randomKey()
+		setItem(t, s, key, &fakeItem{Color: "kept"}, nil)
+		assert.NoError(t, s.Close())
+
+		s, err = initTestStore(t, props)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, item := getItem(t, s, key)
+		assert.Equal(t, "kept", item.Color)
+	})
+
+	t.Run("Replicates to S3", func(t *testing.T) {
+		s3 := newFakeS3Server()
+		defer s3.Close()
+
+		dir := t.TempDir()
+		props := map[string]string{
+			connectionStringKey:   filepath.Join(dir, "source.db"),
+			replicaTypeKey:        "s3",
+			replicaPathKey:        "backups/state",
+			replicaS3EndpointKey:  strings.TrimPrefix(s3.URL, "http://"),
+			replicaS3BucketKey:    "bucket",
+			replicaS3AccessKeyKey: "access",
+			replicaS3SecretKeyKey: "secret",
+			replicaS3UseSSLKey:    "false",
+		}
+		s, err := initTestStore(t, props)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := randomKey()
+		setItem(t, s, key, &fakeItem{Color: "s3"}, nil)
+		assert.NoError(t, s.Close())
+		assert.NotEmpty(t, s3.keys("bucket/backups/state/generations/"))
+
+		props[connectionStringKey] = filepath.Join(dir, "restored.db")
+		props[replicaRestoreKey] = "latest"
+		s, err = initTestStore(t, props)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, item := getItem(t, s, key)
+		assert.Equal(t, "s3", item.Color)
+	})
+
+	t.Run("Configuration errors", func(t *testing.T) {
+		tests := []struct {
+			name        string
+			props       map[string]string
+			expectedErr string
+		}{
+			{
+				name: "Invalid replica type",
+				props: map[string]string{
+					connectionStringKey: filepath.Join(t.TempDir(), "state.db"),
+					replicaTypeKey:      "tape",
+				},
+				expectedErr: "invalid replicaType: tape",
+			},
+			{
+				name: "Missing replica path",
+				props: map[string]string{
+					connectionStringKey: filepath.Join(t.TempDir(), "state.db"),
+					replicaTypeKey:      "local",
+				},
+				expectedErr: "missing replicaPath",
+			},
+			{
+				name: "In-memory database",
+				props: map[string]string{
+					modeKey:        modeMemory,
+					replicaTypeKey: "local",
+					replicaPathKey: t.TempDir(),
+				},
+				expectedErr: "replication is not supported in memory or read-only mode",
+			},
+			{
+				name: "Invalid restore target",
+				props: map[string]string{
+					connectionStringKey: filepath.Join(t.TempDir(), "state.db"),
+					replicaTypeKey:      "local",
+					replicaPathKey:      t.TempDir(),
+					replicaRestoreKey:   "yesterday",
+				},
+				expectedErr: "illegal replicaRestore value: yesterday",
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := initTestStore(t, tt.props)
+				if assert.Error(t, err) {
+					assert.Equal(t, tt.expectedErr, err.Error())
+				}
+			})
+		}
+	})
+}
+
+// fakeS3Server implements the subset of the S3 API used by the S3 replica client, storing objects in memory.
+type fakeS3Server struct {
+	*httptest.Server
+	lock    sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3Server() *fakeS3Server {
+	f := &fakeS3Server{
+		objects: map[string][]byte{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeS3Server) keys(prefix string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	res := []string{}
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (f *fakeS3Server) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			data = decodeAWSChunked(data)
+		}
+		f.objects[path] = data
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(data))+`"`)
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		prefix := path + "/" + r.URL.Query().Get("prefix")
+		type content struct {
+			Key          string
+			Size         int
+			LastModified string
+		}
+		res := struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Name        string
+			IsTruncated bool
+			Contents    []content
+		}{Name: path}
+		keys := make([]string, 0, len(f.objects))
+		for k := range f.objects {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if strings.HasPrefix(k, prefix) {
+				res.Contents = append(res.Contents, content{
+					Key:          strings.TrimPrefix(k, path+"/"),
+					Size:         len(f.objects[k]),
+					LastModified: time.Now().UTC().Format(time.RFC3339),
+				})
+			}
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		_ = xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>")
+			return
+		}
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(data))+`"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// Decodes a request body sent with the "aws-chunked" encoding, ignoring the signatures.
+func decodeAWSChunked(data []byte) []byte {
+	res := []byte{}
+	for len(data) > 0 {
+		idx := bytes.Index(data, []byte("\r\n"))
+		if idx < 0 {
+			break
+		}
+		sizeStr, _, _ := strings.Cut(string(data[:idx]), ";")
+		size, err := strconv.ParseInt(sizeStr, 16, 64)
+		if err != nil || size == 0 {
+			break
+		}
+		data = data[idx+2:]
+		res = append(res, data[:size]...)
+		data = data[size+2:]
+	}
+	return res
+}
+
+func TestRaftCluster(t *testing.T) {
+	dir := t.TempDir()
+
+	// Reserve a port for each node on loopback
+	ids := []string{"node1", "node2", "node3"}
+	addrs := make([]string, len(ids))
+	peers := make([]string, len(ids))
+	for i, id := range ids {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = l.Addr().String()
+		l.Close()
+		peers[i] = id + "=" + addrs[i]
+	}
+	nodeProps := func(i int) map[string]string {
+		return map[string]string{
+			connectionStringKey: filepath.Join(dir, ids[i]+".db"),
+			raftNodeIDKey:       ids[i],
+			raftBindAddressKey:  addrs[i],
+			raftPeersKey:        strings.Join(peers, ","),
+			raftDataDirKey:      filepath.Join(dir, ids[i]),
+
+			expirationNotificationsKey: "true",
+		}
+	}
+	initNode := func(t *testing.T, i int) *SQLiteStore {
+		s, err := initTestStore(t, nodeProps(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	set := func(t *testing.T, s *SQLiteStore, key string, value any) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: key, Value: value}))
+	}
+	strongGet := func(t *testing.T, s *SQLiteStore, key string) *state.GetResponse {
+		res, err := s.Get(&state.GetRequest{
+			Key:     key,
+			Options: state.GetStateOption{Consistency: state.Strong},
+		})
+		assert.NoError(t, err)
+		return res
+	}
+
+	nodes := make([]*SQLiteStore, len(ids))
+	for i := range ids {
+		nodes[i] = initNode(t, i)
+	}
+
+	// Wait for a leader to be elected
+	leader, follower := -1, -1
+	assert.Eventually(t, func() bool {
+		for i, s := range nodes {
+			if s.dbaccess.(*raftDBAccess).raft.State() == raft.Leader {
+				leader = i
+				follower = (i + 1) % len(nodes)
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 50*time.Millisecond)
+	if leader < 0 {
+		t.FailNow()
+	}
+	for _, s := range nodes {
+		assert.NoError(t, s.Ping())
+	}
+
+	t.Run("Writes on followers are forwarded to the leader", func(t *testing.T) {
+		key := randomKey()
+		set(t, nodes[follower], key, &fakeItem{Color: "forwarded"})
+
+		// Strong reads are served by the leader
+		for _, s := range nodes {
+			res := strongGet(t, s, key)
+			assert.Equal(t, `{"Color":"forwarded"}`, string(res.Data))
+		}
+
+		// Eventual reads are served by each node
+		for _, s := range nodes {
+			assert.Eventually(t, func() bool {
+				_, item := getItem(t, s, key)
+				return item != nil && item.Color == "forwarded"
+			}, 5*time.Second, 20*time.Millisecond)
+		}
+	})
+
+	t.Run("All nodes have the same ETag", func(t *testing.T) {
+		key := randomKey()
+		set(t, nodes[leader], key, "value")
+		etag := strongGet(t, nodes[leader], key).ETag
+		for _, s := range nodes {
+			assert.Eventually(t, func() bool {
+				res, err := s.Get(&state.GetRequest{Key: key})
+				return err == nil && res.ETag != nil && *res.ETag == *etag
+			}, 5*time.Second, 20*time.Millisecond)
+		}
+
+		// ETag errors are returned by followers too
+		wrong := "wrong"
+		err := nodes[follower].Set(&state.SetRequest{Key: key, Value: "new", ETag: &wrong})
+		var etagErr *state.ETagError
+		if assert.ErrorAs(t, err, &etagErr) {
+			assert.Equal(t, state.ETagMismatch, etagErr.Kind())
+		}
+		err = nodes[follower].Set(&state.SetRequest{Key: key, Value: "new", ETag: etag})
+		assert.NoError(t, err)
+		assert.Equal(t, `"new"`, string(strongGet(t, nodes[leader], key).Data))
+	})
+
+	t.Run("Transactions are replicated", func(t *testing.T) {
+		keep, remove := randomKey(), randomKey()
+		set(t, nodes[leader], remove, "remove")
+		err := nodes[follower].Multi(&state.TransactionalStateRequest{
+			Operations: []state.TransactionalStateOperation{
+				{Operation: state.Upsert, Request: state.SetRequest{Key: keep, Value: []byte("binary")}},
+				{Operation: state.Delete, Request: state.DeleteRequest{Key: remove}},
+			},
+		})
+		assert.NoError(t, err)
+		for _, s := range nodes {
+			res := strongGet(t, s, keep)
+			assert.Equal(t, "binary", string(res.Data))
+			res = strongGet(t, s, remove)
+			assert.Nil(t, res.Data)
+		}
+	})
+
+	t.Run("Patches are replicated", func(t *testing.T) {
+		key := randomKey()
+		set(t, nodes[leader], key, &fakeItem{Color: "red"})
+		err := nodes[follower].Patch(context.Background(), &PatchRequest{Key: key, Patch: []byte(`{"Color":"blue"}`)})
+		assert.NoError(t, err)
+
+		etag := strongGet(t, nodes[leader], key).ETag
+		for _, s := range nodes {
+			assert.Eventually(t, func() bool {
+				res, err := s.Get(&state.GetRequest{Key: key})
+				return err == nil && string(res.Data) == `{"Color":"blue"}` && *res.ETag == *etag
+			}, 5*time.Second, 20*time.Millisecond)
+		}
+	})
+
+	t.Run("Strong reads on followers return the persisted metadata", func(t *testing.T) {
+		key := randomKey()
+		err := nodes[follower].Set(&state.SetRequest{Key: key, Value: []byte("raw"), Metadata: map[string]string{"contentType": "text/plain"}})
+		assert.NoError(t, err)
+
+		res := strongGet(t, nodes[follower], key)
+		assert.Equal(t, []byte("raw"), res.Data)
+		if assert.NotNil(t, res.ContentType) {
+			assert.Equal(t, "text/plain", *res.ContentType)
+		}
+	})
+
+	t.Run("Sliding expirations are renewed on every node", func(t *testing.T) {
+		key := randomKey()
+		err := nodes[leader].Set(&state.SetRequest{Key: key, Value: "session", Metadata: map[string]string{"slidingTTL": "100"}})
+		assert.NoError(t, err)
+		expirationOf := func(s *SQLiteStore) (exp string) {
+			_ = s.dbaccess.(*raftDBAccess).local.db.QueryRow("SELECT expiration_time FROM state WHERE key = ?", key).Scan(&exp)
+			return exp
+		}
+		old := time.Now().Add(10 * time.Second).UTC().Format("2006-01-02 15:04:05")
+		for _, s := range nodes {
+			assert.Eventually(t, func() bool {
+				res, err := s.dbaccess.(*raftDBAccess).local.db.Exec("UPDATE state SET expiration_time = ? WHERE key = ?", old, key)
+				n, _ := res.RowsAffected()
+				return err == nil && n == 1
+			}, 5*time.Second, 20*time.Millisecond)
+		}
+
+		// A local read on a follower renews the expiration through the log
+		_, err = nodes[follower].Get(&state.GetRequest{Key: key})
+		assert.NoError(t, err)
+		for _, s := range nodes {
+			assert.Eventually(t, func() bool {
+				exp := expirationOf(s)
+				return exp != "" && exp > time.Now().Add(90*time.Second).UTC().Format(time.RFC3339)
+			}, 5*time.Second, 20*time.Millisecond)
+		}
+	})
+
+	t.Run("Increments are replicated", func(t *testing.T) {
+		key := randomKey()
+		for i, s := range []*SQLiteStore{nodes[leader], nodes[follower]} {
+			v, err := s.Increment(context.Background(), &IncrementRequest{Key: key, Delta: 2})
+			assert.NoError(t, err)
+			assert.Equal(t, float64(2*(i+1)), v)
+		}
+
+		for _, s := range nodes {
+			assert.Eventually(t, func() bool {
+				res, err := s.Get(&state.GetRequest{Key: key})
+				return err == nil && string(res.Data) == "4"
+			}, 5*time.Second, 20*time.Millisecond)
+		}
+	})
+
+	t.Run("Expired keys are delivered by the leader only", func(t *testing.T) {
+		ch := make(chan string, 10)
+		for i, s := range nodes {
+			i := i
+			assert.NoError(t, s.OnExpiration(func(ctx context.Context, key ExpiredKey) error {
+				ch <- fmt.Sprintf("%d:%s", i, key.Key)
+				return nil
+			}))
+		}
+
+		key := randomKey()
+		assert.NoError(t, nodes[follower].Set(&state.SetRequest{Key: key, Value: "v", Metadata: map[string]string{"ttlInSeconds": "1"}}))
+		// Expiration times have a resolution of one second
+		time.Sleep(2500 * time.Millisecond)
+		assert.NoError(t, nodes[leader].dbaccess.(*raftDBAccess).propose(context.Background(), raftCommand{Cleanup: true}))
+
+		select {
+		case k := <-ch:
+			assert.Equal(t, fmt.Sprintf("%d:%s", leader, key), k)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the expired key")
+		}
+
+		// The delivered key is removed on every node
+		for _, s := range nodes {
+			assert.Eventually(t, func() bool {
+				keys, err := s.dbaccess.(*raftDBAccess).local.readExpired(context.Background(), 10)
+				return err == nil && len(keys) == 0
+			}, 5*time.Second, 20*time.Millisecond)
+		}
+		assert.Empty(t, ch)
+	})
+
+	t.Run("Restarted nodes catch up", func(t *testing.T) {
+		restart := (leader + 2) % len(nodes)
+		before := randomKey()
+		set(t, nodes[leader], before, "before")
+		assert.Eventually(t, func() bool {
+			res, err := nodes[restart].Get(&state.GetRequest{Key: before})
+			return err == nil && res.Data != nil
+		}, 5*time.Second, 20*time.Millisecond)
+
+		// Take a snapshot, so the node is restored from it when it restarts
+		assert.NoError(t, nodes[restart].dbaccess.(*raftDBAccess).raft.Snapshot().Error())
+		assert.NoError(t, nodes[restart].Close())
+
+		after := randomKey()
+		set(t, nodes[leader], after, "after")
+
+		nodes[restart] = initNode(t, restart)
+		for _, key := range []string{before, after} {
+			assert.Eventually(t, func() bool {
+				res, err := nodes[restart].Get(&state.GetRequest{Key: key})
+				return err == nil && res.Data != nil
+			}, 10*time.Second, 20*time.Millisecond)
+		}
+	})
+
+	t.Run("Configuration errors", func(t *testing.T) {
+		tests := []struct {
+			name        string
+			props       map[string]string
+			expectedErr string
+		}{
+			{
+				name: "Missing bind address",
+				props: map[string]string{
+					connectionStringKey: getConnectionString(),
+					raftNodeIDKey:       "node1",
+					raftDataDirKey:      t.TempDir(),
+				},
+				expectedErr: "missing raftBindAddress",
+			},
+			{
+				name: "Peers without the node",
+				props: map[string]string{
+					connectionStringKey: getConnectionString(),
+					raftNodeIDKey:       "node4",
+					raftBindAddressKey:  "127.0.0.1:0",
+					raftDataDirKey:      t.TempDir(),
+					raftPeersKey:        strings.Join(peers, ","),
+				},
+				expectedErr: "raftPeers must include the node node4",
+			},
+			{
+				name: "Invalid peers",
+				props: map[string]string{
+					connectionStringKey: getConnectionString(),
+					raftNodeIDKey:       "node1",
+					raftBindAddressKey:  "127.0.0.1:0",
+					raftDataDirKey:      t.TempDir(),
+					raftPeersKey:        "node1",
+				},
+				expectedErr: "illegal raftPeers value: node1",
+			},
+			{
+				name: "Cache mode",
+				props: map[string]string{
+					connectionStringKey: getConnectionString(),
+					raftNodeIDKey:       "node1",
+					raftBindAddressKey:  "127.0.0.1:0",
+					raftDataDirKey:      t.TempDir(),
+					cacheMaxRowsKey:     "100",
+				},
+				expectedErr: "cache mode is not supported in clustered mode",
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := initTestStore(t, tt.props)
+				if assert.Error(t, err) {
+					assert.Equal(t, tt.expectedErr, err.Error())
+				}
+			})
+		}
+	})
+}
+
+func TestRaftTLS(t *testing.T) {
+	dir := t.TempDir()
+	props := writeTestCertificates(t, dir, "cluster")
+	cfg, err := parseRaftTLSConfig(state.Metadata{Base: metadata.Base{Properties: props}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded := make(chan struct{}, 1)
+	server, err := newRaftStreamLayer("127.0.0.1:0", nil, cfg, func(conn net.Conn) {
+		forwarded <- struct{}{}
+		conn.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	addr := raft.ServerAddress(server.Addr().String())
+
+	t.Run("Nodes with a certificate of the cluster can connect", func(t *testing.T) {
+		client, err := newRaftStreamLayer("127.0.0.1:0", nil, cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		conn, err := client.Dial(addr, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+
+		accepted, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer accepted.Close()
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(accepted, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(buf))
+	})
+
+	t.Run("Other peers are rejected", func(t *testing.T) {
+		// Without TLS
+		conn, err := net.Dial("tcp", string(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = conn.Write([]byte{raftConnForward})
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Error(t, err)
+		conn.Close()
+
+		// With a certificate signed by another CA
+		otherCfg, err := parseRaftTLSConfig(state.Metadata{Base: metadata.Base{Properties: writeTestCertificates(t, t.TempDir(), "other")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := newRaftStreamLayer("127.0.0.1:0", nil, otherCfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		_, err = other.dial(addr, time.Second, raftConnForward)
+		assert.Error(t, err)
+
+		select {
+		case <-forwarded:
+			t.Fatal("a connection that was not authenticated was forwarded")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("Configuration errors", func(t *testing.T) {
+		_, err := parseRaftTLSConfig(state.Metadata{Base: metadata.Base{Properties: map[string]string{
+			raftTLSCertFileKey: props[raftTLSCertFileKey],
+		}}})
+		if assert.Error(t, err) {
+			assert.Equal(t, "raftTLSCertFile, raftTLSKeyFile and raftTLSCAFile must be set together", err.Error())
+		}
+	})
+}
+
+// Creates a CA and a certificate for 127.0.0.1 signed by it, and returns the properties with their files.
+func writeTestCertificates(t *testing.T, dir string, name string) map[string]string {
+	t.Helper()
+
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	writePEM := func(file string, typ string, der []byte) string {
+		path := filepath.Join(dir, file)
+		err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	caKey := newKey()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name + " CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeKey := newKey()
+	nodeTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name + " node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	nodeDER, err := x509.CreateCertificate(rand.Reader, nodeTemplate, caTemplate, &nodeKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]string{
+		raftTLSCertFileKey: writePEM("node.crt", "CERTIFICATE", nodeDER),
+		raftTLSKeyFileKey:  writePEM("node.key", "EC PRIVATE KEY", keyDER),
+		raftTLSCAFileKey:   writePEM("ca.crt", "CERTIFICATE", caDER),
+	}
+}
+
+func TestSharding(t *testing.T) {
+	dir := t.TempDir()
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey: filepath.Join(dir, "state-{shard}.db"),
+		shardsKey:           "4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharded := s.dbaccess.(*shardedDBAccess)
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = randomKey()
+		assert.NoError(t, s.Set(&state.SetRequest{Key: keys[i], Value: &fakeItem{Color: strconv.Itoa(i)}}))
+	}
+
+	t.Run("Keys are distributed between shards", func(t *testing.T) {
+		for i, key := range keys {
+			_, item := getItem(t, s, key)
+			assert.Equal(t, strconv.Itoa(i), item.Color)
+		}
+		for i := 0; i < 4; i++ {
+			assert.FileExists(t, filepath.Join(dir, "state-"+strconv.Itoa(i)+".db"))
+		}
+
+		stats, err := s.Stats(context.Background())
+		assert.NoError(t, err)
+		assert.Len(t, stats, 4)
+		var total int64
+		for i, st := range stats {
+			assert.Equal(t, "shard-"+strconv.Itoa(i), st.Name)
+			assert.Equal(t, filepath.Join(dir, "state-"+strconv.Itoa(i)+".db"), st.Path)
+			assert.Greater(t, st.Rows, int64(0))
+			assert.Greater(t, st.SizeBytes, int64(0))
+			total += st.Rows
+		}
+		assert.Equal(t, int64(len(keys)), total)
+	})
+
+	t.Run("Transactions on a single shard", func(t *testing.T) {
+		var sameShard []string
+		for _, key := range keys {
+			if sharded.ring.get(key) == sharded.ring.get(keys[0]) {
+				sameShard = append(sameShard, key)
+			}
+		}
+		if len(sameShard) < 2 {
+			t.Skip("not enough keys in the same shard")
+		}
+
+		err := s.Multi(&state.TransactionalStateRequest{
+			Operations: []state.TransactionalStateOperation{
+				{Operation: state.Upsert, Request: state.SetRequest{Key: sameShard[0], Value: "updated"}},
+				{Operation: state.Delete, Request: state.DeleteRequest{Key: sameShard[1]}},
+			},
+		})
+		assert.NoError(t, err)
+		res, _ := getItem(t, s, sameShard[0])
+		assert.Equal(t, `"updated"`, string(res.Data))
+		res, _ = getItem(t, s, sameShard[1])
+		assert.Nil(t, res.Data)
+	})
+
+	t.Run("Transactions across shards are rejected", func(t *testing.T) {
+		var other string
+		for _, key := range keys {
+			if sharded.ring.get(key) != sharded.ring.get(keys[0]) {
+				other = key
+				break
+			}
+		}
+
+		err := s.Multi(&state.TransactionalStateRequest{
+			Operations: []state.TransactionalStateOperation{
+				{Operation: state.Upsert, Request: state.SetRequest{Key: keys[0], Value: "rejected"}},
+				{Operation: state.Upsert, Request: state.SetRequest{Key: other, Value: "rejected"}},
+			},
+		})
+		assert.EqualError(t, err, "the transaction contains keys stored in different shards")
+		res, _ := getItem(t, s, other)
+		assert.NotEqual(t, `"rejected"`, string(res.Data))
+	})
+
+	t.Run("Bulk operations span shards", func(t *testing.T) {
+		reqs := make([]state.DeleteRequest, len(keys))
+		for i, key := range keys {
+			reqs[i] = state.DeleteRequest{Key: key}
+		}
+		assert.NoError(t, s.BulkDelete(reqs))
+		for _, key := range keys {
+			res, _ := getItem(t, s, key)
+			assert.Nil(t, res.Data)
+		}
+	})
+
+	t.Run("Backs up each shard", func(t *testing.T) {
+		key := randomKey()
+		assert.NoError(t, s.Set(&state.SetRequest{Key: key, Value: &fakeItem{Color: "backup"}}))
+
+		files, err := s.Backup(context.Background(), filepath.Join(dir, "backup"))
+		assert.NoError(t, err)
+		assert.Len(t, files, 4)
+
+		shard := sharded.ring.get(key)
+		db, err := sql.Open("sqlite3", "file:"+files[shard]+"?mode=ro")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		var count int
+		err = db.QueryRow("SELECT count(*) FROM state WHERE key = ?", key).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("Connection string without placeholder", func(t *testing.T) {
+		_, err := initTestStore(t, map[string]string{
+			connectionStringKey: filepath.Join(dir, "state.db"),
+			shardsKey:           "2",
+		})
+		assert.EqualError(t, err, "the connection string must contain {shard} when using multiple shards")
+	})
+}
+
+func TestTenantIsolation(t *testing.T) {
+	dir := t.TempDir()
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey:  filepath.Join(dir, "tenant-{tenant}.db"),
+		tenantIsolationKey:   "true",
+		tenantIdleTimeoutKey: "200ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants := s.dbaccess.(*tenantDBAccess)
+	set := func(t *testing.T, key string, value any) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: key, Value: value}))
+	}
+
+	t.Run("Each app ID has its own database", func(t *testing.T) {
+		set(t, "app1||key", "one")
+		set(t, "app2||key", "two")
+		res, _ := getItem(t, s, "app1||key")
+		assert.Equal(t, `"one"`, string(res.Data))
+		res, _ = getItem(t, s, "app2||key")
+		assert.Equal(t, `"two"`, string(res.Data))
+
+		for _, tenant := range []string{"app1", "app2"} {
+			db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "tenant-"+tenant+".db")+"?mode=ro")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			rows, err := db.Query("SELECT key FROM state")
+			assert.NoError(t, err)
+			for rows.Next() {
+				var key string
+				assert.NoError(t, rows.Scan(&key))
+				keys = append(keys, key)
+			}
+			rows.Close()
+			db.Close()
+			assert.Equal(t, []string{tenant + "||key"}, keys)
+		}
+	})
+
+	t.Run("Databases are closed when idle and reopened", func(t *testing.T) {
+		set(t, "app3||key", "three")
+		assert.Eventually(t, func() bool {
+			tenants.lock.Lock()
+			defer tenants.lock.Unlock()
+			_, ok := tenants.tenants["app3"]
+			return !ok
+		}, 2*time.Second, 20*time.Millisecond)
+
+		res, _ := getItem(t, s, "app3||key")
+		assert.Equal(t, `"three"`, string(res.Data))
+	})
+
+	t.Run("Transactions", func(t *testing.T) {
+		err := s.Multi(&state.TransactionalStateRequest{
+			Operations: []state.TransactionalStateOperation{
+				{Operation: state.Upsert, Request: state.SetRequest{Key: "app1||a", Value: "a"}},
+				{Operation: state.Upsert, Request: state.SetRequest{Key: "app1||b", Value: "b"}},
+			},
+		})
+		assert.NoError(t, err)
+
+		err = s.Multi(&state.TransactionalStateRequest{
+			Operations: []state.TransactionalStateOperation{
+				{Operation: state.Upsert, Request: state.SetRequest{Key: "app1||c", Value: "c"}},
+				{Operation: state.Upsert, Request: state.SetRequest{Key: "app2||c", Value: "c"}},
+			},
+		})
+		assert.EqualError(t, err, "the transaction contains keys of different tenants")
+	})
+
+	t.Run("Invalid keys", func(t *testing.T) {
+		err := s.Set(&state.SetRequest{Key: "nokey", Value: "x"})
+		assert.EqualError(t, err, "key 'nokey' does not contain a tenant")
+		err = s.Set(&state.SetRequest{Key: "../app||key", Value: "x"})
+		assert.EqualError(t, err, "invalid tenant in key '../app||key': ../app")
+	})
+
+	t.Run("Stats and backups of all tenants", func(t *testing.T) {
+		stats, err := s.Stats(context.Background())
+		assert.NoError(t, err)
+		names := make([]string, len(stats))
+		for i, st := range stats {
+			names[i] = st.Name
+		}
+		assert.Equal(t, []string{"app1", "app2", "app3"}, names)
+		assert.Equal(t, int64(3), stats[0].Rows)
+
+		files, err := s.Backup(context.Background(), filepath.Join(dir, "backup"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			filepath.Join(dir, "backup", "app1.db"),
+			filepath.Join(dir, "backup", "app2.db"),
+			filepath.Join(dir, "backup", "app3.db"),
+		}, files)
+	})
+
+	t.Run("Delete a tenant", func(t *testing.T) {
+		assert.NoError(t, s.DeleteTenant("app2"))
+		assert.NoFileExists(t, filepath.Join(dir, "tenant-app2.db"))
+		res, _ := getItem(t, s, "app2||key")
+		assert.Nil(t, res.Data)
+		res, _ = getItem(t, s, "app1||key")
+		assert.Equal(t, `"one"`, string(res.Data))
+	})
+
+	t.Run("Custom segment and separator", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{
+			connectionStringKey:   filepath.Join(dir, "actor-{tenant}.db"),
+			tenantIsolationKey:    "true",
+			tenantKeySeparatorKey: "|",
+			tenantKeySegmentKey:   "1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "app|myactor|1|key", Value: "x"}))
+		assert.FileExists(t, filepath.Join(dir, "actor-myactor.db"))
+	})
+
+	t.Run("Opening a database doesn't block other tenants", func(t *testing.T) {
+		// The database of the slow tenant is locked, so opening it waits for the busy timeout
+		lockDB, err := sql.Open("sqlite3", filepath.Join(dir, "lock-slow.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lockDB.Close()
+		conn, err := lockDB.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, err = conn.ExecContext(context.Background(), "BEGIN EXCLUSIVE")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := initTestStore(t, map[string]string{
+			connectionStringKey: filepath.Join(dir, "lock-{tenant}.db"),
+			tenantIsolationKey:  "true",
+			busyTimeoutKey:      "5s",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		slowDone := make(chan error, 1)
+		go func() {
+			slowDone <- s.Set(&state.SetRequest{Key: "slow||key", Value: "slow"})
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		start := time.Now()
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "fast||key", Value: "fast"}))
+		assert.Less(t, time.Since(start), time.Second)
+		select {
+		case <-slowDone:
+			t.Fatal("the slow tenant was opened while its database is locked")
+		default:
+		}
+
+		_, err = conn.ExecContext(context.Background(), "ROLLBACK")
+		assert.NoError(t, err)
+		assert.NoError(t, <-slowDone)
+		res, _ := getItem(t, s, "slow||key")
+		assert.Equal(t, `"slow"`, string(res.Data))
+	})
+
+	t.Run("Expired keys of closed databases are removed", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{
+			connectionStringKey:  filepath.Join(dir, "cleanup-{tenant}.db"),
+			tenantIsolationKey:   "true",
+			tenantIdleTimeoutKey: "100ms",
+			cleanupIntervalKey:   "1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanupTenants := s.dbaccess.(*tenantDBAccess)
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "app1||key", Value: "v", Metadata: map[string]string{metadataTTLKey: "1"}}))
+		assert.Eventually(t, func() bool {
+			cleanupTenants.lock.Lock()
+			defer cleanupTenants.lock.Unlock()
+			_, ok := cleanupTenants.tenants["app1"]
+			return !ok
+		}, 2*time.Second, 20*time.Millisecond)
+
+		db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "cleanup-app1.db")+"?mode=ro")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		assert.Eventually(t, func() bool {
+			var count int
+			err := db.QueryRow("SELECT COUNT(*) FROM state").Scan(&count)
+			return err == nil && count == 0
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("In-memory databases without a persist file are never closed", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{
+			modeKey:              modeMemory,
+			tenantIsolationKey:   "true",
+			tenantIdleTimeoutKey: "100ms",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "app1||key", Value: "kept"}))
+
+		time.Sleep(500 * time.Millisecond)
+		res, _ := getItem(t, s, "app1||key")
+		assert.Equal(t, `"kept"`, string(res.Data))
+	})
+
+	t.Run("In-memory databases are persisted when they're closed", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{
+			modeKey:              modeMemory,
+			persistFileKey:       filepath.Join(dir, "memory-{tenant}.db"),
+			tenantIsolationKey:   "true",
+			tenantIdleTimeoutKey: "100ms",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		memTenants := s.dbaccess.(*tenantDBAccess)
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "app1||key", Value: "persisted"}))
+
+		// Databases are removed from the map before they're persisted and closed
+		assert.Eventually(t, func() bool {
+			memTenants.lock.Lock()
+			defer memTenants.lock.Unlock()
+			_, open := memTenants.tenants["app1"]
+			_, closing := memTenants.closing["app1"]
+			return !open && !closing
+		}, 2*time.Second, 20*time.Millisecond)
+		assert.FileExists(t, filepath.Join(dir, "memory-app1.db"))
+
+		res, _ := getItem(t, s, "app1||key")
+		assert.Equal(t, `"persisted"`, string(res.Data))
+	})
+
+	t.Run("Closing a database doesn't block other tenants", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{
+			modeKey:              modeMemory,
+			persistFileKey:       filepath.Join(dir, "slow-close-{tenant}.db"),
+			tenantIsolationKey:   "true",
+			tenantIdleTimeoutKey: "1h",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		memTenants := s.dbaccess.(*tenantDBAccess)
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "slow||key", Value: "persisted"}))
+
+		// Persisting the database waits for its lock
+		memTenants.lock.Lock()
+		slow := memTenants.tenants["slow"]
+		slow.lastUsed = time.Now().Add(-2 * time.Hour)
+		memTenants.lock.Unlock()
+		slow.access.lock.Lock()
+		closed := make(chan struct{})
+		go func() {
+			memTenants.closeIdle()
+			close(closed)
+		}()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Set(&state.SetRequest{Key: "fast||key", Value: "v"})
+		}()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(2 * time.Second):
+			t.Error("the request of another tenant was blocked")
+		}
+
+		// The database is opened again once it's been persisted
+		got := make(chan *state.GetResponse, 1)
+		go func() {
+			res, _ := getItem(t, s, "slow||key")
+			got <- res
+		}()
+		time.Sleep(50 * time.Millisecond)
+		slow.access.lock.Unlock()
+		<-closed
+		res := <-got
+		assert.Equal(t, `"persisted"`, string(res.Data))
+	})
+
+	t.Run("The size of each tenant's database is limited", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{
+			connectionStringKey: filepath.Join(dir, "limited-{tenant}.db"),
+			tenantIsolationKey:  "true",
+			tenantMaxSizeKey:    "131072",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value := strings.Repeat("x", 8192)
+		for i := 0; i < 32 && err == nil; i++ {
+			err = s.Set(&state.SetRequest{Key: fmt.Sprintf("big||%d", i), Value: value})
+		}
+		var storeErr *StoreError
+		if assert.ErrorAs(t, err, &storeErr) {
+			assert.Equal(t, StoreErrorResourceExhausted, storeErr.Kind())
+		}
+		info, statErr := os.Stat(filepath.Join(dir, "limited-big.db"))
+		if assert.NoError(t, statErr) {
+			assert.LessOrEqual(t, info.Size(), int64(131072))
+		}
+
+		// Other tenants have their own limit
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "small||key", Value: value}))
+	})
+
+	t.Run("The persist file must contain the placeholder", func(t *testing.T) {
+		_, err := initTestStore(t, map[string]string{
+			modeKey:            modeMemory,
+			persistFileKey:     filepath.Join(dir, "memory.db"),
+			tenantIsolationKey: "true",
+		})
+		assert.EqualError(t, err, "the persist file must contain {tenant} when using tenant isolation")
+	})
+}
+
+func TestHistory(t *testing.T) {
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey:    filepath.Join(t.TempDir(), "history.db"),
+		historyLimitKey:        "3",
+		historyRetentionKey:    "1h",
+		persistMetadataKeysKey: "owner",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Versions are listed newest first and pruned to the limit", func(t *testing.T) {
+		for i := 1; i <= 4; i++ {
+			assert.NoError(t, s.Set(&state.SetRequest{Key: "limited", Value: i}))
+		}
+		res, _ := getItem(t, s, "limited")
+
+		versions, err := s.ListVersions(context.Background(), "limited")
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 3) {
+			assert.Equal(t, *res.ETag, versions[0].ETag)
+			assert.Greater(t, versions[0].Version, versions[1].Version)
+			assert.Greater(t, versions[1].Version, versions[2].Version)
+			assert.WithinDuration(t, time.Now(), versions[0].Time, time.Minute)
+			assert.Nil(t, versions[0].Data)
+		}
+
+		v, err := s.GetVersion(context.Background(), "limited", versions[2].Version)
+		assert.NoError(t, err)
+		assert.Equal(t, "2", string(v.Data))
+	})
+
+	t.Run("Restore a previous version", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "restore", Value: map[string]string{"v": "old"}}))
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "restore", Value: map[string]string{"v": "new"}}))
+		versions, err := s.ListVersions(context.Background(), "restore")
+		assert.NoError(t, err)
+		old := versions[1]
+
+		wrongETag := "wrong"
+		err = s.RestoreVersion(context.Background(), "restore", old.Version, &wrongETag)
+		var etagErr *state.ETagError
+		assert.ErrorAs(t, err, &etagErr)
+
+		assert.NoError(t, s.RestoreVersion(context.Background(), "restore", old.Version, &versions[0].ETag))
+		res, _ := getItem(t, s, "restore")
+		assert.Equal(t, `{"v":"old"}`, string(res.Data))
+		assert.NotEqual(t, old.ETag, *res.ETag)
+
+		versions, err = s.ListVersions(context.Background(), "restore")
+		assert.NoError(t, err)
+		assert.Len(t, versions, 3)
+	})
+
+	t.Run("Restore keeps the persisted metadata of the version", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{
+			Key:      "restore-metadata",
+			Value:    "old",
+			Metadata: map[string]string{"contentType": "text/plain", "owner": "alice", "other": "x"},
+		}))
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "restore-metadata", Value: "new"}))
+		versions, err := s.ListVersions(context.Background(), "restore-metadata")
+		assert.NoError(t, err)
+
+		v, err := s.GetVersion(context.Background(), "restore-metadata", versions[1].Version)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"contentType": "text/plain", "owner": "alice"}, v.Metadata)
+
+		assert.NoError(t, s.RestoreVersion(context.Background(), "restore-metadata", versions[1].Version, nil))
+		res, err := s.Get(&state.GetRequest{Key: "restore-metadata"})
+		assert.NoError(t, err)
+		assert.Equal(t, `"old"`, string(res.Data))
+		if assert.NotNil(t, res.ContentType) {
+			assert.Equal(t, "text/plain", *res.ContentType)
+		}
+		assert.Equal(t, "alice", res.Metadata["owner"])
+	})
+
+	t.Run("Binary values", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "binary", Value: []byte{0, 1, 2}}))
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "binary", Value: "text"}))
+		versions, err := s.ListVersions(context.Background(), "binary")
+		assert.NoError(t, err)
+
+		v, err := s.GetVersion(context.Background(), "binary", versions[1].Version)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 1, 2}, v.Data)
+
+		assert.NoError(t, s.RestoreVersion(context.Background(), "binary", v.Version, nil))
+		res, _ := getItem(t, s, "binary")
+		assert.Equal(t, []byte{0, 1, 2}, res.Data)
+	})
+
+	t.Run("Deletions are recorded", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "deleted", Value: "value"}))
+		assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "deleted"}))
+		versions, err := s.ListVersions(context.Background(), "deleted")
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 2) {
+			assert.True(t, versions[0].Deleted)
+			assert.Empty(t, versions[0].ETag)
+			assert.False(t, versions[1].Deleted)
+		}
+
+		err = s.RestoreVersion(context.Background(), "deleted", versions[0].Version, nil)
+		assert.Error(t, err)
+		assert.NoError(t, s.RestoreVersion(context.Background(), "deleted", versions[1].Version, nil))
+		res, _ := getItem(t, s, "deleted")
+		assert.Equal(t, `"value"`, string(res.Data))
+	})
+
+	t.Run("Transactions record versions", func(t *testing.T) {
+		err := s.Multi(&state.TransactionalStateRequest{
+			Operations: []state.TransactionalStateOperation{
+				{Operation: state.Upsert, Request: state.SetRequest{Key: "multi", Value: "a"}},
+				{Operation: state.Upsert, Request: state.SetRequest{Key: "multi", Value: "b"}},
+			},
+		})
+		assert.NoError(t, err)
+		versions, err := s.ListVersions(context.Background(), "multi")
+		assert.NoError(t, err)
+		assert.Len(t, versions, 2)
+	})
+
+	t.Run("Unknown versions", func(t *testing.T) {
+		v, err := s.GetVersion(context.Background(), "limited", 1000)
+		assert.NoError(t, err)
+		assert.Nil(t, v)
+		versions, err := s.ListVersions(context.Background(), "missing")
+		assert.NoError(t, err)
+		assert.Empty(t, versions)
+	})
+
+	t.Run("Old versions are removed by the cleanup", func(t *testing.T) {
+		a := s.dbaccess.(*sqliteDBAccess)
+		_, err := a.deleteExpired(context.Background(), time.Now().Add(2*time.Hour))
+		assert.NoError(t, err)
+		versions, err := s.ListVersions(context.Background(), "limited")
+		assert.NoError(t, err)
+		assert.Empty(t, versions)
+	})
+
+	t.Run("History is disabled by default", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{
+			connectionStringKey: filepath.Join(t.TempDir(), "nohistory.db"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.ListVersions(context.Background(), "key")
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid limit", func(t *testing.T) {
+		_, err := initTestStore(t, map[string]string{
+			connectionStringKey: filepath.Join(t.TempDir(), "invalid.db"),
+			historyLimitKey:     "-1",
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestSoftDelete(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "softdelete.db")
+	countRows := func(t *testing.T, s *SQLiteStore, key string) int {
+		var n int
+		err := s.dbaccess.(*sqliteDBAccess).db.QueryRow("SELECT COUNT(*) FROM state WHERE key = ?", key).Scan(&n)
+		assert.NoError(t, err)
+		return n
+	}
+
+	// Create the table before soft delete is enabled, so the column is added to an existing table
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey: dbPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, s.Set(&state.SetRequest{Key: "existing", Value: "value"}))
+	s.Close()
+
+	s, err = initTestStore(t, map[string]string{
+		connectionStringKey:      dbPath,
+		softDeleteKey:            "true",
+		softDeleteGracePeriodKey: "1h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Deleted rows are hidden but kept", func(t *testing.T) {
+		assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "existing"}))
+		res, _ := getItem(t, s, "existing")
+		assert.Nil(t, res.Data)
+		assert.Nil(t, res.ETag)
+		assert.Equal(t, 1, countRows(t, s, "existing"))
+
+		// Deleting again is a no-op
+		assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "existing"}))
+	})
+
+	t.Run("Undelete restores the value with a new ETag", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "undelete", Value: "value"}))
+		before, _ := getItem(t, s, "undelete")
+		assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "undelete", ETag: before.ETag}))
+
+		etag, err := s.Undelete(context.Background(), "undelete")
+		assert.NoError(t, err)
+		assert.NotEqual(t, *before.ETag, etag)
+		res, _ := getItem(t, s, "undelete")
+		assert.Equal(t, `"value"`, string(res.Data))
+		assert.Equal(t, etag, *res.ETag)
+
+		_, err = s.Undelete(context.Background(), "undelete")
+		var storeErr *StoreError
+		if assert.ErrorAs(t, err, &storeErr) {
+			assert.Equal(t, StoreErrorConflict, storeErr.Kind())
+		}
+	})
+
+	t.Run("Deleted rows don't match their ETag", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "etag", Value: "value"}))
+		res, _ := getItem(t, s, "etag")
+		assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "etag"}))
+
+		err := s.Set(&state.SetRequest{Key: "etag", Value: "new", ETag: res.ETag})
+		var etagErr *state.ETagError
+		assert.ErrorAs(t, err, &etagErr)
+		err = s.Delete(&state.DeleteRequest{Key: "etag", ETag: res.ETag})
+		assert.ErrorAs(t, err, &etagErr)
+
+		// Setting the key without an ETag replaces the deleted row
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "etag", Value: "new"}))
+		res, _ = getItem(t, s, "etag")
+		assert.Equal(t, `"new"`, string(res.Data))
+	})
+
+	t.Run("Deleted rows are purged after the grace period", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "purge", Value: "value"}))
+		assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "purge"}))
+
+		a := s.dbaccess.(*sqliteDBAccess)
+		_, err := a.deleteExpired(context.Background(), time.Time{})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, countRows(t, s, "purge"))
+
+		_, err = a.deleteExpired(context.Background(), time.Now().Add(2*time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, countRows(t, s, "purge"))
+
+		_, err = s.Undelete(context.Background(), "purge")
+		assert.Error(t, err)
+	})
+
+	t.Run("Undelete requires soft delete", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{
+			connectionStringKey: filepath.Join(t.TempDir(), "hard.db"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "key", Value: "value"}))
+		assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "key"}))
+		_, err = s.Undelete(context.Background(), "key")
+		assert.Error(t, err)
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey:  filepath.Join(t.TempDir(), "audit.db"),
+		auditLogKey:          "true",
+		auditMetadataKeysKey: "appID, user",
+		auditRetentionKey:    "1h",
+		softDeleteKey:        "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	start := time.Now()
+	md := map[string]string{"appID": "app1", "user": "alice", "secret": "hidden"}
+	assert.NoError(t, s.Set(&state.SetRequest{Key: "key", Value: "one", Metadata: md}))
+	first, _ := getItem(t, s, "key")
+	assert.NoError(t, s.Set(&state.SetRequest{Key: "key", Value: "two"}))
+	second, _ := getItem(t, s, "key")
+	assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "key", Metadata: map[string]string{"appID": "app2"}}))
+	newETag, err := s.Undelete(ctx, "key")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set(&state.SetRequest{Key: "other", Value: "value"}))
+
+	// Deletions of missing keys and failed writes are not recorded
+	assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "missing"}))
+	wrongETag := "wrong"
+	assert.Error(t, s.Set(&state.SetRequest{Key: "key", Value: "three", ETag: &wrongETag}))
+
+	t.Run("Query by key", func(t *testing.T) {
+		entries, err := s.QueryAuditLog(ctx, AuditQuery{Key: "key"})
+		assert.NoError(t, err)
+		if !assert.Len(t, entries, 4) {
+			return
+		}
+
+		assert.Equal(t, "upsert", entries[0].Operation)
+		assert.Empty(t, entries[0].OldETag)
+		assert.Equal(t, *first.ETag, entries[0].NewETag)
+		assert.Equal(t, map[string]string{"appID": "app1", "user": "alice"}, entries[0].Metadata)
+		assert.WithinDuration(t, start, entries[0].Time, time.Minute)
+
+		assert.Equal(t, "upsert", entries[1].Operation)
+		assert.Equal(t, *first.ETag, entries[1].OldETag)
+		assert.Equal(t, *second.ETag, entries[1].NewETag)
+		assert.Nil(t, entries[1].Metadata)
+
+		assert.Equal(t, "delete", entries[2].Operation)
+		assert.Equal(t, *second.ETag, entries[2].OldETag)
+		assert.Empty(t, entries[2].NewETag)
+		assert.Equal(t, map[string]string{"appID": "app2"}, entries[2].Metadata)
+
+		assert.Equal(t, "undelete", entries[3].Operation)
+		assert.Equal(t, newETag, entries[3].NewETag)
+	})
+
+	t.Run("Query by time range", func(t *testing.T) {
+		entries, err := s.QueryAuditLog(ctx, AuditQuery{Since: start.Add(-time.Second)})
+		assert.NoError(t, err)
+		assert.Len(t, entries, 5)
+
+		entries, err = s.QueryAuditLog(ctx, AuditQuery{Since: start.Add(-time.Second), Limit: 2})
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+
+		entries, err = s.QueryAuditLog(ctx, AuditQuery{Until: start.Add(-time.Second)})
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("Old entries are removed by the cleanup", func(t *testing.T) {
+		_, err := s.dbaccess.(*sqliteDBAccess).deleteExpired(ctx, time.Now().Add(2*time.Hour))
+		assert.NoError(t, err)
+		entries, err := s.QueryAuditLog(ctx, AuditQuery{})
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
+
+func TestJSONIndexes(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "indexes.db")
+	initStore := func(t *testing.T, indexes string) (*SQLiteStore, error) {
+		return initTestStore(t, map[string]string{
+			connectionStringKey: dbPath,
+			jsonIndexesKey:      indexes,
+		})
+	}
+	paths := func(indexes []JSONIndex) []string {
+		res := make([]string, len(indexes))
+		for i, idx := range indexes {
+			res[i] = idx.Path
+		}
+		sort.Strings(res)
+		return res
+	}
+
+	t.Run("Indexes are created", func(t *testing.T) {
+		s, err := initStore(t, "status, $.customer.id, items[0].sku")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		indexes, err := s.JSONIndexes(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"$.customer.id", "$.items[0].sku", "$.status"}, paths(indexes))
+
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "order", Value: map[string]any{"status": "shipped"}}))
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "binary", Value: []byte("not json")}))
+
+		var plan string
+		err = s.dbaccess.(*sqliteDBAccess).db.QueryRow(
+			"EXPLAIN QUERY PLAN SELECT key FROM state WHERE json_extract(value, '$.status') = 'shipped'",
+		).Scan(new(int), new(int), new(int), &plan)
+		assert.NoError(t, err)
+		assert.Contains(t, plan, "USING INDEX idx_state_json_status_")
+	})
+
+	t.Run("Indexes that are not declared anymore are dropped", func(t *testing.T) {
+		s, err := initStore(t, "status")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		indexes, err := s.JSONIndexes(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"$.status"}, paths(indexes))
+	})
+
+	t.Run("Invalid paths are rejected", func(t *testing.T) {
+		_, err := initStore(t, "status'); DROP TABLE state; --")
+		assert.Error(t, err)
+	})
+}
+
+func TestFullTextSearch(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "search.db")
+	search := func(t *testing.T, s *SQLiteStore, q SearchQuery) []string {
+		results, err := s.Search(context.Background(), q)
+		assert.NoError(t, err)
+		keys := make([]string, len(results))
+		for i, r := range results {
+			keys[i] = r.Key
+		}
+		return keys
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var available bool
+	err = db.QueryRow(fts5AvailableStmt).Scan(&available)
+	db.Close()
+	assert.NoError(t, err)
+	if !available {
+		_, err = initTestStore(t, map[string]string{
+			connectionStringKey: dbPath,
+			fullTextSearchKey:   "true",
+		})
+		assert.ErrorContains(t, err, "sqlite_fts5")
+		t.Skip("FTS5 is not available; run the tests with -tags sqlite_fts5")
+	}
+
+	// Values written before full-text search is enabled are indexed too
+	s, err := initTestStore(t, map[string]string{connectionStringKey: dbPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, s.Set(&state.SetRequest{Key: "orders||1", Value: map[string]string{"status": "shipped", "note": "fragile parcel"}}))
+	s.Close()
+
+	s, err = initTestStore(t, map[string]string{
+		connectionStringKey: dbPath,
+		fullTextSearchKey:   "true",
+		softDeleteKey:       "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Search the whole value", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "orders||2", Value: map[string]string{"status": "pending", "note": "parcel"}}))
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "users||1", Value: map[string]string{"name": "parcel enthusiast"}}))
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "binary", Value: []byte("parcel")}))
+
+		assert.ElementsMatch(t, []string{"orders||1", "orders||2", "users||1"}, search(t, s, SearchQuery{Query: "parcel"}))
+		assert.Equal(t, []string{"orders||1"}, search(t, s, SearchQuery{Query: "shipped"}))
+		assert.ElementsMatch(t, []string{"orders||1", "orders||2"}, search(t, s, SearchQuery{Query: "parcel", KeyPrefix: "orders||"}))
+		assert.Len(t, search(t, s, SearchQuery{Query: "parcel", Limit: 1}), 1)
+
+		results, err := s.Search(context.Background(), SearchQuery{Query: "fragile"})
+		assert.NoError(t, err)
+		if assert.Len(t, results, 1) {
+			assert.Contains(t, results[0].Snippet, "<b>fragile</b>")
+			assert.Less(t, results[0].Rank, 0.0)
+		}
+	})
+
+	t.Run("Updates and deletions are reflected", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "orders||2", Value: map[string]string{"status": "delivered"}}))
+		assert.Empty(t, search(t, s, SearchQuery{Query: "pending"}))
+		assert.Equal(t, []string{"orders||2"}, search(t, s, SearchQuery{Query: "delivered"}))
+
+		etag := "wrong"
+		assert.Error(t, s.Set(&state.SetRequest{Key: "orders||2", Value: "ignored", ETag: &etag}))
+		assert.Equal(t, []string{"orders||2"}, search(t, s, SearchQuery{Query: "delivered"}))
+
+		assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "orders||2"}))
+		assert.Empty(t, search(t, s, SearchQuery{Query: "delivered"}))
+	})
+
+	t.Run("Invalid queries", func(t *testing.T) {
+		_, err := s.Search(context.Background(), SearchQuery{Query: `"unterminated`})
+		assert.Error(t, err)
+	})
+
+	t.Run("Results don't depend on the rowids of the state table", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "renumbered||1", Value: "first"}))
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "renumbered||2", Value: "second"}))
+
+		// VACUUM may change the rowids, like this does
+		db := s.dbaccess.(*sqliteDBAccess).db
+		_, err := db.Exec("UPDATE state SET rowid = -rowid WHERE key LIKE 'renumbered||%'")
+		assert.NoError(t, err)
+
+		assert.Equal(t, []string{"renumbered||2"}, search(t, s, SearchQuery{Query: "second"}))
+		assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "renumbered||1"}))
+		assert.Empty(t, search(t, s, SearchQuery{Query: "first"}))
+	})
+	s.Close()
+
+	t.Run("Tables linked by rowid are created again", func(t *testing.T) {
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("DROP TABLE state_fts; CREATE VIRTUAL TABLE state_fts USING fts5(content)")
+		db.Close()
+		assert.NoError(t, err)
+
+		s, err := initTestStore(t, map[string]string{
+			connectionStringKey: dbPath,
+			fullTextSearchKey:   "true",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{"orders||1"}, search(t, s, SearchQuery{Query: "shipped"}))
+	})
+
+	t.Run("Index configured fields", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{
+			connectionStringKey:     dbPath,
+			fullTextSearchKey:       "true",
+			fullTextSearchFieldsKey: "note",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, []string{"orders||1"}, search(t, s, SearchQuery{Query: "fragile"}))
+		assert.Empty(t, search(t, s, SearchQuery{Query: "shipped"}))
+	})
+
+	t.Run("Disabling removes the index", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{connectionStringKey: dbPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exists, err := tableExists(context.Background(), s.dbaccess.(*sqliteDBAccess).db, "state_fts")
+		assert.NoError(t, err)
+		assert.False(t, exists)
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "orders||3", Value: "value"}))
+	})
+}
+
+func TestPatch(t *testing.T) {
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey: filepath.Join(t.TempDir(), "patch.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	assert.NoError(t, s.Set(&state.SetRequest{Key: "doc", Value: map[string]any{"name": "order", "status": "pending", "items": []string{"a"}}}))
+
+	t.Run("Merge patch", func(t *testing.T) {
+		before, _ := getItem(t, s, "doc")
+		err := s.Patch(ctx, &PatchRequest{Key: "doc", Patch: []byte(`{"status":"shipped","name":null}`)})
+		assert.NoError(t, err)
+
+		res, _ := getItem(t, s, "doc")
+		assert.JSONEq(t, `{"status":"shipped","items":["a"]}`, string(res.Data))
+		assert.NotEqual(t, *before.ETag, *res.ETag)
+	})
+
+	t.Run("JSON patch", func(t *testing.T) {
+		err := s.Patch(ctx, &PatchRequest{
+			Key:   "doc",
+			Type:  PatchTypeJSON,
+			Patch: []byte(`[{"op":"add","path":"/items/-","value":"b"},{"op":"test","path":"/status","value":"shipped"}]`),
+		})
+		assert.NoError(t, err)
+		res, _ := getItem(t, s, "doc")
+		assert.JSONEq(t, `{"status":"shipped","items":["a","b"]}`, string(res.Data))
+
+		// A failed test operation aborts the patch
+		err = s.Patch(ctx, &PatchRequest{
+			Key:   "doc",
+			Type:  PatchTypeJSON,
+			Patch: []byte(`[{"op":"test","path":"/status","value":"pending"},{"op":"remove","path":"/items"}]`),
+		})
+		assert.Error(t, err)
+		res, _ = getItem(t, s, "doc")
+		assert.JSONEq(t, `{"status":"shipped","items":["a","b"]}`, string(res.Data))
+	})
+
+	t.Run("ETags are honored", func(t *testing.T) {
+		res, _ := getItem(t, s, "doc")
+		wrongETag := "wrong"
+		err := s.Patch(ctx, &PatchRequest{Key: "doc", Patch: []byte(`{"status":"lost"}`), ETag: &wrongETag})
+		var etagErr *state.ETagError
+		assert.ErrorAs(t, err, &etagErr)
+
+		err = s.Patch(ctx, &PatchRequest{
+			Key:     "doc",
+			Patch:   []byte(`{"status":"delivered"}`),
+			ETag:    res.ETag,
+			Options: state.SetStateOption{Concurrency: state.FirstWrite},
+		})
+		assert.NoError(t, err)
+		res, _ = getItem(t, s, "doc")
+		assert.JSONEq(t, `{"status":"delivered","items":["a","b"]}`, string(res.Data))
+	})
+
+	t.Run("Patch in a transaction", func(t *testing.T) {
+		err := s.Multi(&state.TransactionalStateRequest{
+			Operations: []state.TransactionalStateOperation{
+				{Operation: state.Upsert, Request: state.SetRequest{Key: "multi", Value: map[string]int{"count": 1}}},
+				{Operation: OperationPatch, Request: PatchRequest{Key: "multi", Patch: []byte(`{"count":2}`)}},
+			},
+		})
+		assert.NoError(t, err)
+		res, _ := getItem(t, s, "multi")
+		assert.JSONEq(t, `{"count":2}`, string(res.Data))
+
+		// A failed patch rolls back the transaction
+		err = s.Multi(&state.TransactionalStateRequest{
+			Operations: []state.TransactionalStateOperation{
+				{Operation: state.Upsert, Request: state.SetRequest{Key: "multi", Value: map[string]int{"count": 3}}},
+				{Operation: OperationPatch, Request: PatchRequest{Key: "missing", Patch: []byte(`{"count":4}`)}},
+			},
+		})
+		assert.Error(t, err)
+		res, _ = getItem(t, s, "multi")
+		assert.JSONEq(t, `{"count":2}`, string(res.Data))
+	})
+
+	t.Run("Invalid patches", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "binary", Value: []byte{1, 2}}))
+		assert.Error(t, s.Patch(ctx, &PatchRequest{Key: "binary", Patch: []byte(`{}`)}))
+		assert.Error(t, s.Patch(ctx, &PatchRequest{Key: "doc", Patch: []byte(`not json`)}))
+		assert.Error(t, s.Patch(ctx, &PatchRequest{Key: "doc", Type: "other", Patch: []byte(`{}`)}))
+		assert.Error(t, s.Patch(ctx, &PatchRequest{Key: "doc"}))
+	})
+}
+
+func TestIncrement(t *testing.T) {
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey: filepath.Join(t.TempDir(), "increment.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	t.Run("Increment a number", func(t *testing.T) {
+		v, err := s.Increment(ctx, &IncrementRequest{Key: "counter", Delta: 1, Initial: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, 11.0, v)
+
+		before, _ := getItem(t, s, "counter")
+		v, err = s.Increment(ctx, &IncrementRequest{Key: "counter", Delta: 5})
+		assert.NoError(t, err)
+		assert.Equal(t, 16.0, v)
+		v, err = s.Increment(ctx, &IncrementRequest{Key: "counter", Delta: -0.5})
+		assert.NoError(t, err)
+		assert.Equal(t, 15.5, v)
+
+		res, _ := getItem(t, s, "counter")
+		assert.Equal(t, "15.5", string(res.Data))
+		assert.NotEqual(t, *before.ETag, *res.ETag)
+	})
+
+	t.Run("Increment a JSON field", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "doc", Value: map[string]any{"name": "page", "stats": map[string]int{"views": 3}}}))
+
+		v, err := s.Increment(ctx, &IncrementRequest{Key: "doc", Field: "stats.views", Delta: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, 5.0, v)
+		v, err = s.Increment(ctx, &IncrementRequest{Key: "doc", Field: "$.stats.likes", Delta: 1, Initial: 100})
+		assert.NoError(t, err)
+		assert.Equal(t, 101.0, v)
+
+		res, _ := getItem(t, s, "doc")
+		assert.JSONEq(t, `{"name":"page","stats":{"views":5,"likes":101}}`, string(res.Data))
+
+		// Missing keys start from an empty object
+		v, err = s.Increment(ctx, &IncrementRequest{Key: "newdoc", Field: "count", Delta: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, 1.0, v)
+		res, _ = getItem(t, s, "newdoc")
+		assert.JSONEq(t, `{"count":1}`, string(res.Data))
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		_, err := s.Increment(ctx, &IncrementRequest{Key: "ttl", Delta: 1, Metadata: map[string]string{"ttlInSeconds": "1000"}})
+		assert.NoError(t, err)
+		_, _, expiration := getTimesForRow(t, s, "ttl")
+		assert.True(t, expiration.Valid)
+
+		// Without ttlInSeconds, the expiration is kept
+		_, err = s.Increment(ctx, &IncrementRequest{Key: "ttl", Delta: 1})
+		assert.NoError(t, err)
+		_, _, after := getTimesForRow(t, s, "ttl")
+		assert.Equal(t, expiration, after)
+
+		_, err = s.Increment(ctx, &IncrementRequest{Key: "ttl", Delta: 1, Metadata: map[string]string{"ttlInSeconds": "-1"}})
+		assert.NoError(t, err)
+		_, _, after = getTimesForRow(t, s, "ttl")
+		assert.False(t, after.Valid)
+	})
+
+	t.Run("ETags are honored", func(t *testing.T) {
+		res, _ := getItem(t, s, "counter")
+		wrongETag := "wrong"
+		_, err := s.Increment(ctx, &IncrementRequest{Key: "counter", Delta: 1, ETag: &wrongETag})
+		var etagErr *state.ETagError
+		assert.ErrorAs(t, err, &etagErr)
+		_, err = s.Increment(ctx, &IncrementRequest{Key: "missing", Delta: 1, ETag: &wrongETag})
+		assert.ErrorAs(t, err, &etagErr)
+
+		v, err := s.Increment(ctx, &IncrementRequest{
+			Key:     "counter",
+			Delta:   1,
+			ETag:    res.ETag,
+			Options: state.SetStateOption{Concurrency: state.FirstWrite},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 16.5, v)
+	})
+
+	t.Run("Increment in a transaction", func(t *testing.T) {
+		err := s.Multi(&state.TransactionalStateRequest{
+			Operations: []state.TransactionalStateOperation{
+				{Operation: state.Upsert, Request: state.SetRequest{Key: "multi", Value: 1}},
+				{Operation: OperationIncrement, Request: IncrementRequest{Key: "multi", Delta: 2}},
+				{Operation: OperationIncrement, Request: IncrementRequest{Key: "multi", Delta: 3}},
+			},
+		})
+		assert.NoError(t, err)
+		res, _ := getItem(t, s, "multi")
+		assert.Equal(t, "6", string(res.Data))
+
+		// A failed increment rolls back the transaction
+		err = s.Multi(&state.TransactionalStateRequest{
+			Operations: []state.TransactionalStateOperation{
+				{Operation: OperationIncrement, Request: IncrementRequest{Key: "multi", Delta: 1}},
+				{Operation: OperationIncrement, Request: IncrementRequest{Key: "doc", Delta: 1}},
+			},
+		})
+		assert.Error(t, err)
+		res, _ = getItem(t, s, "multi")
+		assert.Equal(t, "6", string(res.Data))
+	})
+
+	t.Run("Invalid increments", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "binary", Value: []byte{1, 2}}))
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "text", Value: "hello"}))
+
+		_, err := s.Increment(ctx, &IncrementRequest{Key: "binary", Delta: 1})
+		assert.Error(t, err)
+		_, err = s.Increment(ctx, &IncrementRequest{Key: "text", Delta: 1})
+		assert.Error(t, err)
+		_, err = s.Increment(ctx, &IncrementRequest{Key: "doc", Field: "name", Delta: 1})
+		assert.Error(t, err)
+		_, err = s.Increment(ctx, &IncrementRequest{Key: "counter", Field: "count", Delta: 1})
+		assert.Error(t, err)
+		_, err = s.Increment(ctx, &IncrementRequest{Key: "doc", Field: "stats['views']", Delta: 1})
+		assert.Error(t, err)
+		_, err = s.Increment(ctx, &IncrementRequest{Delta: 1})
+		assert.Error(t, err)
+
+		res, _ := getItem(t, s, "doc")
+		assert.JSONEq(t, `{"name":"page","stats":{"views":5,"likes":101}}`, string(res.Data))
+	})
+
+	t.Run("Integers are incremented exactly", func(t *testing.T) {
+		// 2^53+1 can't be represented as a float64
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "big", Value: json.RawMessage("9007199254740993")}))
+		_, err := s.Increment(ctx, &IncrementRequest{Key: "big", Delta: 2})
+		assert.NoError(t, err)
+		res, _ := getItem(t, s, "big")
+		assert.Equal(t, "9007199254740995", string(res.Data))
+
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "bigdoc", Value: json.RawMessage(`{"n":9007199254740993}`)}))
+		_, err = s.Increment(ctx, &IncrementRequest{Key: "bigdoc", Field: "n", Delta: -2})
+		assert.NoError(t, err)
+		res, _ = getItem(t, s, "bigdoc")
+		assert.Equal(t, `{"n":9007199254740991}`, string(res.Data))
+
+		// A real delta switches to floating point
+		_, err = s.Increment(ctx, &IncrementRequest{Key: "big", Delta: 0.5})
+		assert.NoError(t, err)
+		res, _ = getItem(t, s, "big")
+		assert.NotContains(t, string(res.Data), "9007199254740995")
+
+		// Overflows are errors and leave the value unchanged
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "max", Value: json.RawMessage("9223372036854775807")}))
+		_, err = s.Increment(ctx, &IncrementRequest{Key: "max", Delta: 1})
+		assert.ErrorContains(t, err, "out of range")
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "mindoc", Value: json.RawMessage(`{"n":-9223372036854775808}`)}))
+		_, err = s.Increment(ctx, &IncrementRequest{Key: "mindoc", Field: "n", Delta: -1})
+		assert.ErrorContains(t, err, "out of range")
+
+		res, _ = getItem(t, s, "max")
+		assert.Equal(t, "9223372036854775807", string(res.Data))
+		res, _ = getItem(t, s, "mindoc")
+		assert.Equal(t, `{"n":-9223372036854775808}`, string(res.Data))
+	})
+}
+
+func TestPersistedMetadata(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "metadata.db")
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey:    dbPath,
+		persistMetadataKeysKey: "owner, source",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	t.Run("Content type and allow-listed metadata are returned", func(t *testing.T) {
+		err := s.Set(&state.SetRequest{
+			Key:   "image",
+			Value: []byte{0x89, 0x50, 0x4e, 0x47},
+			Metadata: map[string]string{
+				"contentType": "image/png",
+				"owner":       "alice",
+				"other":       "not persisted",
+			},
+		})
+		assert.NoError(t, err)
+
+		res, err := s.Get(&state.GetRequest{Key: "image", Metadata: map[string]string{"partitionKey": "p1"}})
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x89, 0x50, 0x4e, 0x47}, res.Data)
+		if assert.NotNil(t, res.ContentType) {
+			assert.Equal(t, "image/png", *res.ContentType)
+		}
+		assert.Equal(t, map[string]string{"contentType": "image/png", "owner": "alice", "partitionKey": "p1"}, res.Metadata)
+	})
+
+	t.Run("Metadata is replaced by Set", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "image", Value: "text"}))
+		res, err := s.Get(&state.GetRequest{Key: "image"})
+		assert.NoError(t, err)
+		assert.Nil(t, res.ContentType)
+		assert.Empty(t, res.Metadata)
+	})
+
+	t.Run("Metadata is kept by increments", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "counter", Value: 1, Metadata: map[string]string{"source": "import"}}))
+		_, err := s.Increment(ctx, &IncrementRequest{Key: "counter", Delta: 1})
+		assert.NoError(t, err)
+		res, err := s.Get(&state.GetRequest{Key: "counter"})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"source": "import"}, res.Metadata)
+	})
+
+	t.Run("ttlInSeconds can't be persisted", func(t *testing.T) {
+		_, err := parsePersistMetadataKeys(state.Metadata{
+			Base: metadata.Base{Properties: map[string]string{persistMetadataKeysKey: "owner,ttlInSeconds"}},
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("Tables without the metadata column are migrated", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "old.db")
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(fmt.Sprintf(createTableTpl, defaultTableName))
+		assert.NoError(t, err)
+		_, err = db.Exec("INSERT INTO state (key, value, is_binary, etag) VALUES ('old', '1', false, 'e1')")
+		assert.NoError(t, err)
+		db.Close()
+
+		// In read-only mode, the table can't be altered but it can be read
+		ro, err := initTestStore(t, map[string]string{connectionStringKey: path, readOnlyKey: "true"})
+		if assert.NoError(t, err) {
+			res, err := ro.Get(&state.GetRequest{Key: "old"})
+			assert.NoError(t, err)
+			assert.Equal(t, "1", string(res.Data))
+			ro.Close()
+		}
+
+		rw, err := initTestStore(t, map[string]string{connectionStringKey: path})
+		if assert.NoError(t, err) {
+			assert.NoError(t, rw.Set(&state.SetRequest{Key: "old", Value: 2, Metadata: map[string]string{"contentType": "application/json"}}))
+			res, err := rw.Get(&state.GetRequest{Key: "old"})
+			assert.NoError(t, err)
+			if assert.NotNil(t, res.ContentType) {
+				assert.Equal(t, "application/json", *res.ContentType)
+			}
+		}
+	})
+}
+
+func TestSlidingTTL(t *testing.T) {
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey:  filepath.Join(t.TempDir(), "sliding.db"),
+		slidingTTLRefreshKey: "0.5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dba := s.dbaccess.(*sqliteDBAccess)
+
+	// Moves the expiration of a key, as if it was written some time ago
+	setExpiresIn := func(t *testing.T, key string, d time.Duration) {
+		_, err := dba.db.Exec("UPDATE state SET expiration_time = DATETIME(?, 'unixepoch') WHERE key = ?", time.Now().Add(d).Unix(), key)
+		assert.NoError(t, err)
+	}
+
+	t.Run("Reads renew the expiration after a fraction of the window", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "session", Value: "data", Metadata: map[string]string{"slidingTTL": "100"}}))
+		assert.InDelta(t, 100, expiresIn(t, s, "session").Seconds(), 2)
+		before, _ := getItem(t, s, "session")
+
+		// Less than half of the window passed
+		setExpiresIn(t, "session", 70*time.Second)
+		getItem(t, s, "session")
+		assert.InDelta(t, 70, expiresIn(t, s, "session").Seconds(), 2)
+
+		// More than half of the window passed
+		setExpiresIn(t, "session", 40*time.Second)
+		res, _ := getItem(t, s, "session")
+		assert.Equal(t, "\"data\"", string(res.Data))
+		assert.InDelta(t, 100, expiresIn(t, s, "session").Seconds(), 2)
+
+		// Renewing the expiration doesn't change the ETag
+		assert.Equal(t, *before.ETag, *res.ETag)
+	})
+
+	t.Run("Increments keep the sliding TTL", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "counter", Value: 1, Metadata: map[string]string{"slidingTTL": "100"}}))
+		_, err := s.Increment(context.Background(), &IncrementRequest{Key: "counter", Delta: 1})
+		assert.NoError(t, err)
+
+		setExpiresIn(t, "counter", 10*time.Second)
+		getItem(t, s, "counter")
+		assert.InDelta(t, 100, expiresIn(t, s, "counter").Seconds(), 2)
+	})
+
+	t.Run("Set without slidingTTL removes it", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "session", Value: "data", Metadata: map[string]string{"ttlInSeconds": "100"}}))
+		setExpiresIn(t, "session", 10*time.Second)
+		getItem(t, s, "session")
+		assert.InDelta(t, 10, expiresIn(t, s, "session").Seconds(), 2)
+	})
+
+	t.Run("Invalid sliding TTLs", func(t *testing.T) {
+		assert.Error(t, s.Set(&state.SetRequest{Key: "invalid", Value: "data", Metadata: map[string]string{"slidingTTL": "0"}}))
+		assert.Error(t, s.Set(&state.SetRequest{Key: "invalid", Value: "data", Metadata: map[string]string{"slidingTTL": "1m"}}))
+		assert.Error(t, s.Set(&state.SetRequest{Key: "invalid", Value: "data", Metadata: map[string]string{"slidingTTL": "10", "ttlInSeconds": "10"}}))
+
+		for _, v := range []string{"-0.1", "1.5", "half"} {
+			_, err := parseSlidingTTLRefresh(state.Metadata{Base: metadata.Base{Properties: map[string]string{slidingTTLRefreshKey: v}}})
+			assert.Error(t, err, v)
+		}
+	})
+}
+
+func TestExpirationLimits(t *testing.T) {
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey: filepath.Join(t.TempDir(), "expiration.db"),
+		defaultTTLKey:       "100",
+		maxTTLKey:           "1000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		expected float64
+	}{
+		{name: "Default TTL", metadata: nil, expected: 100},
+		{name: "TTL", metadata: map[string]string{"ttlInSeconds": "500"}, expected: 500},
+		{name: "TTL above the maximum", metadata: map[string]string{"ttlInSeconds": "5000"}, expected: 1000},
+		{name: "No expiration", metadata: map[string]string{"ttlInSeconds": "-1"}, expected: 1000},
+		{name: "Absolute expiration", metadata: map[string]string{"ttlExpireTime": time.Now().Add(300 * time.Second).Format(time.RFC3339)}, expected: 300},
+		{name: "Absolute expiration as epoch", metadata: map[string]string{"ttlExpireTime": strconv.FormatInt(time.Now().Add(200*time.Second).Unix(), 10)}, expected: 200},
+		{name: "Absolute expiration above the maximum", metadata: map[string]string{"ttlExpireTime": time.Now().Add(time.Hour).Format(time.RFC3339)}, expected: 1000},
+		{name: "Sliding TTL above the maximum", metadata: map[string]string{"slidingTTL": "5000"}, expected: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := randomKey()
+			assert.NoError(t, s.Set(&state.SetRequest{Key: key, Value: "v", Metadata: tt.metadata}))
+			assert.InDelta(t, tt.expected, expiresIn(t, s, key).Seconds(), 2)
+		})
+	}
+
+	t.Run("Invalid absolute expirations", func(t *testing.T) {
+		for _, md := range []map[string]string{
+			{"ttlExpireTime": time.Now().Add(-time.Minute).Format(time.RFC3339)},
+			{"ttlExpireTime": "tomorrow"},
+			{"ttlExpireTime": time.Now().Add(time.Minute).Format(time.RFC3339), "ttlInSeconds": "10"},
+		} {
+			assert.Error(t, s.Set(&state.SetRequest{Key: "invalid", Value: "v", Metadata: md}), md)
+		}
+	})
+
+	t.Run("Invalid limits", func(t *testing.T) {
+		for _, props := range []map[string]string{
+			{defaultTTLKey: "0"},
+			{maxTTLKey: "1h"},
+			{defaultTTLKey: "100", maxTTLKey: "10"},
+		} {
+			_, err := parseTTLLimits(state.Metadata{Base: metadata.Base{Properties: props}})
+			assert.Error(t, err, props)
+		}
+	})
+}
+
+func TestTTLPolicies(t *testing.T) {
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey: filepath.Join(t.TempDir(), "policies.db"),
+		defaultTTLKey:       "100",
+		ttlPoliciesKey: `[
+			{"pattern": "session||", "defaultTTL": "30m"},
+			{"pattern": "cache-*-v?", "defaultTTL": "60s", "maxAge": "1h"},
+			{"pattern": "reminders[1]", "maxAge": "24h"},
+			{"pattern": "*", "maxAge": "48h"}
+		]`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dba := s.dbaccess.(*sqliteDBAccess)
+
+	t.Run("Default TTL of the first matching policy", func(t *testing.T) {
+		tests := map[string]float64{
+			"session||abc":   1800,
+			"cache-users-v2": 60,
+			"cache-users":    100,
+			"reminders[1]":   100,
+			"other":          100,
+		}
+		for key, expected := range tests {
+			assert.NoError(t, s.Set(&state.SetRequest{Key: key, Value: "v"}))
+			assert.InDelta(t, expected, expiresIn(t, s, key).Seconds(), 2, key)
+		}
+
+		// An explicit TTL takes precedence
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "session||ttl", Value: "v", Metadata: map[string]string{"ttlInSeconds": "10"}}))
+		assert.InDelta(t, 10, expiresIn(t, s, "session||ttl").Seconds(), 2)
+	})
+
+	t.Run("Cleanup removes rows older than the maximum age", func(t *testing.T) {
+		created := map[string]time.Duration{
+			"cache-a-v1":    2 * time.Hour,
+			"cache-b-v1":    10 * time.Minute,
+			"reminders[1]1": 30 * time.Hour,
+			"reminders[1]2": 20 * time.Hour,
+			"session||old":  72 * time.Hour,
+			"misc-old":      72 * time.Hour,
+			"misc-new":      time.Hour,
+		}
+		for key, age := range created {
+			assert.NoError(t, s.Set(&state.SetRequest{Key: key, Value: "v", Metadata: map[string]string{"ttlInSeconds": "-1"}}))
+			_, err := dba.db.Exec("UPDATE state SET creation_time = DATETIME(?, 'unixepoch') WHERE key = ?", time.Now().Add(-age).Unix(), key)
+			assert.NoError(t, err)
+		}
+
+		_, err := dba.deleteExpired(context.Background(), time.Time{})
+		assert.NoError(t, err)
+
+		// Session keys match the first policy, which has no maximum age
+		for _, key := range []string{"cache-b-v1", "reminders[1]2", "session||old", "misc-new"} {
+			res, _ := getItem(t, s, key)
+			assert.NotNil(t, res.Data, key)
+		}
+		for _, key := range []string{"cache-a-v1", "reminders[1]1", "misc-old"} {
+			res, _ := getItem(t, s, key)
+			assert.Nil(t, res.Data, key)
+		}
+	})
+
+	t.Run("Invalid policies", func(t *testing.T) {
+		for _, v := range []string{
+			`{"pattern": "a"}`,
+			`[{"defaultTTL": "1m"}]`,
+			`[{"pattern": "a"}]`,
+			`[{"pattern": "a", "defaultTTL": "1"}]`,
+			`[{"pattern": "a", "maxAge": "-1h"}]`,
+		} {
+			_, err := parseTTLPolicies(state.Metadata{Base: metadata.Base{Properties: map[string]string{ttlPoliciesKey: v}}})
+			assert.Error(t, err, v)
+		}
+	})
+}
+
+func TestExpirationNotifications(t *testing.T) {
+	// Each test has its own database, so keys that are still being delivered when a test ends don't affect the next one
+	open := func(t *testing.T, dbPath string) (*SQLiteStore, *sqliteDBAccess) {
+		s, err := initTestStore(t, map[string]string{
+			connectionStringKey:        dbPath,
+			cleanupIntervalKey:         "0",
+			expirationNotificationsKey: "true",
+			persistMetadataKeysKey:     "owner",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, s.dbaccess.(*sqliteDBAccess)
+	}
+	receive := func(t *testing.T, ch chan ExpiredKey) ExpiredKey {
+		select {
+		case k := <-ch:
+			return k
+		case <-time.After(2 * expirationRetryInterval):
+			t.Fatal("timed out waiting for an expired key")
+			return ExpiredKey{}
+		}
+	}
+
+	t.Run("Expired keys are delivered with their last value", func(t *testing.T) {
+		s, dba := open(t, filepath.Join(t.TempDir(), "expired.db"))
+
+		ch := make(chan ExpiredKey, 10)
+		assert.NoError(t, s.OnExpiration(func(ctx context.Context, key ExpiredKey) error {
+			ch <- key
+			return nil
+		}))
+
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "json", Value: map[string]string{"a": "b"}, Metadata: map[string]string{"ttlInSeconds": "60", "contentType": "application/json", "owner": "me"}}))
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "binary", Value: []byte{1, 2, 3}, Metadata: map[string]string{"ttlInSeconds": "120"}}))
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "forever", Value: "v"}))
+
+		cleaned, err := dba.deleteExpired(context.Background(), time.Now().Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), cleaned)
+		dba.expirations.notify()
+
+		k := receive(t, ch)
+		assert.Equal(t, "json", k.Key)
+		assert.JSONEq(t, `{"a":"b"}`, string(k.Value))
+		assert.Equal(t, map[string]string{"contentType": "application/json", "owner": "me"}, k.Metadata)
+		assert.InDelta(t, time.Now().Add(time.Minute).Unix(), k.ExpirationTime.Unix(), 2)
+
+		k = receive(t, ch)
+		assert.Equal(t, "binary", k.Key)
+		assert.Equal(t, []byte{1, 2, 3}, k.Value)
+
+		// Delivered keys are removed
+		assert.Eventually(t, func() bool {
+			keys, err := dba.readExpired(context.Background(), 10)
+			return err == nil && len(keys) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Keys are delivered again if the handler fails", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "expired.db")
+		s, dba := open(t, dbPath)
+
+		var attempts int
+		ch := make(chan ExpiredKey, 10)
+		assert.NoError(t, s.OnExpiration(func(ctx context.Context, key ExpiredKey) error {
+			attempts++
+			if attempts == 1 {
+				return errors.New("failed")
+			}
+			ch <- key
+			return nil
+		}))
+
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "retried", Value: "v", Metadata: map[string]string{"ttlInSeconds": "60"}}))
+		_, err := dba.deleteExpired(context.Background(), time.Now().Add(time.Hour))
+		assert.NoError(t, err)
+		dba.expirations.notify()
+
+		// The key is delivered again on the next attempt
+		k := receive(t, ch)
+		assert.Equal(t, "retried", k.Key)
+		assert.Equal(t, 2, attempts)
+
+		// Closing the store waits for the delivered key to be removed, so it's not delivered again after a restart
+		assert.NoError(t, s.Close())
+		s, dba = open(t, dbPath)
+		keys, err := dba.readExpired(context.Background(), 10)
+		assert.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+
+	t.Run("Undelivered keys survive a restart", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "expired.db")
+		s, dba := open(t, dbPath)
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "pending", Value: "v", Metadata: map[string]string{"ttlInSeconds": "60"}}))
+		_, err := dba.deleteExpired(context.Background(), time.Now().Add(time.Hour))
+		assert.NoError(t, err)
+		assert.NoError(t, s.Close())
+
+		s, _ = open(t, dbPath)
+		ch := make(chan ExpiredKey, 10)
+		assert.NoError(t, s.OnExpiration(func(ctx context.Context, key ExpiredKey) error {
+			ch <- key
+			return nil
+		}))
+		assert.Equal(t, "pending", receive(t, ch).Key)
+	})
+
+	t.Run("Notifications must be enabled", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{
+			connectionStringKey: filepath.Join(t.TempDir(), "disabled.db"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Error(t, s.OnExpiration(func(ctx context.Context, key ExpiredKey) error { return nil }))
+	})
+}
+
+func TestCacheMode(t *testing.T) {
+	open := func(t *testing.T, props map[string]string) *SQLiteStore {
+		props[connectionStringKey] = filepath.Join(t.TempDir(), "cache.db")
+		s, err := initTestStore(t, props)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	cacheStats := func(t *testing.T, s *SQLiteStore) CacheStats {
+		stats, err := s.CacheStats(context.Background())
+		assert.NoError(t, err)
+		if !assert.Len(t, stats, 1) {
+			t.FailNow()
+		}
+		return stats[0]
+	}
+
+	t.Run("Least recently used rows are evicted", func(t *testing.T) {
+		s := open(t, map[string]string{cacheMaxRowsKey: "3"})
+
+		for _, key := range []string{"a", "b", "c"} {
+			assert.NoError(t, s.Set(&state.SetRequest{Key: key, Value: "v"}))
+		}
+		res, _ := getItem(t, s, "a")
+		assert.NotNil(t, res.Data)
+
+		// "b" is the least recently used key, since "a" was read after it was written
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "d", Value: "v"}))
+		for _, key := range []string{"a", "c", "d"} {
+			res, _ := getItem(t, s, key)
+			assert.NotNil(t, res.Data, key)
+		}
+		res, _ = getItem(t, s, "b")
+		assert.Nil(t, res.Data)
+
+		stats := cacheStats(t, s)
+		assert.Equal(t, int64(3), stats.Rows)
+		assert.Equal(t, int64(3), stats.MaxRows)
+		assert.Equal(t, int64(1), stats.EvictedRows)
+		assert.Equal(t, int64(len("b")+len(`"v"`)), stats.EvictedBytes)
+
+		// Updates and deletes keep the size up to date
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "a", Value: "value"}))
+		assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "c"}))
+		stats = cacheStats(t, s)
+		assert.Equal(t, int64(2), stats.Rows)
+		assert.Equal(t, int64(len("a")+len(`"value"`)+len("d")+len(`"v"`)), stats.Bytes)
+	})
+
+	t.Run("Rows are evicted when the table exceeds the maximum size", func(t *testing.T) {
+		s := open(t, map[string]string{cacheMaxBytesKey: "100"})
+
+		for i := 0; i < 20; i++ {
+			err := s.Multi(&state.TransactionalStateRequest{
+				Operations: []state.TransactionalStateOperation{
+					{Operation: state.Upsert, Request: state.SetRequest{Key: fmt.Sprintf("key%02d", i), Value: "0123456789"}},
+				},
+			})
+			assert.NoError(t, err)
+		}
+
+		stats := cacheStats(t, s)
+		assert.LessOrEqual(t, stats.Bytes, int64(100))
+		assert.Equal(t, int64(20), stats.Rows+stats.EvictedRows)
+		res, _ := getItem(t, s, "key19")
+		assert.NotNil(t, res.Data)
+		res, _ = getItem(t, s, "key00")
+		assert.Nil(t, res.Data)
+	})
+
+	t.Run("Rows are evicted in the background", func(t *testing.T) {
+		s := open(t, map[string]string{cacheMaxRowsKey: "2", cacheEvictionIntervalKey: "50ms"})
+
+		for _, key := range []string{"a", "b", "c", "d"} {
+			assert.NoError(t, s.Set(&state.SetRequest{Key: key, Value: "v"}))
+		}
+		assert.Eventually(t, func() bool {
+			return cacheStats(t, s).Rows == 2
+		}, 5*time.Second, 20*time.Millisecond)
+		res, _ := getItem(t, s, "d")
+		assert.NotNil(t, res.Data)
+	})
+
+	t.Run("Stats require cache mode", func(t *testing.T) {
+		s := open(t, map[string]string{})
+
+		_, err := s.CacheStats(context.Background())
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid settings", func(t *testing.T) {
+		for _, props := range []map[string]string{
+			{cacheMaxRowsKey: "0"},
+			{cacheMaxBytesKey: "1KB"},
+			{cacheEvictionIntervalKey: "1m"},
+			{cacheMaxRowsKey: "10", cacheEvictionIntervalKey: "soon"},
+		} {
+			_, err := parseEvictionSettings(state.Metadata{Base: metadata.Base{Properties: props}})
+			assert.Error(t, err, props)
+		}
+	})
+}
+
+func TestReadCache(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "readcache.db")
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey:    dbPath,
+		readCacheMaxEntriesKey: "3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := s.dbaccess.(*sqliteDBAccess).readCache
+
+	t.Run("Reads are served from the cache", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "a", Value: "v1"}))
+		res, _ := getItem(t, s, "a")
+		assert.Equal(t, `"v1"`, string(res.Data))
+		assert.Contains(t, cache.entries, "a")
+
+		// A row that is only in the cache proves it's used
+		cache.put("cached-only", currentValue{value: []byte(`"cached"`), etag: "1"}, cache.dataVersion)
+		res, _ = getItem(t, s, "cached-only")
+		assert.Equal(t, `"cached"`, string(res.Data))
+
+		// Responses don't share memory with the cache
+		res.Data[1] = 'X'
+		res, _ = getItem(t, s, "cached-only")
+		assert.Equal(t, `"cached"`, string(res.Data))
+	})
+
+	t.Run("Writes invalidate the cache", func(t *testing.T) {
+		getItem(t, s, "a")
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "a", Value: "v2"}))
+		res, _ := getItem(t, s, "a")
+		assert.Equal(t, `"v2"`, string(res.Data))
+
+		err := s.Multi(&state.TransactionalStateRequest{
+			Operations: []state.TransactionalStateOperation{
+				{Operation: state.Upsert, Request: state.SetRequest{Key: "a", Value: "v3"}},
+			},
+		})
+		assert.NoError(t, err)
+		res, _ = getItem(t, s, "a")
+		assert.Equal(t, `"v3"`, string(res.Data))
+
+		assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "a"}))
+		res, _ = getItem(t, s, "a")
+		assert.Nil(t, res.Data)
+	})
+
+	t.Run("Writes keep the rows of other keys", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "kept", Value: "v1"}))
+		getItem(t, s, "kept")
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "other", Value: "v1"}))
+		assert.NoError(t, s.Delete(&state.DeleteRequest{Key: "other"}))
+		assert.Contains(t, cache.entries, "kept")
+
+		// A row that is only in the cache proves it's used
+		cache.put("kept-cached-only", currentValue{value: []byte(`"cached"`), etag: "1"}, cache.dataVersion)
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "other", Value: "v2"}))
+		res, _ := getItem(t, s, "kept-cached-only")
+		assert.Equal(t, `"cached"`, string(res.Data))
+	})
+
+	t.Run("Changes by other processes invalidate the cache", func(t *testing.T) {
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "b", Value: "v1"}))
+		getItem(t, s, "b")
+
+		other, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		_, err = other.Exec(`UPDATE state SET value = '"external"' WHERE key = 'b'`)
+		assert.NoError(t, err)
+
+		res, _ := getItem(t, s, "b")
+		assert.Equal(t, `"external"`, string(res.Data))
+	})
+
+	t.Run("Cache is bounded", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, s.Set(&state.SetRequest{Key: fmt.Sprintf("bounded%d", i), Value: "v"}))
+		}
+		for i := 0; i < 5; i++ {
+			getItem(t, s, fmt.Sprintf("bounded%d", i))
+		}
+		assert.Len(t, cache.entries, 3)
+		assert.Equal(t, 3, cache.lru.Len())
+		assert.Contains(t, cache.entries, "bounded4")
+		assert.NotContains(t, cache.entries, "bounded0")
+
+		c := &readCache{maxBytes: 2 * readCacheEntryOverhead, entries: map[string]*list.Element{}, lru: list.New()}
+		c.put("a", currentValue{value: []byte("1")}, 0)
+		c.put("b", currentValue{value: []byte("2")}, 0)
+		c.put("c", currentValue{value: make([]byte, 3*readCacheEntryOverhead)}, 0)
+		assert.Len(t, c.entries, 1)
+		assert.Contains(t, c.entries, "b")
+		assert.LessOrEqual(t, c.bytes, c.maxBytes)
+	})
+}
+
+func TestGroupCommit(t *testing.T) {
+	s, err := initTestStore(t, map[string]string{
+		connectionStringKey:    filepath.Join(t.TempDir(), "groupcommit.db"),
+		groupCommitMaxDelayKey: "50ms",
+		groupCommitMaxBatchKey: "8",
+		// Accesses are buffered until rows are evicted in the background
+		cacheMaxRowsKey:          "1000",
+		cacheEvictionIntervalKey: "1h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dba := s.dbaccess.(*sqliteDBAccess)
+
+	assert.NoError(t, s.Set(&state.SetRequest{Key: "existing", Value: "v"}))
+	res, _ := getItem(t, s, "existing")
+	etag := *res.ETag
+
+	t.Run("Concurrent writes get their own result", func(t *testing.T) {
+		badETag := "bad"
+		errs := make([]error, 8)
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				switch i {
+				case 0:
+					// Fails because of the ETag
+					errs[i] = s.Set(&state.SetRequest{Key: "existing", Value: "changed", ETag: &badETag})
+				case 1:
+					// Fails as a whole, so its first operation is rolled back too
+					errs[i] = s.Multi(&state.TransactionalStateRequest{
+						Operations: []state.TransactionalStateOperation{
+							{Operation: state.Upsert, Request: state.SetRequest{Key: "multi", Value: "v"}},
+							{Operation: state.Delete, Request: state.DeleteRequest{Key: "existing", ETag: &badETag}},
+						},
+					})
+				case 2:
+					errs[i] = s.Delete(&state.DeleteRequest{Key: "existing", ETag: &etag})
+				default:
+					errs[i] = s.Set(&state.SetRequest{Key: fmt.Sprintf("key%d", i), Value: i})
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		var etagErr *state.ETagError
+		assert.ErrorAs(t, errs[0], &etagErr)
+		assert.ErrorAs(t, errs[1], &etagErr)
+		for i := 2; i < len(errs); i++ {
+			assert.NoError(t, errs[i], i)
+		}
+
+		res, _ := getItem(t, s, "multi")
+		assert.Nil(t, res.Data)
+		res, _ = getItem(t, s, "existing")
+		assert.Nil(t, res.Data)
+		for i := 3; i < len(errs); i++ {
+			res, _ := getItem(t, s, fmt.Sprintf("key%d", i))
+			assert.Equal(t, strconv.Itoa(i), string(res.Data))
+		}
+	})
+
+	t.Run("Cancelled writes are not committed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		for i := 0; i < 10; i++ {
+			err := dba.Set(ctx, &state.SetRequest{Key: "cancelled", Value: i})
+			assert.ErrorIs(t, err, context.Canceled)
+		}
+		res, _ := getItem(t, s, "cancelled")
+		assert.Nil(t, res.Data)
+	})
+
+	t.Run("Writes that are rolled back have no side effects", func(t *testing.T) {
+		accessed := func(key string) bool {
+			dba.lock.Lock()
+			defer dba.lock.Unlock()
+			_, ok := dba.eviction.accesses[key]
+			return ok
+		}
+
+		badETag := "bad"
+		err := s.Multi(&state.TransactionalStateRequest{
+			Operations: []state.TransactionalStateOperation{
+				{Operation: state.Upsert, Request: state.SetRequest{Key: "rolledback", Value: "v"}},
+				{Operation: state.Delete, Request: state.DeleteRequest{Key: "existing2", ETag: &badETag}},
+			},
+		})
+		var etagErr *state.ETagError
+		assert.ErrorAs(t, err, &etagErr)
+		assert.False(t, accessed("rolledback"))
+
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "committed", Value: "v"}))
+		assert.True(t, accessed("committed"))
+	})
+
+	t.Run("Writes are committed after the maximum delay", func(t *testing.T) {
+		start := time.Now()
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "alone", Value: "v"}))
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	})
+
+	t.Run("Invalid settings", func(t *testing.T) {
+		for _, props := range []map[string]string{
+			{groupCommitMaxDelayKey: "0"},
+			{groupCommitMaxBatchKey: "-1"},
+		} {
+			_, err := parseGroupCommit(state.Metadata{Base: metadata.Base{Properties: props}})
+			assert.Error(t, err, props)
+		}
+	})
+}
+
+func TestPreparedStatements(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "statements.db")
+
+	t.Run("Statements are prepared at Init and closed on Close", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{connectionStringKey: dbPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts := s.dbaccess.(*sqliteDBAccess).stmts
+		for _, stmt := range []*sql.Stmt{stmts.get, stmts.set, stmts.setWithETag, stmts.delete, stmts.deleteWithETag} {
+			assert.NotNil(t, stmt)
+		}
+
+		setItem(t, s, "key", "v1", nil)
+		res, _ := getItem(t, s, "key")
+		etag := *res.ETag
+		setItem(t, s, "key", "v2", &etag)
+		res, _ = getItem(t, s, "key")
+		assert.Equal(t, `"v2"`, string(res.Data))
+		deleteItem(t, s, "key", res.ETag)
+		assert.False(t, storeItemExists(t, s, "key"))
+
+		assert.NoError(t, s.Close())
+		_, err = stmts.get.Exec("key")
+		assert.Error(t, err)
+	})
+
+	t.Run("Only reads are prepared in read-only mode", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{
+			connectionStringKey: dbPath,
+			readOnlyKey:         "true",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts := s.dbaccess.(*sqliteDBAccess).stmts
+		assert.NotNil(t, stmts.get)
+		assert.Nil(t, stmts.set)
+		assert.Nil(t, stmts.delete)
+	})
+
+	t.Run("Updates with an ETag keep the expiration time when requested", func(t *testing.T) {
+		s, err := initTestStore(t, map[string]string{connectionStringKey: dbPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := s.dbaccess.(*sqliteDBAccess)
+
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "ttl", Value: "v1", Metadata: map[string]string{metadataTTLKey: "1000"}}))
+		res, _ := getItem(t, s, "ttl")
+		err = a.executeWrite(context.Background(), func(tx *sql.Tx) error {
+			r, err := prepareSetRequest(a, tx, &state.SetRequest{Key: "ttl", Value: "v2", ETag: res.ETag})
+			if err != nil {
+				return err
+			}
+			r.keepExpiration = true
+			return a.executeSetRequest(context.Background(), tx, r, &state.SetRequest{Key: "ttl", ETag: res.ETag}, writeContext{})
+		})
+		assert.NoError(t, err)
+		assert.Greater(t, expiresIn(t, s, "ttl"), 900*time.Second)
+
+		res, _ = getItem(t, s, "ttl")
+		assert.NoError(t, s.Set(&state.SetRequest{Key: "ttl", Value: "v3", ETag: res.ETag}))
+		_, _, expirationTime := getTimesForRow(t, s, "ttl")
+		assert.False(t, expirationTime.Valid)
+	})
+}
+
+// Returns a store for the benchmarks, which compare the statements prepared at Init with the same statements formatted and parsed for every operation.
+func newBenchmarkStore(b *testing.B) (*SQLiteStore, *sqliteDBAccess) {
+	s := NewSQLiteStateStore(logger.NewLogger("test")).(*SQLiteStore)
+	err := s.Init(state.Metadata{
+		Base: metadata.Base{
+			Properties: map[string]string{
+				connectionStringKey: filepath.Join(b.TempDir(), "benchmark.db"),
+			},
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		s.Close()
+	})
+	return s, s.dbaccess.(*sqliteDBAccess)
+}
+
+func BenchmarkGet(b *testing.B) {
+	s, a := newBenchmarkStore(b)
+	err := s.Set(&state.SetRequest{Key: "key", Value: "value"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+
+	b.Run("Store", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := s.Get(&state.GetRequest{Key: "key"})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	scan := func(b *testing.B, row *sql.Row) {
+		var cur currentValue
+		err := row.Scan(&cur.value, &cur.isBinary, &cur.etag, &cur.metadata, &cur.slidingTTL, &cur.expiration)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Run("Prepared", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			scan(b, a.stmts.get.QueryRowContext(ctx, "key"))
+		}
+	})
+	b.Run("Unprepared", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			scan(b, a.db.QueryRowContext(ctx, fmt.Sprintf(getValueTpl, a.tableName, a.valueColumns()), "key"))
+		}
+	})
+}
+
+func BenchmarkSet(b *testing.B) {
+	s, a := newBenchmarkStore(b)
+	ctx := context.Background()
+
+	b.Run("Store", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := s.Set(&state.SetRequest{Key: "key", Value: i})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	args := func(i int) []interface{} {
+		ts := time.Now().Unix()
+		return []interface{}{"key", strconv.Itoa(i), false, "etag", nil, nil, ts, nil, "key", ts}
+	}
+	b.Run("Prepared", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := a.executeWrite(ctx, func(tx *sql.Tx) error {
+				_, err := a.stmts.bind(ctx, tx, a.stmts.set).Exec(args(i)...)
+				return err
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Unprepared", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := a.executeWrite(ctx, func(tx *sql.Tx) error {
+				_, err := tx.Exec(fmt.Sprintf(setValueTpl, a.tableName), args(i)...)
+				return err
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Deletes a key that doesn't exist, so only the cost of the statement is measured.
+func BenchmarkDelete(b *testing.B) {
+	s, a := newBenchmarkStore(b)
+	ctx := context.Background()
+
+	b.Run("Store", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := s.Delete(&state.DeleteRequest{Key: "missing"})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Prepared", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := a.executeWrite(ctx, func(tx *sql.Tx) error {
+				_, err := a.stmts.bind(ctx, tx, a.stmts.delete).Exec("missing")
+				return err
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Unprepared", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := a.executeWrite(ctx, func(tx *sql.Tx) error {
+				_, err := tx.Exec(fmt.Sprintf(delValueTpl, a.tableName), "missing")
+				return err
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
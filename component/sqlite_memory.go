@@ -0,0 +1,241 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// Returns true if the metadata selects the in-memory mode.
+func parseMode(metadata state.Metadata) (bool, error) {
+	switch strings.ToLower(metadata.Properties[modeKey]) {
+	case "", modeFile:
+		return false, nil
+	case modeMemory:
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid %s: %s", modeKey, metadata.Properties[modeKey])
+	}
+}
+
+// Returns nil duration means never persist the in-memory database periodically.
+func parsePersistInterval(metadata state.Metadata) (*time.Duration, error) {
+	s, ok := metadata.Properties[persistIntervalKey]
+	if ok && s != "" {
+		persistIntervalInSec, err := strconv.ParseInt(s, 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("illegal %s value: %s", persistIntervalKey, s)
+		}
+
+		// Non-positive value from meta means persist on close only.
+		if persistIntervalInSec > 0 {
+			d := time.Duration(persistIntervalInSec) * time.Second
+			return &d, nil
+		}
+	} else {
+		d := defaultPersistIntervalInSec * time.Second
+		return &d, nil
+	}
+
+	return nil, nil
+}
+
+// Returns the connection string for a new shared-cache in-memory database.
+// Each instance of the component gets a database with a unique name.
+func memoryConnectionString() string {
+	return "file:" + uuid.New().String() + "?mode=memory&cache=shared"
+}
+
+// Sets up the in-memory database.
+// The in-memory database is deleted when its last connection is closed, so one connection is kept open until the component is closed.
+// If there's a persist file, its contents are loaded in the database.
+func (a *sqliteDBAccess) initMemoryMode(ctx context.Context) (err error) {
+	a.memConn, err = a.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	if a.persistFile == "" {
+		return nil
+	}
+
+	_, err = os.Stat(a.persistFile)
+	if errors.Is(err, os.ErrNotExist) {
+		a.logger.Infof("Persist file '%s' does not exist; starting with an empty database", a.persistFile)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read persist file: %w", err)
+	}
+
+	a.logger.Infof("Loading in-memory database from '%s'", a.persistFile)
+	err = a.memConn.Raw(func(driverConn any) error {
+		fileConn, err := openRawConn("file:" + a.persistFile + "?mode=ro")
+		if err != nil {
+			return err
+		}
+		defer fileConn.Close()
+
+		return backupDatabase(ctx, driverConn.(*sqlite3.SQLiteConn), fileConn)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load persist file: %w", err)
+	}
+	return nil
+}
+
+func (a *sqliteDBAccess) schedulePersist() {
+	if a.persistFile == "" || a.persistInterval == nil {
+		return
+	}
+
+	d := *a.persistInterval
+	a.logger.Infof("Schedule in-memory database persistence every %v", d)
+
+	ticker := time.NewTicker(d)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				err := a.persist()
+				if err != nil {
+					a.logger.Errorf("Error persisting in-memory database: %v", err)
+				}
+			case <-a.ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Writes a snapshot of the in-memory database to the persist file.
+// The snapshot is written to a temporary file first, which then replaces the persist file, so the persist file is always consistent.
+// Both the temporary file and the rename are synced to disk, so a power loss can't leave a persist file that is renamed but incomplete.
+func (a *sqliteDBAccess) persist() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	start := time.Now()
+	tmpFile := a.persistFile + ".tmp"
+	err := os.Remove(tmpFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = a.memConn.Raw(func(driverConn any) error {
+		fileConn, err := openRawConn(tmpFile)
+		if err != nil {
+			return err
+		}
+		defer fileConn.Close()
+
+		return backupDatabase(ctx, fileConn, driverConn.(*sqlite3.SQLiteConn))
+	})
+	if err != nil {
+		return err
+	}
+
+	err = syncFile(tmpFile)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile, a.persistFile)
+	if err != nil {
+		return err
+	}
+	err = syncDir(filepath.Dir(a.persistFile))
+	if err != nil {
+		return err
+	}
+
+	a.logger.Debugf("Persisted in-memory database to '%s' in %v", a.persistFile, time.Since(start))
+	return nil
+}
+
+// Flushes the entries of a directory, such as a renamed file, to disk.
+// Directories can't be opened to be synced on Windows, so this is skipped there.
+func syncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	return syncFile(path)
+}
+
+// Flushes a file to disk.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync '%s': %w", path, err)
+	}
+	return nil
+}
+
+// Opens a connection to a database outside of the connection pool.
+func openRawConn(dsn string) (*sqlite3.SQLiteConn, error) {
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*sqlite3.SQLiteConn), nil
+}
+
+// Copies the "main" database from src to dest using the SQLite backup API.
+func backupDatabase(ctx context.Context, dest *sqlite3.SQLiteConn, src *sqlite3.SQLiteConn) error {
+	bk, err := dest.Backup("main", src, "main")
+	if err != nil {
+		return err
+	}
+	defer bk.Close()
+
+	for {
+		// Step returns false with no error if either database is busy or locked, so wait and try again
+		done, err := bk.Step(-1)
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(defaultBusyRetryInterval):
+		}
+	}
+
+	return bk.Finish()
+}
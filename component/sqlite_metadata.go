@@ -0,0 +1,89 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// Returns the keys of the request metadata that are persisted with the values, besides contentType.
+func parsePersistMetadataKeys(metadata state.Metadata) ([]string, error) {
+	var keys []string
+	for _, k := range strings.Split(metadata.Properties[persistMetadataKeysKey], ",") {
+		k = strings.TrimSpace(k)
+		if k == "" || k == metadataContentTypeKey {
+			continue
+		}
+		if k == metadataTTLKey {
+			return nil, fmt.Errorf("illegal %s value: %s is never persisted", persistMetadataKeysKey, k)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Returns the metadata of a write that is persisted with the value, encoded as JSON, or nil if there's none.
+func (a *sqliteDBAccess) persistedMetadata(reqMetadata map[string]string) (*string, error) {
+	res := map[string]string{}
+	if v := reqMetadata[metadataContentTypeKey]; v != "" {
+		res[metadataContentTypeKey] = v
+	}
+	for _, k := range a.persistMetadataKeys {
+		if v, ok := reqMetadata[k]; ok {
+			res[k] = v
+		}
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+
+	enc, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	s := string(enc)
+	return &s, nil
+}
+
+// Adds the persisted metadata of a value to the response of a Get request.
+// The persisted values take precedence over the metadata of the request, which is echoed back.
+func setResponseMetadata(res *state.GetResponse, reqMetadata map[string]string, persisted sql.NullString) error {
+	res.Metadata = reqMetadata
+	if !persisted.Valid || persisted.String == "" {
+		return nil
+	}
+
+	var stored map[string]string
+	err := json.Unmarshal([]byte(persisted.String), &stored)
+	if err != nil {
+		return fmt.Errorf("invalid persisted metadata: %w", err)
+	}
+
+	res.Metadata = make(map[string]string, len(reqMetadata)+len(stored))
+	for k, v := range reqMetadata {
+		res.Metadata[k] = v
+	}
+	for k, v := range stored {
+		res.Metadata[k] = v
+	}
+	if v, ok := stored[metadataContentTypeKey]; ok {
+		res.ContentType = &v
+	}
+	return nil
+}
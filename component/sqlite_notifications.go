@@ -0,0 +1,343 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/dapr/components-contrib/state"
+	"github.com/dapr/kit/logger"
+)
+
+// ExpiredKey is a key that was removed by the cleanup because it expired.
+type ExpiredKey struct {
+	Key string
+	// Last value of the key, as returned by Get.
+	Value []byte
+	// Persisted metadata of the key, such as contentType.
+	Metadata map[string]string
+	// Time when the key expired.
+	ExpirationTime time.Time
+}
+
+// ExpirationHandler is invoked for each expired key.
+// If it returns an error, the key is delivered again later, so handlers must be idempotent.
+type ExpirationHandler func(ctx context.Context, key ExpiredKey) error
+
+// expirationDBAccess is implemented by DBAccess objects that can notify expired keys.
+type expirationDBAccess interface {
+	onExpiration(handler ExpirationHandler) error
+}
+
+// An expired key waiting to be delivered, with its ID in the table.
+type pendingExpiredKey struct {
+	id int64
+	ExpiredKey
+}
+
+// expirationDispatcher delivers the keys captured in the table of expired keys to the handler, and removes them once it succeeds.
+// Keys stay in the table until they're delivered, including across restarts.
+type expirationDispatcher struct {
+	logger logger.Logger
+	// Reads the next keys to deliver, in order.
+	read func(ctx context.Context, limit int) ([]pendingExpiredKey, error)
+	// Removes a key that was delivered.
+	ack func(ctx context.Context, id int64) error
+	// If set, keys are only delivered while it returns true.
+	active func() bool
+
+	lock    sync.Mutex
+	handler ExpirationHandler
+	signal  chan struct{}
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func newExpirationDispatcher(logger logger.Logger) *expirationDispatcher {
+	return &expirationDispatcher{
+		logger: logger,
+		signal: make(chan struct{}, 1),
+	}
+}
+
+// Sets the handler, and starts delivering keys when the first handler is set.
+func (d *expirationDispatcher) setHandler(parentCtx context.Context, handler ExpirationHandler) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.handler == nil {
+		var ctx context.Context
+		ctx, d.cancel = context.WithCancel(parentCtx)
+		d.wg.Add(1)
+		go d.run(ctx)
+	}
+	d.handler = handler
+	d.notify()
+}
+
+// Wakes up the dispatcher after new keys were captured.
+func (d *expirationDispatcher) notify() {
+	select {
+	case d.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (d *expirationDispatcher) run(ctx context.Context) {
+	defer d.wg.Done()
+
+	// Keys that failed, or that couldn't be delivered while inactive, are retried periodically
+	ticker := time.NewTicker(expirationRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.signal:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if d.active != nil && !d.active() {
+			continue
+		}
+		err := d.deliver(ctx)
+		if err != nil && ctx.Err() == nil {
+			d.logger.Warnf("Failed to deliver expired keys, will retry in %v: %v", expirationRetryInterval, err)
+		}
+	}
+}
+
+// Delivers the pending keys until there are none left or a delivery fails.
+func (d *expirationDispatcher) deliver(ctx context.Context) error {
+	d.lock.Lock()
+	handler := d.handler
+	d.lock.Unlock()
+
+	for {
+		keys, err := d.read(ctx, expirationBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			err = handler(ctx, k.ExpiredKey)
+			if err != nil {
+				return fmt.Errorf("handler failed for key '%s': %w", k.Key, err)
+			}
+			// The key was delivered, so it's removed even if the dispatcher is being stopped, which waits for it; otherwise, it would be delivered again after a restart
+			err = d.ack(context.Background(), k.id)
+			if err != nil {
+				return err
+			}
+		}
+		if len(keys) < expirationBatchSize {
+			return nil
+		}
+	}
+}
+
+// Stops delivering keys, and waits for the delivery in progress (if any) to end.
+func (d *expirationDispatcher) stop() {
+	d.lock.Lock()
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.lock.Unlock()
+	d.wg.Wait()
+}
+
+func (a *sqliteDBAccess) expiredTableName() string {
+	return a.tableName + expiredTableSuffix
+}
+
+func (a *sqliteDBAccess) ensureExpiredTable(parentCtx context.Context) error {
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec(fmt.Sprintf(createExpiredTableTpl, a.expiredTableName()))
+		return err
+	})
+}
+
+// Copies the rows that expired before the given time (or the current time if it's zero) to the table of expired keys.
+// It's called in the same transaction that deletes them, before they're deleted.
+func (a *sqliteDBAccess) captureExpired(tx *sql.Tx, before time.Time) (int64, error) {
+	if a.expirations == nil {
+		return 0, nil
+	}
+
+	// Rows that were soft-deleted already were notified as deleted, not expired
+	var cond string
+	if a.softDeleteGracePeriod > 0 {
+		cond = " AND deletion_time IS NULL"
+	}
+
+	var (
+		res sql.Result
+		err error
+	)
+	if before.IsZero() {
+		res, err = tx.Exec(fmt.Sprintf(captureExpiredTpl, a.expiredTableName(), a.tableName, "CURRENT_TIMESTAMP", cond))
+	} else {
+		res, err = tx.Exec(fmt.Sprintf(captureExpiredTpl, a.expiredTableName(), a.tableName, "DATETIME(?, 'unixepoch')", cond), before.Unix())
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to capture expired rows: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+func (a *sqliteDBAccess) readExpired(parentCtx context.Context, limit int) ([]pendingExpiredKey, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	rows, err := a.db.QueryContext(ctx, fmt.Sprintf(listExpiredTpl, a.expiredTableName()), limit)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer rows.Close()
+
+	var res []pendingExpiredKey
+	for rows.Next() {
+		var (
+			k        pendingExpiredKey
+			isBinary bool
+			metadata sql.NullString
+		)
+		err = rows.Scan(&k.id, &k.Key, &k.Value, &isBinary, &metadata, &k.ExpirationTime)
+		if err != nil {
+			return nil, err
+		}
+		if isBinary {
+			var s string
+			if err = json.Unmarshal(k.Value, &s); err != nil {
+				return nil, err
+			}
+			if k.Value, err = base64.StdEncoding.DecodeString(s); err != nil {
+				return nil, err
+			}
+		}
+		if metadata.Valid {
+			if err = json.Unmarshal([]byte(metadata.String), &k.Metadata); err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, k)
+	}
+	return res, rows.Err()
+}
+
+func (a *sqliteDBAccess) ackExpired(parentCtx context.Context, id int64) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec(fmt.Sprintf(deleteExpiredKeyTpl, a.expiredTableName()), id)
+		return err
+	})
+}
+
+func (a *sqliteDBAccess) onExpiration(handler ExpirationHandler) error {
+	if a.expirations == nil {
+		return errors.New("expiration notifications are not enabled")
+	}
+	a.expirations.setHandler(a.ctx, handler)
+	return nil
+}
+
+// In clustered mode, every node captures the expired keys, but only the leader delivers them.
+// Delivered keys are removed through the Raft log, so a new leader doesn't deliver them again.
+func (r *raftDBAccess) onExpiration(handler ExpirationHandler) error {
+	return r.local.onExpiration(handler)
+}
+
+// Configures the dispatcher of the local database to deliver keys on the leader only.
+func (r *raftDBAccess) initExpirations() {
+	d := r.local.expirations
+	if d == nil {
+		return
+	}
+	rf := r.raft
+	d.active = func() bool {
+		return rf.State() == raft.Leader
+	}
+	d.ack = func(ctx context.Context, id int64) error {
+		return r.propose(ctx, raftCommand{AckExpired: &id})
+	}
+}
+
+func (s *shardedDBAccess) onExpiration(handler ExpirationHandler) error {
+	for _, shard := range s.shards {
+		err := shard.onExpiration(handler)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The handler is set on the databases of the tenants that are open, and on those that are opened later.
+func (t *tenantDBAccess) onExpiration(handler ExpirationHandler) error {
+	if enabled, _ := parseBool(t.metadata, expirationNotificationsKey); !enabled {
+		return errors.New("expiration notifications are not enabled")
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.expirationHandler = handler
+	for _, db := range t.tenants {
+		if db.access == nil {
+			// Databases that are being opened get the handler when they're ready
+			continue
+		}
+		err := db.access.onExpiration(handler)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnExpiration registers a handler that is invoked for each key removed by the cleanup because it expired, replacing the previous handler.
+// Keys are delivered at least once: they're retried until the handler succeeds, including after a restart.
+func (s *SQLiteStore) OnExpiration(handler ExpirationHandler) error {
+	a, ok := s.dbaccess.(expirationDBAccess)
+	if !ok {
+		return errors.New("expiration notifications are not supported")
+	}
+	if handler == nil {
+		return errors.New("missing handler")
+	}
+	return a.onExpiration(handler)
+}
+
+// Returns true if expiration notifications are enabled in the metadata.
+func parseExpirationNotifications(metadata state.Metadata) (bool, error) {
+	return parseBool(metadata, expirationNotificationsKey)
+}
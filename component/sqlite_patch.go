@@ -0,0 +1,155 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// OperationPatch is the operation type of PatchRequest objects in transactions.
+const OperationPatch state.OperationType = "patch"
+
+// PatchType is the format of a patch.
+type PatchType string
+
+const (
+	// PatchTypeMerge is a JSON Merge Patch (RFC 7386).
+	PatchTypeMerge PatchType = "merge"
+	// PatchTypeJSON is a JSON Patch (RFC 6902).
+	PatchTypeJSON PatchType = "json"
+)
+
+// PatchRequest modifies the JSON value of an existing key with a patch.
+// It can be executed with SQLiteStore.Patch or as part of a transaction, with the OperationPatch operation type.
+type PatchRequest struct {
+	Key string
+	// Patch document, in the format of Type.
+	Patch json.RawMessage
+	// Format of the patch, which is PatchTypeMerge if empty.
+	Type PatchType
+	// If set, the patch is only applied if the ETag of the key matches.
+	ETag *string
+	// Metadata of the write, such as ttlInSeconds; as with Set, the TTL is removed if it's not set.
+	Metadata map[string]string
+	Options  state.SetStateOption
+}
+
+// Patch applies a patch to the JSON value of a key, which gets a new ETag.
+func (s *SQLiteStore) Patch(ctx context.Context, req *PatchRequest) error {
+	return s.dbaccess.ExecuteMulti(ctx, []state.TransactionalStateOperation{
+		{Operation: OperationPatch, Request: *req},
+	})
+}
+
+// Returns the result of applying a patch to a JSON document.
+func applyPatch(doc []byte, patchType PatchType, patch []byte) ([]byte, error) {
+	switch patchType {
+	case PatchTypeMerge, "":
+		return jsonpatch.MergePatch(doc, patch)
+	case PatchTypeJSON:
+		p, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, err
+		}
+		return p.Apply(doc)
+	default:
+		return nil, fmt.Errorf("invalid patch type: %s", patchType)
+	}
+}
+
+// Applies a patch to the value of a key, inside the transaction.
+// The patched value is written with setValue, so it's subject to the same ETag checks and side effects as a set.
+func (a *sqliteDBAccess) patchValue(ctx context.Context, tx *sql.Tx, req *PatchRequest, wc writeContext) error {
+	if req.Key == "" {
+		return errors.New("missing key in patch operation")
+	}
+	if len(req.Patch) == 0 {
+		return errors.New("missing patch in patch operation")
+	}
+
+	cur, err := a.readValueForUpdate(ctx, tx, req.Key, req.ETag, req.Options.Concurrency)
+	if err != nil {
+		return err
+	}
+	if cur == nil {
+		return NewStoreError(StoreErrorConflict, fmt.Errorf("key '%s' does not exist", req.Key))
+	}
+	if cur.isBinary {
+		return fmt.Errorf("the value of key '%s' is binary and can't be patched", req.Key)
+	}
+
+	patched, err := applyPatch(cur.value, req.Type, req.Patch)
+	if err != nil {
+		return fmt.Errorf("failed to apply patch to key '%s': %w", req.Key, err)
+	}
+
+	// The ETag that was read guarantees that the value wasn't changed in the meantime
+	setReq := state.SetRequest{
+		Key:      req.Key,
+		Value:    json.RawMessage(patched),
+		ETag:     &cur.etag,
+		Metadata: req.Metadata,
+		Options: state.SetStateOption{
+			Concurrency: state.FirstWrite,
+		},
+	}
+	return a.setValue(ctx, tx, &setReq, wc)
+}
+
+// Current value of a key, which is read to be returned by Get or to be modified.
+type currentValue struct {
+	value    []byte
+	isBinary bool
+	etag     string
+	metadata sql.NullString
+	// Sliding TTL and expiration time, which are kept by increments.
+	slidingTTL sql.NullInt64
+	expiration sql.NullTime
+}
+
+// Reads the value of a key inside a transaction, checking the ETag of the request like a write would.
+// It returns nil if the key doesn't exist and the request has no ETag.
+func (a *sqliteDBAccess) readValueForUpdate(ctx context.Context, tx *sql.Tx, key string, etag *string, concurrency string) (*currentValue, error) {
+	if concurrency == state.FirstWrite && (etag == nil || *etag == "") {
+		return nil, errors.New("when FirstWrite is to be enforced, a value must be provided for the ETag")
+	}
+	if concurrency == state.LastWrite {
+		etag = nil
+	}
+
+	var cur currentValue
+	err := a.stmts.bind(ctx, tx, a.stmts.get).QueryRow(key).
+		Scan(&cur.value, &cur.isBinary, &cur.etag, &cur.metadata, &cur.slidingTTL, &cur.expiration)
+	if errors.Is(err, sql.ErrNoRows) {
+		if etag != nil && *etag != "" {
+			return nil, state.NewETagError(state.ETagMismatch, nil)
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if etag != nil && *etag != "" && *etag != cur.etag {
+		return nil, state.NewETagError(state.ETagMismatch, nil)
+	}
+	return &cur, nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// ttlPolicy sets the lifetime of the keys that match a pattern.
+type ttlPolicy struct {
+	// Prefix of the keys, or a glob pattern if it contains "*" or "?".
+	Pattern string `json:"pattern"`
+	// TTL of the keys written without one, as a duration such as "30m".
+	DefaultTTL string `json:"defaultTTL,omitempty"`
+	// Age after which the keys are removed by the cleanup, even if they don't expire.
+	MaxAge string `json:"maxAge,omitempty"`
+
+	defaultTTL int64
+	maxAge     time.Duration
+	// Pattern compiled for keys that are written, and translated for SQLite's GLOB operator for the cleanup.
+	re   *regexp.Regexp
+	glob string
+}
+
+// Returns the TTL policies in the metadata, in the order in which they're matched.
+func parseTTLPolicies(metadata state.Metadata) ([]ttlPolicy, error) {
+	s := metadata.Properties[ttlPoliciesKey]
+	if s == "" {
+		return nil, nil
+	}
+
+	var policies []ttlPolicy
+	err := json.Unmarshal([]byte(s), &policies)
+	if err != nil {
+		return nil, fmt.Errorf("illegal %s value: %w", ttlPoliciesKey, err)
+	}
+	for i := range policies {
+		p := &policies[i]
+		if p.Pattern == "" {
+			return nil, fmt.Errorf("illegal %s value: missing pattern", ttlPoliciesKey)
+		}
+		if p.DefaultTTL == "" && p.MaxAge == "" {
+			return nil, fmt.Errorf("illegal %s value: policy for '%s' has neither defaultTTL nor maxAge", ttlPoliciesKey, p.Pattern)
+		}
+		if p.DefaultTTL != "" {
+			d, err := time.ParseDuration(p.DefaultTTL)
+			if err != nil || d < time.Second {
+				return nil, fmt.Errorf("illegal %s value: invalid defaultTTL for '%s': %s", ttlPoliciesKey, p.Pattern, p.DefaultTTL)
+			}
+			p.defaultTTL = int64(d / time.Second)
+		}
+		if p.MaxAge != "" {
+			p.maxAge, err = time.ParseDuration(p.MaxAge)
+			if err != nil || p.maxAge <= 0 {
+				return nil, fmt.Errorf("illegal %s value: invalid maxAge for '%s': %s", ttlPoliciesKey, p.Pattern, p.MaxAge)
+			}
+		}
+		p.re, p.glob = compilePattern(p.Pattern)
+	}
+	return policies, nil
+}
+
+// Compiles a key pattern, which matches keys that start with it unless it contains wildcards.
+// "*" matches any sequence of characters and "?" any single character, in both the regular expression and the GLOB pattern.
+func compilePattern(pattern string) (*regexp.Regexp, string) {
+	if !strings.ContainsAny(pattern, "*?") {
+		pattern += "*"
+	}
+
+	var re, glob strings.Builder
+	re.WriteString("(?s)^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			re.WriteString(".*")
+			glob.WriteRune(c)
+		case '?':
+			re.WriteString(".")
+			glob.WriteRune(c)
+		case '[':
+			// "[" starts a character class in GLOB patterns, unless it's in one
+			re.WriteString(regexp.QuoteMeta(string(c)))
+			glob.WriteString("[[]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+			glob.WriteRune(c)
+		}
+	}
+	re.WriteString("$")
+	return regexp.MustCompile(re.String()), glob.String()
+}
+
+// Returns the first policy that matches a key, or nil.
+func (a *sqliteDBAccess) ttlPolicyFor(key string) *ttlPolicy {
+	for i := range a.ttlPolicies {
+		if a.ttlPolicies[i].re.MatchString(key) {
+			return &a.ttlPolicies[i]
+		}
+	}
+	return nil
+}
+
+// Returns the TTL limits of a key, with the default TTL of its policy.
+func (a *sqliteDBAccess) ttlLimitsFor(key string) ttlLimits {
+	limits := a.ttlLimits
+	if p := a.ttlPolicyFor(key); p != nil && p.defaultTTL > 0 {
+		limits.defaultTTL = p.defaultTTL
+	}
+	return limits
+}
+
+// Removes the rows that are older than the maximum age of their policy, and returns how many were removed.
+// Keys are subject to the first policy they match only, like when they're written.
+func (a *sqliteDBAccess) enforceMaxAge(tx *sql.Tx, now time.Time) (int64, error) {
+	var removed int64
+	for i, p := range a.ttlPolicies {
+		if p.maxAge == 0 {
+			continue
+		}
+
+		cond := "key GLOB ?"
+		args := []any{p.glob}
+		for _, prev := range a.ttlPolicies[:i] {
+			cond += " AND key NOT GLOB ?"
+			args = append(args, prev.glob)
+		}
+		args = append(args, now.Add(-p.maxAge).Unix())
+
+		res, err := tx.Exec(fmt.Sprintf(deleteOlderThanTpl, a.tableName, cond), args...)
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove rows older than the maximum age of '%s': %w", p.Pattern, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+	return removed, nil
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// Pragmas that are set on each connection when it's opened.
+// Empty values are not set, so SQLite (or the connection string) defaults apply.
+type pragmaSettings struct {
+	journalMode       string
+	synchronous       string
+	cacheSize         string
+	mmapSize          string
+	tempStore         string
+	walAutocheckpoint string
+
+	// If true, the connection can't make changes to the database.
+	queryOnly bool
+	// Maximum size of the database in bytes, or 0 for no limit.
+	// It's set with max_page_count, so writes that would grow the database beyond it fail with SQLITE_FULL.
+	maxSize int64
+}
+
+// Named profiles that can be selected with the "profile" metadata property.
+var profiles = map[string]pragmaSettings{
+	// Every transaction is fsync'd before it's committed: no data is lost on power failure.
+	"durable": {
+		journalMode:       "WAL",
+		synchronous:       "FULL",
+		cacheSize:         "-2000",
+		mmapSize:          "0",
+		tempStore:         "DEFAULT",
+		walAutocheckpoint: "1000",
+	},
+	// The database can't be corrupted, but the last transactions can be rolled back on power failure.
+	"balanced": {
+		journalMode:       "WAL",
+		synchronous:       "NORMAL",
+		cacheSize:         "-16000",
+		mmapSize:          "268435456",
+		tempStore:         "MEMORY",
+		walAutocheckpoint: "1000",
+	},
+	// Data is never fsync'd: the database can be corrupted on power failure (but not if the app crashes).
+	"fast": {
+		journalMode:       "WAL",
+		synchronous:       "OFF",
+		cacheSize:         "-64000",
+		mmapSize:          "1073741824",
+		tempStore:         "MEMORY",
+		walAutocheckpoint: "10000",
+	},
+}
+
+// Returns the pragmas for the profile selected in the metadata, with any individual overrides applied.
+func parsePragmaSettings(metadata state.Metadata) (string, pragmaSettings, error) {
+	var settings pragmaSettings
+
+	profile := strings.ToLower(metadata.Properties[profileKey])
+	if profile != "" {
+		var ok bool
+		settings, ok = profiles[profile]
+		if !ok {
+			return "", settings, fmt.Errorf("invalid %s: %s", profileKey, metadata.Properties[profileKey])
+		}
+	}
+
+	overrides := []struct {
+		key      string
+		dest     *string
+		validate func(string) (string, bool)
+	}{
+		{journalModeKey, &settings.journalMode, oneOf("DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF")},
+		{synchronousKey, &settings.synchronous, oneOf("OFF", "NORMAL", "FULL", "EXTRA")},
+		{cacheSizeKey, &settings.cacheSize, isInteger},
+		{mmapSizeKey, &settings.mmapSize, isInteger},
+		{tempStoreKey, &settings.tempStore, oneOf("DEFAULT", "FILE", "MEMORY")},
+		{walAutocheckpointKey, &settings.walAutocheckpoint, isInteger},
+	}
+	for _, o := range overrides {
+		val, ok := metadata.Properties[o.key]
+		if !ok || val == "" {
+			continue
+		}
+		val, ok = o.validate(val)
+		if !ok {
+			return "", settings, fmt.Errorf("invalid %s value: %s", o.key, metadata.Properties[o.key])
+		}
+		*o.dest = val
+	}
+
+	return profile, settings, nil
+}
+
+func oneOf(allowed ...string) func(string) (string, bool) {
+	return func(v string) (string, bool) {
+		v = strings.ToUpper(v)
+		for _, a := range allowed {
+			if v == a {
+				return v, true
+			}
+		}
+		return "", false
+	}
+}
+
+func isInteger(v string) (string, bool) {
+	_, err := strconv.ParseInt(v, 10, 64)
+	return v, err == nil
+}
+
+// Returns the PRAGMA statements to execute on each new connection.
+func (p pragmaSettings) statements() []string {
+	// journal_mode must be set first, as it affects how the other pragmas behave.
+	pairs := [][2]string{
+		{"journal_mode", p.journalMode},
+		{"synchronous", p.synchronous},
+		{"cache_size", p.cacheSize},
+		{"mmap_size", p.mmapSize},
+		{"temp_store", p.tempStore},
+		{"wal_autocheckpoint", p.walAutocheckpoint},
+	}
+	res := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair[1] != "" {
+			res = append(res, "PRAGMA "+pair[0]+" = "+pair[1])
+		}
+	}
+	if p.queryOnly {
+		res = append(res, "PRAGMA query_only = ON")
+	}
+	return res
+}
+
+func (p pragmaSettings) String() string {
+	val := func(v string) string {
+		if v == "" {
+			return "default"
+		}
+		return v
+	}
+	return fmt.Sprintf("journal_mode=%s synchronous=%s cache_size=%s mmap_size=%s temp_store=%s wal_autocheckpoint=%s",
+		val(p.journalMode), val(p.synchronous), val(p.cacheSize), val(p.mmapSize), val(p.tempStore), val(p.walAutocheckpoint))
+}
+
+// sqliteConnector implements driver.Connector.
+// It opens connections with go-sqlite3 and sets the pragmas on each one of them.
+type sqliteConnector struct {
+	driver *sqlite3.SQLiteDriver
+	dsn    string
+}
+
+func newSqliteConnector(dsn string, pragmas pragmaSettings) *sqliteConnector {
+	stmts := pragmas.statements()
+	return &sqliteConnector{
+		driver: &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				for _, stmt := range stmts {
+					_, err := conn.Exec(stmt, nil)
+					if err != nil {
+						return fmt.Errorf("failed to execute '%s': %w", stmt, err)
+					}
+				}
+				if pragmas.maxSize > 0 {
+					return setMaxSize(conn, pragmas.maxSize)
+				}
+				return nil
+			},
+		},
+		dsn: dsn,
+	}
+}
+
+// Sets the max_page_count of a connection, which is the maximum size divided by the page size of the database.
+func setMaxSize(conn *sqlite3.SQLiteConn, maxSize int64) error {
+	rows, err := conn.Query("PRAGMA page_size", nil)
+	if err != nil {
+		return err
+	}
+	dest := make([]driver.Value, 1)
+	err = rows.Next(dest)
+	rows.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read the page size: %w", err)
+	}
+	pageSize, ok := dest[0].(int64)
+	if !ok || pageSize <= 0 {
+		return fmt.Errorf("invalid page size: %v", dest[0])
+	}
+
+	pages := maxSize / pageSize
+	if pages < 1 {
+		pages = 1
+	}
+	_, err = conn.Exec("PRAGMA max_page_count = "+strconv.FormatInt(pages, 10), nil)
+	if err != nil {
+		return fmt.Errorf("failed to set max_page_count: %w", err)
+	}
+	return nil
+}
+
+func (c *sqliteConnector) Connect(_ context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *sqliteConnector) Driver() driver.Driver {
+	return c.driver
+}
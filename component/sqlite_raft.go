@@ -0,0 +1,1015 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/dapr/components-contrib/state"
+	"github.com/dapr/components-contrib/state/utils"
+	"github.com/dapr/kit/logger"
+)
+
+// raftDBAccess implements DBAccess for the clustered mode.
+// Writes are entries in a Raft log that is replicated between the nodes of the cluster, and every node applies them to its local SQLite database.
+// Reads are served by the local database, unless they require strong consistency: then, they're served by the leader.
+type raftDBAccess struct {
+	logger          logger.Logger
+	local           *sqliteDBAccess
+	raft            *raft.Raft
+	layer           *raftStreamLayer
+	logStore        *raftLogStore
+	cleanupInterval *time.Duration
+	ctx             context.Context
+	cancel          context.CancelFunc
+	wg              sync.WaitGroup
+}
+
+// Configuration of the Raft node.
+type raftConfig struct {
+	nodeID      string
+	bindAddress string
+	dataDir     string
+	peers       []raft.Server
+	// Nil if connections between nodes are not encrypted nor authenticated.
+	tlsConfig *tls.Config
+}
+
+// Entry in the Raft log.
+type raftCommand struct {
+	// Time when the command was proposed, which is used in place of the local clock when applying it.
+	Time int64 `json:"time"`
+	// Operations to execute in a transaction.
+	Ops []raftOperation `json:"ops,omitempty"`
+	// If true, deletes the rows that expired before Time.
+	Cleanup bool `json:"cleanup,omitempty"`
+	// If set, restores the soft-deleted row of the key, giving it NewETag.
+	Undelete *raftOperation `json:"undelete,omitempty"`
+	// If set, renews the expiration of the key if it has a sliding TTL and its ETag still matches.
+	Refresh *raftOperation `json:"refresh,omitempty"`
+	// If set, removes the expired key with this ID, which was delivered to the handler.
+	AckExpired *int64 `json:"ackExpired,omitempty"`
+}
+
+// Set, delete, patch or increment operation in a raftCommand.
+type raftOperation struct {
+	Operation   state.OperationType `json:"op"`
+	Key         string              `json:"key"`
+	Value       []byte              `json:"value,omitempty"`
+	ValueType   string              `json:"valueType,omitempty"`
+	ETag        *string             `json:"etag,omitempty"`
+	Metadata    map[string]string   `json:"metadata,omitempty"`
+	Concurrency string              `json:"concurrency,omitempty"`
+	NewETag     string              `json:"newEtag,omitempty"`
+	PatchType   PatchType           `json:"patchType,omitempty"`
+	Field       string              `json:"field,omitempty"`
+	Delta       float64             `json:"delta,omitempty"`
+	Initial     float64             `json:"initial,omitempty"`
+}
+
+// Types of values in a raftOperation, so they're passed to the local database as they were passed to the proposing node.
+const (
+	raftValueBinary = "binary"
+	raftValueString = "string"
+	raftValueJSON   = "json"
+)
+
+// Request that a follower forwards to the leader: either a command to apply, or a key to read.
+type raftForwardRequest struct {
+	Command  []byte            `json:"command,omitempty"`
+	Key      string            `json:"key,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type raftForwardResponse struct {
+	Error     string  `json:"error,omitempty"`
+	ErrorKind string  `json:"errorKind,omitempty"`
+	Data      []byte  `json:"data,omitempty"`
+	ETag      *string `json:"etag,omitempty"`
+	// Metadata of the value that was read, including the persisted one.
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	ContentType *string           `json:"contentType,omitempty"`
+	// New values of the increment operations in the command.
+	Increments []float64 `json:"increments,omitempty"`
+}
+
+func newRaftDBAccess(logger logger.Logger, local *sqliteDBAccess) *raftDBAccess {
+	return &raftDBAccess{
+		logger: logger,
+		local:  local,
+	}
+}
+
+func (r *raftDBAccess) Init(metadata state.Metadata) error {
+	cfg, err := parseRaftConfig(metadata)
+	if err != nil {
+		return err
+	}
+	if readOnly, _ := parseBool(metadata, readOnlyKey); readOnly {
+		return errors.New("clustered mode is not supported in read-only mode")
+	}
+	if metadata.Properties[cacheMaxRowsKey] != "" || metadata.Properties[cacheMaxBytesKey] != "" {
+		// Reads are local, so the access times used to evict rows would differ on every node
+		return errors.New("cache mode is not supported in clustered mode")
+	}
+
+	// Expired rows are deleted through the Raft log, so every node deletes the same rows
+	r.cleanupInterval, err = parseCleanupInterval(metadata)
+	if err != nil {
+		return err
+	}
+	localMetadata := metadata
+	localMetadata.Properties = make(map[string]string, len(metadata.Properties))
+	for k, v := range metadata.Properties {
+		localMetadata.Properties[k] = v
+	}
+	localMetadata.Properties[cleanupIntervalKey] = "0"
+	// Writes are applied one log entry at a time, so they can't be grouped
+	delete(localMetadata.Properties, groupCommitMaxDelayKey)
+	delete(localMetadata.Properties, groupCommitMaxBatchKey)
+
+	err = r.local.Init(localMetadata)
+	if err != nil {
+		return err
+	}
+
+	// The local database is rebuilt from the latest Raft snapshot and the log entries that follow it
+	err = r.local.truncateState(r.local.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to reset the local database: %w", err)
+	}
+
+	err = os.MkdirAll(cfg.dataDir, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create Raft data directory: %w", err)
+	}
+	raftLogger := hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Info,
+		Output: &raftLogWriter{logger: r.logger},
+	})
+
+	r.logStore, err = newRaftLogStore(filepath.Join(cfg.dataDir, "raft.db"))
+	if err != nil {
+		return fmt.Errorf("failed to open Raft log: %w", err)
+	}
+	logCache, err := raft.NewLogCache(defaultRaftLogCacheSize, r.logStore)
+	if err != nil {
+		return err
+	}
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(cfg.dataDir, defaultRaftSnapshotRetain, raftLogger)
+	if err != nil {
+		return fmt.Errorf("failed to open Raft snapshots: %w", err)
+	}
+
+	var advertise net.Addr
+	for _, p := range cfg.peers {
+		if string(p.ID) == cfg.nodeID {
+			advertise, err = net.ResolveTCPAddr("tcp", string(p.Address))
+			if err != nil {
+				return fmt.Errorf("invalid address for node %s: %w", p.ID, err)
+			}
+		}
+	}
+	if cfg.tlsConfig == nil {
+		r.logger.Warnf("Connections between Raft nodes are not authenticated: %s must only be reachable from a trusted network", cfg.bindAddress)
+	}
+	r.layer, err = newRaftStreamLayer(cfg.bindAddress, advertise, cfg.tlsConfig, r.handleForward)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", cfg.bindAddress, err)
+	}
+	transport := raft.NewNetworkTransportWithLogger(r.layer, defaultRaftMaxPool, r.local.timeout, raftLogger)
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(cfg.nodeID)
+	conf.Logger = raftLogger
+
+	peers := cfg.peers
+	if len(peers) == 0 {
+		// Single-node cluster
+		peers = []raft.Server{{ID: conf.LocalID, Address: transport.LocalAddr()}}
+	}
+	err = raft.BootstrapCluster(conf, logCache, r.logStore, snapshots, transport, raft.Configuration{Servers: peers})
+	if err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+		return fmt.Errorf("failed to bootstrap Raft cluster: %w", err)
+	}
+
+	r.raft, err = raft.NewRaft(conf, &raftFSM{local: r.local, dataDir: cfg.dataDir}, logCache, r.logStore, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		return fmt.Errorf("failed to start Raft: %w", err)
+	}
+	r.logger.Infof("Started Raft node %s on %s with %d peers", cfg.nodeID, transport.LocalAddr(), len(peers))
+
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.initExpirations()
+	r.scheduleCleanupExpiredData()
+
+	return nil
+}
+
+// Returns the Raft configuration from the metadata.
+// Peers are listed as "id=address" pairs separated by commas, and they must include the node itself.
+func parseRaftConfig(metadata state.Metadata) (cfg raftConfig, err error) {
+	cfg.nodeID = metadata.Properties[raftNodeIDKey]
+	cfg.bindAddress = metadata.Properties[raftBindAddressKey]
+	if cfg.bindAddress == "" {
+		return cfg, fmt.Errorf("missing %s", raftBindAddressKey)
+	}
+	cfg.dataDir = metadata.Properties[raftDataDirKey]
+	if cfg.dataDir == "" {
+		return cfg, fmt.Errorf("missing %s", raftDataDirKey)
+	}
+	cfg.tlsConfig, err = parseRaftTLSConfig(metadata)
+	if err != nil {
+		return cfg, err
+	}
+
+	peers := metadata.Properties[raftPeersKey]
+	if peers == "" {
+		return cfg, nil
+	}
+	hasSelf := false
+	for _, p := range strings.Split(peers, ",") {
+		id, addr, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || id == "" || addr == "" {
+			return cfg, fmt.Errorf("illegal %s value: %s", raftPeersKey, peers)
+		}
+		if id == cfg.nodeID {
+			hasSelf = true
+		}
+		cfg.peers = append(cfg.peers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(id),
+			Address:  raft.ServerAddress(addr),
+		})
+	}
+	if !hasSelf {
+		return cfg, fmt.Errorf("%s must include the node %s", raftPeersKey, cfg.nodeID)
+	}
+	return cfg, nil
+}
+
+// Returns the mutual TLS configuration for the connections between nodes, or nil if it's not set.
+// The same certificate is used as server and as client, and peers must present a certificate signed by the CA.
+func parseRaftTLSConfig(metadata state.Metadata) (*tls.Config, error) {
+	certFile := metadata.Properties[raftTLSCertFileKey]
+	keyFile := metadata.Properties[raftTLSKeyFileKey]
+	caFile := metadata.Properties[raftTLSCAFileKey]
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, fmt.Errorf("%s, %s and %s must be set together", raftTLSCertFileKey, raftTLSKeyFileKey, raftTLSCAFileKey)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the Raft TLS certificate: %w", err)
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the Raft TLS CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Ping returns an error if the local database can't be reached, or if the cluster has no leader.
+func (r *raftDBAccess) Ping(ctx context.Context) error {
+	err := r.local.Ping(ctx)
+	if err != nil {
+		return err
+	}
+	if addr, _ := r.raft.LeaderWithID(); addr == "" {
+		return NewStoreError(StoreErrorUnavailable, raft.ErrNotLeader)
+	}
+	return nil
+}
+
+func (r *raftDBAccess) Get(ctx context.Context, req *state.GetRequest) (*state.GetResponse, error) {
+	if req.Options.Consistency != state.Strong {
+		return r.localGet(ctx, req)
+	}
+
+	if r.raft.State() == raft.Leader {
+		return r.linearizableGet(ctx, req)
+	}
+
+	res, err := r.forward(ctx, raftForwardRequest{Key: req.Key, Metadata: req.Metadata})
+	if err != nil {
+		return nil, err
+	}
+	return &state.GetResponse{
+		Data:        res.Data,
+		ETag:        res.ETag,
+		Metadata:    res.Metadata,
+		ContentType: res.ContentType,
+	}, nil
+}
+
+// Reads a key on the leader after all the entries committed before the read have been applied.
+func (r *raftDBAccess) linearizableGet(ctx context.Context, req *state.GetRequest) (*state.GetResponse, error) {
+	// The barrier is committed only if this node is still the leader
+	err := r.raft.Barrier(r.local.timeout).Error()
+	if err != nil {
+		return nil, raftError(err)
+	}
+	return r.localGet(ctx, req)
+}
+
+// Reads a key from the local database.
+// If the key has a sliding TTL, its expiration is renewed through the Raft log, so it's the same on every node.
+func (r *raftDBAccess) localGet(ctx context.Context, req *state.GetRequest) (*state.GetResponse, error) {
+	res, refresh, err := r.local.get(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if refresh {
+		err = r.propose(ctx, raftCommand{Refresh: &raftOperation{Key: req.Key, ETag: res.ETag}})
+		if err != nil {
+			r.logger.Warnf("Failed to renew the expiration of key '%s': %v", req.Key, err)
+		}
+	}
+	return res, nil
+}
+
+func (r *raftDBAccess) Set(ctx context.Context, req *state.SetRequest) error {
+	op, err := newRaftSetOperation(req)
+	if err != nil {
+		return err
+	}
+	return r.propose(ctx, raftCommand{Ops: []raftOperation{op}})
+}
+
+func (r *raftDBAccess) Delete(ctx context.Context, req *state.DeleteRequest) error {
+	return r.propose(ctx, raftCommand{Ops: []raftOperation{newRaftDeleteOperation(req)}})
+}
+
+func (r *raftDBAccess) ExecuteMulti(ctx context.Context, reqs []state.TransactionalStateOperation) error {
+	ops := make([]raftOperation, 0, len(reqs))
+	var results []*float64
+	for _, req := range reqs {
+		switch req.Operation {
+		case state.Upsert:
+			setReq, ok := req.Request.(state.SetRequest)
+			if !ok {
+				return fmt.Errorf("expecting set request")
+			}
+			op, err := newRaftSetOperation(&setReq)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, op)
+		case state.Delete:
+			delReq, ok := req.Request.(state.DeleteRequest)
+			if !ok {
+				return fmt.Errorf("expecting delete request")
+			}
+			ops = append(ops, newRaftDeleteOperation(&delReq))
+		case OperationPatch:
+			patchReq, ok := req.Request.(PatchRequest)
+			if !ok {
+				return fmt.Errorf("expecting patch request")
+			}
+			ops = append(ops, newRaftPatchOperation(&patchReq))
+		case OperationIncrement:
+			incrReq, ok := req.Request.(IncrementRequest)
+			if !ok {
+				return fmt.Errorf("expecting increment request")
+			}
+			ops = append(ops, newRaftIncrementOperation(&incrReq))
+			results = append(results, incrReq.result)
+		default:
+			// Do nothing
+		}
+	}
+
+	increments, err := r.proposeWithResults(ctx, raftCommand{Ops: ops})
+	if err != nil {
+		return err
+	}
+	for i, res := range results {
+		if res != nil && i < len(increments) {
+			*res = increments[i]
+		}
+	}
+	return nil
+}
+
+// Close implements io.Close.
+func (r *raftDBAccess) Close() error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.wg.Wait()
+	if r.local.expirations != nil {
+		// The dispatcher proposes the keys it delivers, so it's stopped before Raft
+		r.local.expirations.stop()
+	}
+
+	var err error
+	if r.raft != nil {
+		// This closes the transport too
+		err = r.raft.Shutdown().Error()
+		r.raft = nil
+	}
+	if r.layer != nil {
+		_ = r.layer.Close()
+	}
+	if r.logStore != nil {
+		_ = r.logStore.Close()
+		r.logStore = nil
+	}
+	localErr := r.local.Close()
+	if err == nil {
+		err = localErr
+	}
+	return err
+}
+
+func newRaftSetOperation(req *state.SetRequest) (raftOperation, error) {
+	op := raftOperation{
+		Operation:   state.Upsert,
+		Key:         req.Key,
+		ETag:        req.ETag,
+		Metadata:    req.Metadata,
+		Concurrency: req.Options.Concurrency,
+		NewETag:     uuid.New().String(),
+	}
+	switch v := req.Value.(type) {
+	case []byte:
+		op.Value = v
+		op.ValueType = raftValueBinary
+	case string:
+		op.Value = []byte(v)
+		op.ValueType = raftValueString
+	default:
+		bt, err := utils.Marshal(v, json.Marshal)
+		if err != nil {
+			return op, err
+		}
+		op.Value = bt
+		op.ValueType = raftValueJSON
+	}
+	return op, nil
+}
+
+func newRaftPatchOperation(req *PatchRequest) raftOperation {
+	return raftOperation{
+		Operation:   OperationPatch,
+		Key:         req.Key,
+		Value:       req.Patch,
+		PatchType:   req.Type,
+		ETag:        req.ETag,
+		Metadata:    req.Metadata,
+		Concurrency: req.Options.Concurrency,
+		NewETag:     uuid.New().String(),
+	}
+}
+
+func newRaftIncrementOperation(req *IncrementRequest) raftOperation {
+	return raftOperation{
+		Operation:   OperationIncrement,
+		Key:         req.Key,
+		Field:       req.Field,
+		Delta:       req.Delta,
+		Initial:     req.Initial,
+		ETag:        req.ETag,
+		Metadata:    req.Metadata,
+		Concurrency: req.Options.Concurrency,
+		NewETag:     uuid.New().String(),
+	}
+}
+
+func newRaftDeleteOperation(req *state.DeleteRequest) raftOperation {
+	return raftOperation{
+		Operation:   state.Delete,
+		Key:         req.Key,
+		ETag:        req.ETag,
+		Metadata:    req.Metadata,
+		Concurrency: req.Options.Concurrency,
+	}
+}
+
+// Appends a command to the Raft log, forwarding it to the leader if needed, and waits for it to be applied.
+func (r *raftDBAccess) propose(ctx context.Context, cmd raftCommand) error {
+	_, err := r.proposeWithResults(ctx, cmd)
+	return err
+}
+
+// Like propose, but also returns the new values of the increment operations in the command, in order.
+func (r *raftDBAccess) proposeWithResults(ctx context.Context, cmd raftCommand) ([]float64, error) {
+	cmd.Time = time.Now().Unix()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.raft.State() == raft.Leader {
+		return r.apply(data)
+	}
+
+	res, err := r.forward(ctx, raftForwardRequest{Command: data})
+	if err != nil {
+		return nil, err
+	}
+	return res.Increments, nil
+}
+
+// Appends a command to the Raft log on the leader, and returns the result of applying it.
+func (r *raftDBAccess) apply(data []byte) ([]float64, error) {
+	f := r.raft.Apply(data, r.local.timeout)
+	err := f.Error()
+	if err != nil {
+		return nil, raftError(err)
+	}
+	switch res := f.Response().(type) {
+	case error:
+		return nil, res
+	case []float64:
+		return res, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Sends a request to the leader.
+func (r *raftDBAccess) forward(parentCtx context.Context, req raftForwardRequest) (*raftForwardResponse, error) {
+	addr, _ := r.raft.LeaderWithID()
+	if addr == "" {
+		return nil, NewStoreError(StoreErrorUnavailable, raft.ErrNotLeader)
+	}
+
+	ctx, cancel := context.WithTimeout(parentCtx, r.local.timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	conn, err := r.layer.dial(addr, time.Until(deadline), raftConnForward)
+	if err != nil {
+		return nil, NewStoreError(StoreErrorUnavailable, fmt.Errorf("failed to connect to the leader: %w", err))
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(deadline)
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, NewStoreError(StoreErrorUnavailable, fmt.Errorf("failed to send request to the leader: %w", err))
+	}
+	var res raftForwardResponse
+	err = json.NewDecoder(conn).Decode(&res)
+	if err != nil {
+		return nil, NewStoreError(StoreErrorUnavailable, fmt.Errorf("failed to read response from the leader: %w", err))
+	}
+	return &res, res.err()
+}
+
+// Serves requests forwarded by followers.
+func (r *raftDBAccess) handleForward(conn net.Conn) {
+	defer conn.Close()
+
+	var req raftForwardRequest
+	err := json.NewDecoder(conn).Decode(&req)
+	if err != nil {
+		return
+	}
+
+	var res raftForwardResponse
+	if req.Command != nil {
+		if r.raft.State() != raft.Leader {
+			err = NewStoreError(StoreErrorUnavailable, raft.ErrNotLeader)
+		} else {
+			res.Increments, err = r.apply(req.Command)
+		}
+	} else {
+		var getRes *state.GetResponse
+		getRes, err = r.linearizableGet(r.ctx, &state.GetRequest{Key: req.Key, Metadata: req.Metadata})
+		if getRes != nil {
+			res.Data = getRes.Data
+			res.ETag = getRes.ETag
+			res.Metadata = getRes.Metadata
+			res.ContentType = getRes.ContentType
+		}
+	}
+	if err != nil {
+		res.setErr(err)
+	}
+	_ = json.NewEncoder(conn).Encode(res)
+}
+
+// Serializes an error, keeping the kind of ETag errors and StoreError objects.
+func (res *raftForwardResponse) setErr(err error) {
+	res.Error = err.Error()
+
+	var etagErr *state.ETagError
+	var storeErr *StoreError
+	switch {
+	case errors.As(err, &etagErr):
+		res.ErrorKind = "etag:" + string(etagErr.Kind())
+	case errors.As(err, &storeErr):
+		res.ErrorKind = "store:" + string(storeErr.Kind())
+		if inner := storeErr.Unwrap(); inner != nil {
+			res.Error = inner.Error()
+		}
+	}
+}
+
+func (res *raftForwardResponse) err() error {
+	if res.Error == "" {
+		return nil
+	}
+
+	kind, val, _ := strings.Cut(res.ErrorKind, ":")
+	switch kind {
+	case "etag":
+		return state.NewETagError(state.ETagErrorKind(val), nil)
+	case "store":
+		return NewStoreError(StoreErrorKind(val), errors.New(res.Error))
+	default:
+		return errors.New(res.Error)
+	}
+}
+
+// Converts errors returned by Raft, which mean that the cluster can't accept the request right now.
+func raftError(err error) error {
+	switch {
+	case errors.Is(err, raft.ErrNotLeader),
+		errors.Is(err, raft.ErrLeadershipLost),
+		errors.Is(err, raft.ErrAbortedByRestore),
+		errors.Is(err, raft.ErrRaftShutdown),
+		errors.Is(err, raft.ErrEnqueueTimeout):
+		return NewStoreError(StoreErrorUnavailable, err)
+	default:
+		return err
+	}
+}
+
+// The leader deletes expired rows by appending a command to the Raft log.
+func (r *raftDBAccess) scheduleCleanupExpiredData() {
+	if r.cleanupInterval == nil {
+		return
+	}
+
+	d := *r.cleanupInterval
+	r.logger.Infof("Schedule expired data clean up every %v", d)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if r.raft.State() != raft.Leader {
+					continue
+				}
+				err := r.propose(r.ctx, raftCommand{Cleanup: true})
+				if err != nil {
+					r.logger.Errorf("Error removing expired data: %v", err)
+				}
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// raftFSM applies the entries of the Raft log to the local database.
+type raftFSM struct {
+	local   *sqliteDBAccess
+	dataDir string
+}
+
+// Apply executes a command, and returns the error (if any) or the new values of its increment operations, which are passed to the node that proposed it.
+func (f *raftFSM) Apply(l *raft.Log) interface{} {
+	var cmd raftCommand
+	err := json.Unmarshal(l.Data, &cmd)
+	if err != nil {
+		return fmt.Errorf("invalid Raft log entry %d: %w", l.Index, err)
+	}
+	now := time.Unix(cmd.Time, 0)
+
+	if cmd.Cleanup {
+		f.local.lock.Lock()
+		cleaned, err := f.local.deleteExpired(context.Background(), now)
+		f.local.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		f.local.logger.Debugf("Removed %d expired rows", cleaned)
+		if cleaned > 0 && f.local.expirations != nil {
+			f.local.expirations.notify()
+		}
+		return nil
+	}
+
+	if cmd.AckExpired != nil {
+		return f.local.ackExpired(context.Background(), *cmd.AckExpired)
+	}
+
+	if cmd.Undelete != nil {
+		return f.local.undeleteWithContext(context.Background(), cmd.Undelete.Key, writeContext{newETag: cmd.Undelete.NewETag, now: now})
+	}
+
+	if cmd.Refresh != nil && cmd.Refresh.ETag != nil {
+		return f.local.refreshExpiration(context.Background(), cmd.Refresh.Key, *cmd.Refresh.ETag, writeContext{now: now})
+	}
+
+	reqs := make([]state.TransactionalStateOperation, len(cmd.Ops))
+	wcs := make([]writeContext, len(cmd.Ops))
+	var increments []float64
+	for _, op := range cmd.Ops {
+		if op.Operation == OperationIncrement {
+			increments = append(increments, 0)
+		}
+	}
+	n := 0
+	for i, op := range cmd.Ops {
+		switch op.Operation {
+		case state.Upsert:
+			var value any
+			switch op.ValueType {
+			case raftValueBinary:
+				value = op.Value
+			case raftValueString:
+				value = string(op.Value)
+			default:
+				value = json.RawMessage(op.Value)
+			}
+			reqs[i] = state.TransactionalStateOperation{
+				Operation: state.Upsert,
+				Request: state.SetRequest{
+					Key:      op.Key,
+					Value:    value,
+					ETag:     op.ETag,
+					Metadata: op.Metadata,
+					Options:  state.SetStateOption{Concurrency: op.Concurrency},
+				},
+			}
+			wcs[i] = writeContext{newETag: op.NewETag, now: now}
+		case state.Delete:
+			reqs[i] = state.TransactionalStateOperation{
+				Operation: state.Delete,
+				Request: state.DeleteRequest{
+					Key:      op.Key,
+					ETag:     op.ETag,
+					Metadata: op.Metadata,
+					Options:  state.DeleteStateOption{Concurrency: op.Concurrency},
+				},
+			}
+			wcs[i] = writeContext{now: now}
+		case OperationPatch:
+			reqs[i] = state.TransactionalStateOperation{
+				Operation: OperationPatch,
+				Request: PatchRequest{
+					Key:      op.Key,
+					Patch:    op.Value,
+					Type:     op.PatchType,
+					ETag:     op.ETag,
+					Metadata: op.Metadata,
+					Options:  state.SetStateOption{Concurrency: op.Concurrency},
+				},
+			}
+			wcs[i] = writeContext{newETag: op.NewETag, now: now}
+		case OperationIncrement:
+			reqs[i] = state.TransactionalStateOperation{
+				Operation: OperationIncrement,
+				Request: IncrementRequest{
+					Key:      op.Key,
+					Field:    op.Field,
+					Delta:    op.Delta,
+					Initial:  op.Initial,
+					ETag:     op.ETag,
+					Metadata: op.Metadata,
+					Options:  state.SetStateOption{Concurrency: op.Concurrency},
+					result:   &increments[n],
+				},
+			}
+			wcs[i] = writeContext{newETag: op.NewETag, now: now}
+			n++
+		}
+	}
+
+	err = f.local.executeMulti(context.Background(), reqs, wcs)
+	if err != nil {
+		return err
+	}
+	if increments != nil {
+		return increments
+	}
+	return nil
+}
+
+// Snapshot copies the local database to a temporary file.
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	tmp, err := os.CreateTemp(f.dataDir, "fsm-snapshot-*.db")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+
+	err = f.local.backupToFile(context.Background(), tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &raftFSMSnapshot{path: tmp.Name()}, nil
+}
+
+// Restore replaces the state in the local database with the one in the snapshot.
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp(f.dataDir, "fsm-restore-*.db")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, rc)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return f.local.restoreStateFromFile(context.Background(), tmp.Name())
+}
+
+// raftFSMSnapshot is a copy of the local database.
+type raftFSMSnapshot struct {
+	path string
+}
+
+func (s *raftFSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(sink, f)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *raftFSMSnapshot) Release() {
+	os.Remove(s.path)
+}
+
+// Deletes all rows in the state table and in the history and audit tables, if any.
+func (a *sqliteDBAccess) truncateState(parentCtx context.Context) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		for _, table := range a.replicatedTables() {
+			_, err := tx.Exec(fmt.Sprintf(truncateTableTpl, table))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Returns the tables whose content is part of the state replicated by Raft.
+func (a *sqliteDBAccess) replicatedTables() []string {
+	tables := []string{a.tableName}
+	if a.history != nil {
+		tables = append(tables, a.historyTableName())
+	}
+	if a.audit != nil {
+		tables = append(tables, a.auditTableName())
+	}
+	if a.expirations != nil {
+		tables = append(tables, a.expiredTableName())
+	}
+	return tables
+}
+
+// Copies the database to a file using the SQLite backup API.
+func (a *sqliteDBAccess) backupToFile(parentCtx context.Context, path string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	conn, err := a.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		fileConn, err := openRawConn(path)
+		if err != nil {
+			return err
+		}
+		defer fileConn.Close()
+
+		return backupDatabase(ctx, fileConn, driverConn.(*sqlite3.SQLiteConn))
+	})
+}
+
+// Replaces the rows in the state, history and audit tables with those in the same tables of the database at path.
+func (a *sqliteDBAccess) restoreStateFromFile(parentCtx context.Context, path string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	conn, err := a.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Databases can't be attached inside a transaction
+	_, err = conn.ExecContext(ctx, attachSnapshotStmt, path)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), detachSnapshotStmt) //nolint:errcheck
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range a.replicatedTables() {
+		_, err = tx.Exec(fmt.Sprintf(truncateTableTpl, table))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf(restoreFromSnapshotTpl, table, table))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// raftLogWriter sends the logs of the Raft library to the component's logger.
+type raftLogWriter struct {
+	logger logger.Logger
+}
+
+func (w *raftLogWriter) Write(p []byte) (int, error) {
+	w.logger.Debug(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// raftLogStore implements raft.LogStore and raft.StableStore, keeping the Raft log and the node's Raft state in a SQLite database.
+// This is a separate database from the one containing the state, which is rebuilt from the log.
+type raftLogStore struct {
+	db *sql.DB
+}
+
+func newRaftLogStore(path string) (*raftLogStore, error) {
+	// Raft requires the log to be durable
+	pragmas := pragmaSettings{
+		journalMode: "WAL",
+		synchronous: "FULL",
+	}
+	db := sql.OpenDB(newSqliteConnector(connectionStringWithBusyTimeout(path, defaultBusyTimeout), pragmas))
+	_, err := db.Exec(createRaftTablesStmt)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &raftLogStore{db: db}, nil
+}
+
+func (s *raftLogStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *raftLogStore) FirstIndex() (idx uint64, err error) {
+	err = s.db.QueryRow(raftFirstIndexStmt).Scan(&idx)
+	return idx, err
+}
+
+func (s *raftLogStore) LastIndex() (idx uint64, err error) {
+	err = s.db.QueryRow(raftLastIndexStmt).Scan(&idx)
+	return idx, err
+}
+
+func (s *raftLogStore) GetLog(index uint64, log *raft.Log) error {
+	var appendedAt int64
+	err := s.db.QueryRow(raftGetLogStmt, index).
+		Scan(&log.Term, &log.Type, &log.Data, &log.Extensions, &appendedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return raft.ErrLogNotFound
+	} else if err != nil {
+		return err
+	}
+	log.Index = index
+	log.AppendedAt = time.Unix(0, appendedAt)
+	return nil
+}
+
+func (s *raftLogStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+func (s *raftLogStore) StoreLogs(logs []*raft.Log) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, log := range logs {
+		_, err = tx.Exec(raftStoreLogStmt, log.Index, log.Term, log.Type, log.Data, log.Extensions, log.AppendedAt.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *raftLogStore) DeleteRange(min uint64, max uint64) error {
+	_, err := s.db.Exec(raftDeleteRangeStmt, min, max)
+	return err
+}
+
+func (s *raftLogStore) Set(key []byte, val []byte) error {
+	_, err := s.db.Exec(raftSetStableStmt, key, val)
+	return err
+}
+
+func (s *raftLogStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.db.QueryRow(raftGetStableStmt, key).Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Raft checks for this error message
+		return nil, errors.New("not found")
+	}
+	return val, err
+}
+
+func (s *raftLogStore) SetUint64(key []byte, val uint64) error {
+	_, err := s.db.Exec(raftSetStableStmt, key, val)
+	return err
+}
+
+func (s *raftLogStore) GetUint64(key []byte) (uint64, error) {
+	var val uint64
+	err := s.db.QueryRow(raftGetStableStmt, key).Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return val, err
+}
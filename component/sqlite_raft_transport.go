@@ -0,0 +1,162 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// The first byte sent on each connection identifies what it's used for.
+const (
+	raftConnRaft    byte = 'R'
+	raftConnForward byte = 'F'
+)
+
+var errRaftLayerClosed = errors.New("raft stream layer is closed")
+
+// raftStreamLayer implements raft.StreamLayer on top of a TCP listener.
+// The listener is shared by Raft RPCs and by requests that followers forward to the leader.
+// With a TLS configuration, connections use mutual TLS, so only nodes with a certificate signed by the cluster's CA can connect.
+type raftStreamLayer struct {
+	listener  net.Listener
+	advertise net.Addr
+	tlsConfig *tls.Config
+	raftConns chan net.Conn
+	forward   func(conn net.Conn)
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newRaftStreamLayer(bindAddress string, advertise net.Addr, tlsConfig *tls.Config, forward func(conn net.Conn)) (*raftStreamLayer, error) {
+	listener, err := net.Listen("tcp", bindAddress)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	l := &raftStreamLayer{
+		listener:  listener,
+		advertise: advertise,
+		tlsConfig: tlsConfig,
+		raftConns: make(chan net.Conn),
+		forward:   forward,
+		closed:    make(chan struct{}),
+	}
+	go l.serve()
+	return l, nil
+}
+
+func (l *raftStreamLayer) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			// The listener was closed
+			return
+		}
+		go l.route(conn)
+	}
+}
+
+// Reads the first byte of the connection and hands it over to Raft or to the forwarding handler.
+// With TLS, the handshake happens on this first read, so peers without a valid certificate are rejected here.
+func (l *raftStreamLayer) route(conn net.Conn) {
+	var b [1]byte
+	_ = conn.SetReadDeadline(time.Now().Add(raftHandshakeTimeout))
+	_, err := io.ReadFull(conn, b[:])
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	switch b[0] {
+	case raftConnRaft:
+		select {
+		case l.raftConns <- conn:
+		case <-l.closed:
+			conn.Close()
+		}
+	case raftConnForward:
+		l.forward(conn)
+	default:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection for Raft.
+func (l *raftStreamLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.raftConns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errRaftLayerClosed
+	}
+}
+
+func (l *raftStreamLayer) Close() (err error) {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.listener.Close()
+	})
+	return err
+}
+
+// Addr returns the address other nodes use to connect to this one.
+func (l *raftStreamLayer) Addr() net.Addr {
+	if l.advertise != nil {
+		return l.advertise
+	}
+	return l.listener.Addr()
+}
+
+// Dial opens a connection for Raft.
+func (l *raftStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return l.dial(address, timeout, raftConnRaft)
+}
+
+func (l *raftStreamLayer) dial(address raft.ServerAddress, timeout time.Duration, kind byte) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if l.tlsConfig != nil {
+		// The certificate of the peer must be valid for the host in its address
+		cfg := l.tlsConfig.Clone()
+		cfg.ServerName, _, err = net.SplitHostPort(string(address))
+		if err != nil {
+			return nil, err
+		}
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), cfg)
+	} else {
+		conn, err = net.DialTimeout("tcp", string(address), timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write([]byte{kind})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
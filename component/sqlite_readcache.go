@@ -0,0 +1,178 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// Returns the approximate memory used by a row in the read cache, including the key.
+func (r *currentValue) size(key string) int64 {
+	return int64(len(key)+len(r.value)+len(r.etag)+len(r.metadata.String)) + readCacheEntryOverhead
+}
+
+// An entry of the read cache.
+type readCacheEntry struct {
+	key string
+	row currentValue
+}
+
+// readCache is an in-memory LRU cache of the rows read by Get.
+// The store commits its writes on a dedicated connection, which invalidate the keys they change.
+// Before it's used, the cache is validated with the data_version of that connection, which only changes when another connection (such as another process) commits a change, so it never returns rows that changed.
+type readCache struct {
+	maxEntries int
+	maxBytes   int64
+	// Connection used for all the writes of the store and to read the data_version.
+	conn *sql.Conn
+
+	lock        sync.Mutex
+	entries     map[string]*list.Element
+	lru         *list.List
+	bytes       int64
+	dataVersion int64
+}
+
+// Returns the read cache configured in the metadata, or nil if it's not enabled.
+func parseReadCache(metadata state.Metadata) (*readCache, error) {
+	maxEntries, err := parseLimitProperty(metadata, readCacheMaxEntriesKey)
+	if err != nil {
+		return nil, err
+	}
+	maxBytes, err := parseLimitProperty(metadata, readCacheMaxBytesKey)
+	if err != nil {
+		return nil, err
+	}
+	if maxEntries == 0 && maxBytes == 0 {
+		return nil, nil
+	}
+	return &readCache{
+		maxEntries:  int(maxEntries),
+		maxBytes:    maxBytes,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+		dataVersion: -1,
+	}, nil
+}
+
+// Opens the connection used for writes and to validate the cache.
+func (c *readCache) open(ctx context.Context, db *sql.DB) (err error) {
+	c.conn, err = db.Conn(ctx)
+	return err
+}
+
+func (c *readCache) close() {
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// Returns the cached row of a key, if any, and the data_version the cache is valid for, which must be passed to put.
+// If the database changed since the cache was last validated, the cache is cleared.
+func (c *readCache) get(parentCtx context.Context, key string, timeout time.Duration) (*currentValue, int64, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	var version int64
+	err := c.conn.QueryRowContext(ctx, dataVersionStmt).Scan(&version)
+	cancel()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to validate the read cache: %w", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// The data_version only increases, but concurrent reads may see it out of order; an older one is never accepted by put
+	if version > c.dataVersion {
+		c.clear()
+		c.dataVersion = version
+	} else if version < c.dataVersion {
+		return nil, version, nil
+	}
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, version, nil
+	}
+	e := el.Value.(*readCacheEntry)
+	if e.row.expiration.Valid && !e.row.expiration.Time.After(time.Now()) {
+		c.remove(el)
+		return nil, version, nil
+	}
+	c.lru.MoveToFront(el)
+	// The value is copied, so the cached row isn't modified through the response
+	row := e.row
+	row.value = append([]byte(nil), e.row.value...)
+	return &row, version, nil
+}
+
+// Adds a row read from the database, unless the cache was cleared since the version was returned by get.
+func (c *readCache) put(key string, row currentValue, version int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if version != c.dataVersion {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	size := row.size(key)
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return
+	}
+
+	row.value = append([]byte(nil), row.value...)
+	c.entries[key] = c.lru.PushFront(&readCacheEntry{key: key, row: row})
+	c.bytes += size
+	for (c.maxEntries > 0 && len(c.entries) > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Removes the row of a key that is written.
+func (c *readCache) invalidate(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *readCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*readCacheEntry)
+	delete(c.entries, e.key)
+	c.bytes -= e.row.size(e.key)
+}
+
+func (c *readCache) clear() {
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.bytes = 0
+}
+
+// Removes the row of a key from the read cache, if it's enabled.
+func (a *sqliteDBAccess) invalidateCachedRow(key string) {
+	if a.readCache != nil {
+		a.readCache.invalidate(key)
+	}
+}
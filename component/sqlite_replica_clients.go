@@ -0,0 +1,211 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// ReplicaClient is the interface for destinations the database is replicated to.
+// Object names are slash-separated paths.
+type ReplicaClient interface {
+	// WriteObject stores an object, replacing it if it exists already.
+	WriteObject(ctx context.Context, name string, data io.Reader, size int64) error
+	// ReadObject returns the content of an object.
+	ReadObject(ctx context.Context, name string) (io.ReadCloser, error)
+	// ListObjects returns the names of all objects whose name begins with prefix.
+	ListObjects(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Factories for the replica clients that can be selected with the "replicaType" metadata property.
+var replicaClientFactories = map[string]func(metadata state.Metadata) (ReplicaClient, error){
+	"local": newLocalReplicaClient,
+	"s3":    newS3ReplicaClient,
+}
+
+// Returns the replica client selected in the metadata, or nil if replication is disabled.
+func parseReplicaClient(metadata state.Metadata) (ReplicaClient, error) {
+	replicaType := strings.ToLower(metadata.Properties[replicaTypeKey])
+	if replicaType == "" {
+		return nil, nil
+	}
+
+	factory, ok := replicaClientFactories[replicaType]
+	if !ok {
+		return nil, fmt.Errorf("invalid %s: %s", replicaTypeKey, metadata.Properties[replicaTypeKey])
+	}
+	return factory(metadata)
+}
+
+// localReplicaClient stores replicas in a local directory.
+type localReplicaClient struct {
+	dir string
+}
+
+func newLocalReplicaClient(metadata state.Metadata) (ReplicaClient, error) {
+	dir := metadata.Properties[replicaPathKey]
+	if dir == "" {
+		return nil, fmt.Errorf("missing %s", replicaPathKey)
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replica directory: %w", err)
+	}
+	return &localReplicaClient{dir: dir}, nil
+}
+
+func (c *localReplicaClient) WriteObject(_ context.Context, name string, data io.Reader, _ int64) error {
+	dest := filepath.Join(c.dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(dest), 0o755)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see partial objects
+	f, err := os.CreateTemp(filepath.Dir(dest), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dest)
+}
+
+func (c *localReplicaClient) ReadObject(_ context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(c.dir, filepath.FromSlash(name)))
+}
+
+func (c *localReplicaClient) ListObjects(_ context.Context, prefix string) ([]string, error) {
+	res := []string{}
+	err := filepath.WalkDir(c.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(c.dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			res = append(res, name)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return res, nil
+	}
+	return res, err
+}
+
+// s3ReplicaClient stores replicas in a bucket on S3 or a S3-compatible service.
+type s3ReplicaClient struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3ReplicaClient(metadata state.Metadata) (ReplicaClient, error) {
+	props := metadata.Properties
+	endpoint := props[replicaS3EndpointKey]
+	if endpoint == "" {
+		endpoint = defaultReplicaS3Endpoint
+	}
+	bucket := props[replicaS3BucketKey]
+	if bucket == "" {
+		return nil, fmt.Errorf("missing %s", replicaS3BucketKey)
+	}
+	region := props[replicaS3RegionKey]
+	if region == "" {
+		region = defaultReplicaS3Region
+	}
+	useSSL := true
+	if props[replicaS3UseSSLKey] != "" {
+		var err error
+		useSSL, err = parseBool(metadata, replicaS3UseSSLKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(props[replicaS3AccessKeyKey], props[replicaS3SecretKeyKey], ""),
+		Secure: useSSL,
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	return &s3ReplicaClient{
+		client: client,
+		bucket: bucket,
+		prefix: strings.Trim(props[replicaPathKey], "/"),
+	}, nil
+}
+
+func (c *s3ReplicaClient) WriteObject(ctx context.Context, name string, data io.Reader, size int64) error {
+	_, err := c.client.PutObject(ctx, c.bucket, path.Join(c.prefix, name), data, size, minio.PutObjectOptions{})
+	return err
+}
+
+func (c *s3ReplicaClient) ReadObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	return c.client.GetObject(ctx, c.bucket, path.Join(c.prefix, name), minio.GetObjectOptions{})
+}
+
+func (c *s3ReplicaClient) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	fullPrefix := prefix
+	if c.prefix != "" {
+		fullPrefix = c.prefix + "/" + prefix
+	}
+
+	res := []string{}
+	for obj := range c.client.ListObjects(ctx, c.bucket, minio.ListObjectsOptions{Prefix: fullPrefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		name := obj.Key
+		if c.prefix != "" {
+			name = strings.TrimPrefix(name, c.prefix+"/")
+		}
+		res = append(res, name)
+	}
+	return res, nil
+}
@@ -0,0 +1,694 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/dapr/components-contrib/state"
+	"github.com/dapr/kit/logger"
+)
+
+// Replication works by copying the WAL file of the database to a ReplicaClient, in the same way as Litestream.
+//
+// The replicator takes over checkpointing from SQLite, so frames can't be removed from the WAL before they have been copied.
+// The WAL is checkpointed (and truncated) once it grows larger than the wal_autocheckpoint threshold; the period between two checkpoints is an "index".
+// Replicas are organized in "generations", one for each time the component is started:
+//
+//	generations/<generation>/snapshots/<index>-<time>.db
+//	generations/<generation>/wal/<index>-<offset>-<time>.wal
+//
+// A snapshot contains the database at the beginning of an index, and WAL segments contain the committed frames added to the WAL of an index, starting at offset.
+// Restoring a replica means downloading a snapshot, then replaying the WAL segments of its generation that follow it.
+// All numbers in names are hex-encoded with a fixed width, so names can be sorted.
+
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+)
+
+var (
+	errCheckpointBusy = errors.New("could not complete the checkpoint because the database is busy")
+	errNoSnapshot     = errors.New("no snapshot found in the replica")
+)
+
+type replicator struct {
+	logger           logger.Logger
+	client           ReplicaClient
+	db               *sql.DB
+	dbPath           string
+	syncInterval     time.Duration
+	snapshotInterval time.Duration
+	checkpointPages  int64
+	timeout          time.Duration
+
+	// Lock of the sqliteDBAccess object, which is held while reading the WAL and checkpointing, so no write is happening at the same time.
+	dbLock *sync.Mutex
+
+	// Connection used to checkpoint the database and take snapshots. It also keeps the WAL from being deleted when all other connections are closed.
+	conn *sql.Conn
+
+	// Fields below are protected by mu.
+	mu           sync.Mutex
+	generation   string
+	index        uint64
+	offset       int64
+	salt         []byte
+	lastSnapshot time.Time
+	// True if the snapshot that begins the generation couldn't be taken, so no frame can be shipped until it is.
+	generationPending bool
+
+	wg sync.WaitGroup
+}
+
+// Parsed list of objects in a generation.
+type replicaGeneration struct {
+	name      string
+	snapshots []replicaObject
+	segments  []replicaObject
+}
+
+// Parsed name of a snapshot or WAL segment.
+type replicaObject struct {
+	name   string
+	index  uint64
+	offset int64
+	time   time.Time
+}
+
+func (a *sqliteDBAccess) newReplicator(metadata state.Metadata, client ReplicaClient) (*replicator, error) {
+	r := &replicator{
+		logger:  a.logger,
+		client:  client,
+		dbLock:  a.lock,
+		dbPath:  dbFilePath(a.connectionString),
+		timeout: a.timeout,
+	}
+
+	var err error
+	r.syncInterval, err = parseDurationProperty(metadata, replicaSyncIntervalKey, defaultReplicaSyncInterval)
+	if err != nil {
+		return nil, err
+	}
+	r.snapshotInterval, err = parseDurationProperty(metadata, replicaSnapshotIntervalKey, defaultReplicaSnapshotInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.dbPath == "" || r.dbPath == ":memory:" || strings.Contains(a.connectionString, "mode=memory") {
+		return nil, errors.New("replication requires a database stored in a file")
+	}
+
+	// The replicator checkpoints the database itself, using the wal_autocheckpoint threshold.
+	r.checkpointPages = defaultReplicaCheckpointPages
+	if a.pragmas.walAutocheckpoint != "" {
+		r.checkpointPages, _ = strconv.ParseInt(a.pragmas.walAutocheckpoint, 10, 64)
+	}
+	a.pragmas.walAutocheckpoint = "0"
+	if a.pragmas.journalMode != "" && a.pragmas.journalMode != "WAL" {
+		a.logger.Warnf("Ignoring journal_mode=%s: replication requires WAL mode", a.pragmas.journalMode)
+	}
+	a.pragmas.journalMode = "WAL"
+
+	return r, nil
+}
+
+// Starts a new generation, then replicates the database in background until ctx is canceled.
+func (r *replicator) start(ctx context.Context, db *sql.DB) error {
+	r.db = db
+
+	var err error
+	r.conn, err = db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	err = r.skipBusyCheckpoint(r.startGeneration(ctx))
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to start replication: %w", err)
+	}
+
+	r.logger.Infof("Replicating database every %v, with snapshots every %v (generation %s)", r.syncInterval, r.snapshotInterval, r.generation)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(r.syncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := r.sync(ctx)
+				if err != nil {
+					r.logger.Errorf("Error replicating database: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Waits for the background replication to stop (after the context passed to start is canceled), then replicates the last changes.
+func (r *replicator) stop() error {
+	r.wg.Wait()
+	if r.conn == nil {
+		return nil
+	}
+
+	err := r.sync(context.Background())
+	_ = r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+// Replicates the frames added to the WAL since the last sync, and takes a snapshot if it's due.
+func (r *replicator) sync(parentCtx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(parentCtx, r.timeout)
+	defer cancel()
+
+	if r.generationPending {
+		return r.skipBusyCheckpoint(r.startGeneration(ctx))
+	}
+
+	// Read new frames while holding the lock, but upload them without blocking writes
+	r.dbLock.Lock()
+	segment, reset, err := r.readWAL()
+	r.dbLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if reset {
+		r.logger.Warn("The WAL was reset by another process; starting a new replication generation")
+		return r.skipBusyCheckpoint(r.startGeneration(ctx))
+	}
+	err = r.uploadSegment(ctx, segment)
+	if err != nil {
+		return err
+	}
+
+	if time.Since(r.lastSnapshot) >= r.snapshotInterval {
+		return r.skipBusyCheckpoint(r.snapshot(ctx, true))
+	}
+
+	// A non-positive threshold means that the WAL is checkpointed only when taking snapshots
+	if r.checkpointPages <= 0 || r.offset < r.checkpointPages*int64(segment.pageSize+walFrameHeaderSize) {
+		return nil
+	}
+
+	r.dbLock.Lock()
+	defer r.dbLock.Unlock()
+	return r.skipBusyCheckpoint(r.shipAndCheckpoint(ctx))
+}
+
+// Returns nil if err is because the checkpoint was busy, so it's attempted again at the next sync instead of failing.
+func (r *replicator) skipBusyCheckpoint(err error) error {
+	if errors.Is(err, errCheckpointBusy) {
+		r.logger.Debugf("%v; trying again at the next sync", err)
+		return nil
+	}
+	return err
+}
+
+// Starts a new generation, which begins with a snapshot.
+// Must be invoked while holding r.mu.
+func (r *replicator) startGeneration(ctx context.Context) error {
+	r.generation = fmt.Sprintf("%016x", time.Now().UnixNano())
+	r.index = 0
+	r.offset = 0
+	r.salt = nil
+
+	// Frames already in the WAL belong to the previous generation, so they are not shipped
+	err := r.snapshot(ctx, false)
+	r.generationPending = err != nil
+	return err
+}
+
+// Checkpoints the database and uploads a copy of it, which is the beginning of a new index.
+// Must be invoked while holding r.mu.
+func (r *replicator) snapshot(ctx context.Context, ship bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(r.dbPath), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	r.dbLock.Lock()
+	if ship {
+		err = r.shipAndCheckpoint(ctx)
+	} else {
+		err = r.checkpoint(ctx)
+	}
+	if err == nil {
+		err = r.conn.Raw(func(driverConn any) error {
+			tmpConn, err := openRawConn(tmp.Name())
+			if err != nil {
+				return err
+			}
+			defer tmpConn.Close()
+
+			return backupDatabase(ctx, tmpConn, driverConn.(*sqlite3.SQLiteConn))
+		})
+	}
+	r.dbLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to take snapshot: %w", err)
+	}
+
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("generations/%s/snapshots/%016x-%016x.db", r.generation, r.index, now.UnixNano())
+	err = r.client.WriteObject(ctx, name, f, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to upload snapshot: %w", err)
+	}
+
+	r.lastSnapshot = now
+	r.logger.Debugf("Uploaded snapshot %s", name)
+	return nil
+}
+
+// Uploads the frames in the WAL that haven't been replicated yet, then checkpoints the database.
+// Must be invoked while holding r.mu and r.dbLock.
+func (r *replicator) shipAndCheckpoint(ctx context.Context) error {
+	segment, reset, err := r.readWAL()
+	if err != nil {
+		return err
+	}
+	if reset {
+		return errors.New("the WAL was reset by another process")
+	}
+	err = r.uploadSegment(ctx, segment)
+	if err != nil {
+		return err
+	}
+	return r.checkpoint(ctx)
+}
+
+// Checkpoints the database and truncates the WAL, which begins a new index.
+// Must be invoked while holding r.mu and r.dbLock.
+func (r *replicator) checkpoint(ctx context.Context) error {
+	var busy, logFrames, checkpointed int
+	err := r.conn.QueryRowContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed)
+	if isBusyError(err) {
+		return errCheckpointBusy
+	} else if err != nil {
+		return err
+	}
+	if busy != 0 {
+		return errCheckpointBusy
+	}
+
+	r.index++
+	r.offset = 0
+	r.salt = nil
+	return nil
+}
+
+// Committed frames read from the WAL.
+type walSegment struct {
+	data     []byte
+	offset   int64
+	salt     []byte
+	pageSize int
+}
+
+// Reads the committed frames that were added to the WAL since the last time it was replicated.
+// If the WAL was reset by someone else, it returns true and the replica can't be continued.
+// Must be invoked while holding r.mu and r.dbLock.
+func (r *replicator) readWAL() (segment walSegment, reset bool, err error) {
+	segment.offset = r.offset
+
+	f, err := os.Open(r.dbPath + "-wal")
+	if errors.Is(err, os.ErrNotExist) {
+		return segment, r.offset > 0, nil
+	} else if err != nil {
+		return segment, false, err
+	}
+	defer f.Close()
+
+	// Frames are only appended to the WAL while holding the lock, so the file is not changing
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return segment, false, err
+	}
+	if len(data) < walHeaderSize {
+		return segment, r.offset > 0, nil
+	}
+
+	segment.salt = data[16:24]
+	segment.pageSize = int(binary.BigEndian.Uint32(data[8:12]))
+	if segment.pageSize == 1 {
+		segment.pageSize = 65536
+	}
+	if r.offset > 0 && (!bytes.Equal(segment.salt, r.salt) || int64(len(data)) < r.offset) {
+		return segment, true, nil
+	}
+
+	// Find the last frame that commits a transaction; frames after that belong to transactions that are in progress or were rolled back
+	start := r.offset
+	if start == 0 {
+		start = walHeaderSize
+	}
+	end := r.offset
+	frameSize := int64(walFrameHeaderSize + segment.pageSize)
+	for pos := start; pos+frameSize <= int64(len(data)); pos += frameSize {
+		frameHeader := data[pos : pos+walFrameHeaderSize]
+		if !bytes.Equal(frameHeader[8:16], segment.salt) {
+			break
+		}
+		if binary.BigEndian.Uint32(frameHeader[4:8]) != 0 {
+			end = pos + frameSize
+		}
+	}
+
+	if end > r.offset {
+		segment.data = data[r.offset:end]
+	}
+	return segment, false, nil
+}
+
+// Uploads a segment read from the WAL, if it's not empty.
+// Must be invoked while holding r.mu.
+func (r *replicator) uploadSegment(ctx context.Context, segment walSegment) error {
+	if len(segment.data) == 0 {
+		return nil
+	}
+
+	name := fmt.Sprintf("generations/%s/wal/%016x-%016x-%016x.wal", r.generation, r.index, segment.offset, time.Now().UnixNano())
+	err := r.client.WriteObject(ctx, name, bytes.NewReader(segment.data), int64(len(segment.data)))
+	if err != nil {
+		return fmt.Errorf("failed to upload WAL segment: %w", err)
+	}
+
+	r.offset = segment.offset + int64(len(segment.data))
+	r.salt = append([]byte(nil), segment.salt...)
+	return nil
+}
+
+// Rebuilds the database at dbPath from the replica.
+// If target is the zero time, the database is restored to the latest state; otherwise, to the latest state that was replicated before target.
+func restoreReplica(ctx context.Context, log logger.Logger, client ReplicaClient, dbPath string, target time.Time) error {
+	generations, err := listReplicaGenerations(ctx, client)
+	if err != nil {
+		return fmt.Errorf("failed to list replicas: %w", err)
+	}
+
+	// Find the most recent snapshot taken before the target
+	var (
+		gen      *replicaGeneration
+		snapshot *replicaObject
+	)
+	for _, g := range generations {
+		for i := range g.snapshots {
+			s := &g.snapshots[i]
+			if (target.IsZero() || !s.time.After(target)) && (snapshot == nil || s.time.After(snapshot.time)) {
+				gen = g
+				snapshot = s
+			}
+		}
+	}
+	if snapshot == nil {
+		return errNoSnapshot
+	}
+
+	log.Infof("Restoring database from snapshot %s", snapshot.name)
+	tmpPath := dbPath + ".restore"
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err = os.Remove(tmpPath + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	err = downloadReplicaObject(ctx, client, snapshot.name, tmpPath)
+	if err != nil {
+		return err
+	}
+	err = execRawConn(tmpPath, "PRAGMA journal_mode = WAL")
+	if err != nil {
+		return err
+	}
+
+	// Replay the WAL segments that follow the snapshot, one index at a time
+	applied := 0
+	var (
+		index  = snapshot.index
+		offset int64
+		wal    *os.File
+	)
+	replayWAL := func() error {
+		if wal == nil {
+			return nil
+		}
+		err := wal.Close()
+		wal = nil
+		if err != nil {
+			return err
+		}
+		return execRawConn(tmpPath, "PRAGMA wal_checkpoint(TRUNCATE)")
+	}
+	for _, s := range gen.segments {
+		if s.index < snapshot.index || (!target.IsZero() && s.time.After(target)) {
+			continue
+		}
+		if s.index != index {
+			err = replayWAL()
+			if err != nil {
+				return err
+			}
+			index = s.index
+			offset = 0
+		}
+		if s.offset != offset {
+			log.Warnf("WAL segments are not contiguous after %s; stopping the restore there", s.name)
+			break
+		}
+
+		if wal == nil {
+			wal, err = os.Create(tmpPath + "-wal")
+			if err != nil {
+				return err
+			}
+		}
+		rc, err := client.ReadObject(ctx, s.name)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(wal, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		offset += n
+		applied++
+	}
+	err = replayWAL()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, dbPath)
+	if err != nil {
+		return err
+	}
+	log.Infof("Restored database to '%s' applying %d WAL segments", dbPath, applied)
+	return nil
+}
+
+// Returns the generations in the replica, sorted by name.
+func listReplicaGenerations(ctx context.Context, client ReplicaClient) ([]*replicaGeneration, error) {
+	names, err := client.ListObjects(ctx, "generations/")
+	if err != nil {
+		return nil, err
+	}
+
+	generations := map[string]*replicaGeneration{}
+	for _, name := range names {
+		parts := strings.Split(name, "/")
+		if len(parts) != 4 {
+			continue
+		}
+		obj, ok := parseReplicaObjectName(name, parts[3])
+		if !ok {
+			continue
+		}
+
+		gen := generations[parts[1]]
+		if gen == nil {
+			gen = &replicaGeneration{name: parts[1]}
+			generations[parts[1]] = gen
+		}
+		switch parts[2] {
+		case "snapshots":
+			gen.snapshots = append(gen.snapshots, obj)
+		case "wal":
+			gen.segments = append(gen.segments, obj)
+		}
+	}
+
+	res := make([]*replicaGeneration, 0, len(generations))
+	for _, gen := range generations {
+		sort.Slice(gen.segments, func(i, j int) bool {
+			if gen.segments[i].index != gen.segments[j].index {
+				return gen.segments[i].index < gen.segments[j].index
+			}
+			return gen.segments[i].offset < gen.segments[j].offset
+		})
+		res = append(res, gen)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].name < res[j].name
+	})
+	return res, nil
+}
+
+// Parses names in the format "<index>-<time>.db" (snapshots) or "<index>-<offset>-<time>.wal" (WAL segments).
+func parseReplicaObjectName(name string, base string) (obj replicaObject, ok bool) {
+	obj.name = name
+	var parts []string
+	switch {
+	case strings.HasSuffix(base, ".db"):
+		parts = strings.Split(strings.TrimSuffix(base, ".db"), "-")
+		if len(parts) != 2 {
+			return obj, false
+		}
+		parts = []string{parts[0], "0", parts[1]}
+	case strings.HasSuffix(base, ".wal"):
+		parts = strings.Split(strings.TrimSuffix(base, ".wal"), "-")
+		if len(parts) != 3 {
+			return obj, false
+		}
+	default:
+		return obj, false
+	}
+
+	var (
+		nums [3]uint64
+		err  error
+	)
+	for i, p := range parts {
+		nums[i], err = strconv.ParseUint(p, 16, 64)
+		if err != nil {
+			return obj, false
+		}
+	}
+	obj.index = nums[0]
+	obj.offset = int64(nums[1])
+	obj.time = time.Unix(0, int64(nums[2]))
+	return obj, true
+}
+
+func downloadReplicaObject(ctx context.Context, client ReplicaClient, name string, dest string) error {
+	rc, err := client.ReadObject(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rc)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Opens a connection to a database file, executes a statement, then closes the connection.
+func execRawConn(dsn string, stmt string) error {
+	conn, err := openRawConn(dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Exec(stmt, nil)
+	return err
+}
+
+// Returns the path of the database file from the connection string.
+func dbFilePath(connString string) string {
+	p := strings.TrimPrefix(connString, "file:")
+	if idx := strings.IndexRune(p, '?'); idx >= 0 {
+		p = p[:idx]
+	}
+	return p
+}
+
+// Returns the restore target from the metadata: nil if the database should not be restored, the zero time to restore the latest state, or a point in time.
+func parseReplicaRestore(metadata state.Metadata) (*time.Time, error) {
+	s := metadata.Properties[replicaRestoreKey]
+	switch s {
+	case "":
+		return nil, nil
+	case "latest":
+		return &time.Time{}, nil
+	default:
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("illegal %s value: %s", replicaRestoreKey, s)
+		}
+		return &t, nil
+	}
+}
+
+// Returns the value of a duration metadata property, or def if not set.
+func parseDurationProperty(metadata state.Metadata, key string, def time.Duration) (time.Duration, error) {
+	s, ok := metadata.Properties[key]
+	if !ok || s == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("illegal %s value: %s", key, s)
+	}
+	return d, nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/dapr/components-contrib/state"
+	"github.com/dapr/kit/retry"
+)
+
+// executeInTransaction runs fn in a new transaction and commits it.
+// If the database is busy or locked by another connection, the whole transaction is retried with exponential backoff until ctx is done.
+// Errors returned by SQLite are converted into StoreError objects.
+func (a *sqliteDBAccess) executeInTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	var (
+		attempts int
+		lastErr  error
+	)
+	err := backoff.RetryNotify(
+		func() error {
+			attempts++
+			lastErr = a.executeTransactionOnce(ctx, fn)
+			if lastErr != nil && !isBusyError(lastErr) {
+				return backoff.Permanent(lastErr)
+			}
+			return lastErr
+		},
+		a.busyRetry.NewBackOffWithContext(ctx),
+		func(err error, d time.Duration) {
+			a.logger.Debugf("Database is busy, retrying in %v: %v", d, err)
+		},
+	)
+	if err != nil && isBusyError(lastErr) {
+		// Return the error from SQLite rather than the one from the context, which is less informative
+		return classifyError(fmt.Errorf("database is still busy after %d attempts: %w", attempts, lastErr))
+	}
+	return classifyError(err)
+}
+
+func (a *sqliteDBAccess) executeTransactionOnce(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := a.beginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Begins a write transaction, which must be done with the lock held.
+// With the read cache, writes are committed on its connection, so they don't change the data_version it's validated with.
+func (a *sqliteDBAccess) beginTx(ctx context.Context) (*sql.Tx, error) {
+	if a.readCache != nil && a.readCache.conn != nil {
+		return a.readCache.conn.BeginTx(ctx, nil)
+	}
+	return a.db.BeginTx(ctx, nil)
+}
+
+// Returns true if the error is SQLITE_BUSY or SQLITE_LOCKED, which means that the operation can be retried.
+func isBusyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// Returns the timeout for each operation.
+func parseTimeout(metadata state.Metadata) (time.Duration, error) {
+	s, ok := metadata.Properties[timeoutKey]
+	if !ok || s == "" {
+		return defaultTimeout, nil
+	}
+
+	timeoutInSec, err := strconv.ParseInt(s, 10, 0)
+	if err != nil || timeoutInSec <= 0 {
+		return 0, fmt.Errorf("illegal %s value: %s", timeoutKey, s)
+	}
+	return time.Duration(timeoutInSec) * time.Second, nil
+}
+
+// Returns the duration SQLite waits for a lock held by another connection before failing with SQLITE_BUSY.
+func parseBusyTimeout(metadata state.Metadata) (time.Duration, error) {
+	s, ok := metadata.Properties[busyTimeoutKey]
+	if !ok || s == "" {
+		return defaultBusyTimeout, nil
+	}
+
+	busyTimeout, err := time.ParseDuration(s)
+	if err != nil || busyTimeout < 0 {
+		return 0, fmt.Errorf("illegal %s value: %s", busyTimeoutKey, s)
+	}
+	return busyTimeout, nil
+}
+
+// Returns the backoff policy used when retrying operations that failed with SQLITE_BUSY or SQLITE_LOCKED.
+// Retries are bounded by the operation's timeout, so there's no limit on the number of attempts by default.
+func parseBusyRetryConfig(metadata state.Metadata) (retry.Config, error) {
+	cfg := retry.DefaultConfig()
+	cfg.Policy = retry.PolicyExponential
+	cfg.InitialInterval = defaultBusyRetryInterval
+	cfg.MaxInterval = defaultBusyRetryMaxInterval
+	cfg.MaxElapsedTime = 0
+
+	err := retry.DecodeConfigWithPrefix(&cfg, metadata.Properties, busyRetryPrefix)
+	if err != nil {
+		return cfg, fmt.Errorf("illegal %s configuration: %w", busyRetryPrefix, err)
+	}
+	return cfg, nil
+}
+
+// Adds the busy timeout to the connection string, unless the connection string sets one already.
+func connectionStringWithBusyTimeout(connString string, busyTimeout time.Duration) string {
+	var query url.Values
+	idx := strings.IndexRune(connString, '?')
+	if idx >= 0 {
+		// Ignore errors here: go-sqlite3 will report them when opening the database
+		query, _ = url.ParseQuery(connString[idx+1:])
+	}
+	if query.Has("_busy_timeout") || query.Has("_timeout") {
+		return connString
+	}
+
+	param := "_busy_timeout=" + strconv.FormatInt(busyTimeout.Milliseconds(), 10)
+	if idx < 0 {
+		return connString + "?" + param
+	}
+	return connString + "&" + param
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// SearchQuery is a full-text search of the values in the state store.
+type SearchQuery struct {
+	// Query in the FTS5 syntax, such as "shipped AND customer".
+	Query string
+	// If set, only keys that start with this prefix are returned.
+	KeyPrefix string
+	// Maximum number of results, which is 100 if not set.
+	Limit int
+}
+
+// SearchResult is a key whose value matches a SearchQuery.
+type SearchResult struct {
+	Key string
+	// Rank of the result, computed with BM25; lower values are better matches.
+	Rank float64
+	// Fragment of the value that matches the query, with the matching terms wrapped in <b> and </b>.
+	Snippet string
+}
+
+// ftsSettings contains what is indexed for full-text search.
+type ftsSettings struct {
+	// JSON paths of the indexed fields, or nil if the whole value is indexed.
+	fields []string
+}
+
+// searchDBAccess is implemented by DBAccess objects that support full-text search.
+type searchDBAccess interface {
+	search(ctx context.Context, q SearchQuery) ([]SearchResult, error)
+}
+
+// Returns the full-text search settings in the metadata, or nil if full-text search is disabled.
+func parseFTSSettings(metadata state.Metadata) (*ftsSettings, error) {
+	enabled, err := parseBool(metadata, fullTextSearchKey)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	res := &ftsSettings{}
+	for _, p := range strings.Split(metadata.Properties[fullTextSearchFieldsKey], ",") {
+		p = strings.TrimPrefix(strings.TrimSpace(p), "$.")
+		if p == "" {
+			continue
+		}
+		if !jsonPathRegexp.MatchString(p) {
+			return nil, fmt.Errorf("invalid JSON path in %s: %s", fullTextSearchFieldsKey, p)
+		}
+		res.fields = append(res.fields, "$."+p)
+	}
+	return res, nil
+}
+
+func (a *sqliteDBAccess) ftsTableName() string {
+	return a.tableName + ftsTableSuffix
+}
+
+// Returns the names of the triggers that keep the FTS table in sync, in the order they're created.
+func (a *sqliteDBAccess) ftsTriggerNames() []string {
+	prefix := a.ftsTableName()
+	return []string{prefix + "_insert_before", prefix + "_insert", prefix + "_update", prefix + "_delete"}
+}
+
+// Returns the SQL expression for the indexed content of a row.
+// row is the prefix of the columns, such as "new.", or empty.
+// Binary values are not indexed.
+func (a *sqliteDBAccess) ftsContentExpr(row string) string {
+	content := row + "value"
+	if len(a.fts.fields) > 0 {
+		parts := make([]string, len(a.fts.fields))
+		for i, field := range a.fts.fields {
+			parts[i] = fmt.Sprintf("coalesce(json_extract(%svalue, '%s'), '')", row, field)
+		}
+		content = strings.Join(parts, " || ' ' || ")
+	}
+	return fmt.Sprintf("CASE WHEN %sis_binary THEN NULL ELSE %s END", row, content)
+}
+
+// Creates the FTS table and the triggers that keep it in sync with the state table, or removes them if full-text search is disabled.
+// If the indexed fields changed, the content of the FTS table is rebuilt.
+func (a *sqliteDBAccess) syncFullTextSearch(parentCtx context.Context) error {
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	ftsTable := a.ftsTableName()
+	triggers := a.ftsTriggerNames()
+
+	exists, err := tableExists(ctx, a.db, ftsTable)
+	if err != nil {
+		return err
+	}
+
+	if a.fts == nil {
+		if !exists {
+			return nil
+		}
+		a.logger.Infof("Removing full-text search table '%s'", ftsTable)
+		return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+			for _, name := range triggers {
+				_, err := tx.Exec(fmt.Sprintf(dropTriggerTpl, name))
+				if err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(fmt.Sprintf(dropTableTpl, ftsTable))
+			return err
+		})
+	}
+
+	var available bool
+	err = a.db.QueryRowContext(ctx, fts5AvailableStmt).Scan(&available)
+	if err != nil {
+		return err
+	}
+	if !available {
+		return errors.New("full-text search requires SQLite with FTS5, which is enabled by building with the sqlite_fts5 tag")
+	}
+
+	stmts := []string{
+		fmt.Sprintf(createFTSInsertBeforeTriggerTpl, triggers[0], a.tableName, ftsTable),
+		fmt.Sprintf(createFTSInsertTriggerTpl, triggers[1], a.tableName, ftsTable, a.ftsContentExpr("new.")),
+		fmt.Sprintf(createFTSUpdateTriggerTpl, triggers[2], a.tableName, ftsTable, a.ftsContentExpr("new.")),
+		fmt.Sprintf(createFTSDeleteTriggerTpl, triggers[3], a.tableName, ftsTable),
+	}
+
+	// The SQL of the insert trigger contains the indexed fields, so if it changed, the content must be rebuilt
+	var current string
+	err = a.db.QueryRowContext(ctx, getTriggerStmt, triggers[1]).Scan(&current)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	rebuild := !exists || current != stmts[1]
+
+	// FTS tables created before the key column was added are linked by rowid, so they're created again
+	recreate := false
+	if exists {
+		hasKey, err := columnExists(ctx, a.db, ftsTable, "key")
+		if err != nil {
+			return err
+		}
+		recreate = !hasKey
+		rebuild = rebuild || recreate
+	}
+
+	return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		if recreate {
+			_, err := tx.Exec(fmt.Sprintf(dropTableTpl, ftsTable))
+			if err != nil {
+				return err
+			}
+		}
+		if !exists || recreate {
+			a.logger.Infof("Creating full-text search table '%s'", ftsTable)
+			_, err := tx.Exec(fmt.Sprintf(createFTSTableTpl, ftsTable))
+			if err != nil {
+				return err
+			}
+		}
+
+		for i, name := range triggers {
+			_, err := tx.Exec(fmt.Sprintf(dropTriggerTpl, name))
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(stmts[i])
+			if err != nil {
+				return fmt.Errorf("failed to create trigger '%s': %w", name, err)
+			}
+		}
+
+		if rebuild {
+			a.logger.Infof("Indexing the values in the state table '%s' for full-text search", a.tableName)
+			_, err := tx.Exec(fmt.Sprintf(truncateTableTpl, ftsTable))
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(fmt.Sprintf(rebuildFTSTpl, ftsTable, a.ftsContentExpr(""), a.tableName))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (a *sqliteDBAccess) search(parentCtx context.Context, q SearchQuery) ([]SearchResult, error) {
+	if a.fts == nil {
+		return nil, errors.New("full-text search is not enabled")
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	var filter string
+	if a.softDeleteGracePeriod > 0 {
+		filter = "AND s.deletion_time IS NULL"
+	}
+	stmt := fmt.Sprintf(searchTpl, a.ftsTableName(), a.tableName, filter)
+	rows, err := a.db.QueryContext(ctx, stmt, q.Query, q.KeyPrefix, q.KeyPrefix, searchLimit(q))
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer rows.Close()
+
+	res := []SearchResult{}
+	for rows.Next() {
+		var (
+			r       SearchResult
+			snippet sql.NullString
+		)
+		err = rows.Scan(&r.Key, &r.Rank, &snippet)
+		if err != nil {
+			return nil, err
+		}
+		r.Snippet = snippet.String
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+func searchLimit(q SearchQuery) int {
+	if q.Limit <= 0 {
+		return defaultSearchLimit
+	}
+	return q.Limit
+}
+
+// Sorts the results read from multiple databases by rank, and returns up to the limit of the query.
+func mergeSearchResults(results []SearchResult, q SearchQuery) []SearchResult {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Rank < results[j].Rank
+	})
+	if limit := searchLimit(q); len(results) > limit {
+		results = results[:limit]
+	}
+	if results == nil {
+		results = []SearchResult{}
+	}
+	return results
+}
+
+func (r *raftDBAccess) search(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	return r.local.search(ctx, q)
+}
+
+func (s *shardedDBAccess) search(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	var res []SearchResult
+	for _, shard := range s.shards {
+		results, err := shard.search(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, results...)
+	}
+	return mergeSearchResults(res, q), nil
+}
+
+func (t *tenantDBAccess) search(ctx context.Context, q SearchQuery) (res []SearchResult, err error) {
+	// If the prefix contains the tenant, only its database is searched
+	if _, tenantErr := t.tenantOf(q.KeyPrefix); tenantErr == nil {
+		err = t.withTenant(q.KeyPrefix, func(a *sqliteDBAccess) error {
+			res, err = a.search(ctx, q)
+			return err
+		})
+		return res, err
+	}
+
+	tenants, err := t.listTenants()
+	if err != nil {
+		return nil, err
+	}
+	for _, tenant := range tenants {
+		a, err := t.acquire(tenant)
+		if err != nil {
+			return nil, err
+		}
+		results, err := a.search(ctx, q)
+		t.release(tenant)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, results...)
+	}
+	return mergeSearchResults(res, q), nil
+}
+
+// Search returns the keys whose values match a full-text query, best matches first.
+func (s *SQLiteStore) Search(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	a, ok := s.dbaccess.(searchDBAccess)
+	if !ok {
+		return nil, errors.New("full-text search is not supported")
+	}
+	if q.Query == "" {
+		return nil, errors.New("missing query")
+	}
+	return a.search(ctx, q)
+}
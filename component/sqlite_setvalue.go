@@ -14,12 +14,14 @@ limitations under the License.
 package component
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -30,15 +32,41 @@ import (
 
 // Parsed Set Request.
 type setRequest struct {
-	tx        *sql.Tx
-	tableName string
+	tx    *sql.Tx
+	stmts *preparedStatements
 
 	key         string
 	value       string
 	isBinary    bool
 	ttlSeconds  *int64
+	slidingTTL  *int64
 	concurrency *string
 	etag        *string
+	softDelete  bool
+	// Persisted metadata, encoded as JSON.
+	metadata *string
+
+	// Absolute expiration time, which is used instead of ttlSeconds.
+	expireAt *time.Time
+	// True if the request has a TTL of -1, so the key doesn't get the default TTL.
+	noExpiration bool
+	ttlLimits    ttlLimits
+
+	// If true and the request has no TTL, the existing expiration time is kept when the row is updated with its ETag.
+	keepExpiration bool
+	// If true and the request has no persisted metadata, the existing metadata is kept when the row is updated with its ETag.
+	keepMetadata bool
+
+	// If set, used instead of a random ETag and of the current time.
+	newEtag string
+	now     time.Time
+}
+
+// writeContext contains the values a write would otherwise generate itself.
+// In clustered mode, they're chosen when the write is proposed, so it has the same effect on every node.
+type writeContext struct {
+	newETag string
+	now     time.Time
 }
 
 func prepareSetRequest(a *sqliteDBAccess, tx *sql.Tx, req *state.SetRequest) (*setRequest, error) {
@@ -60,6 +88,23 @@ func prepareSetRequest(a *sqliteDBAccess, tx *sql.Tx, req *state.SetRequest) (*s
 		return nil, fmt.Errorf("error in parsing TTL: %w", err)
 	}
 
+	// A sliding TTL sets the initial expiration like a TTL, and it's stored so reads can renew it
+	slidingTTL, err := parseSlidingTTL(req.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("error in parsing TTL: %w", err)
+	}
+	if slidingTTL != nil {
+		if maxTTL := a.ttlLimits.maxTTL; maxTTL > 0 && *slidingTTL > maxTTL {
+			slidingTTL = &maxTTL
+		}
+		ttlSeconds = slidingTTL
+	}
+
+	expireAt, err := parseExpireAt(req.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("error in parsing TTL: %w", err)
+	}
+
 	requestValue := req.Value
 	byteArray, isBinary := req.Value.([]uint8)
 	if isBinary {
@@ -73,52 +118,67 @@ func prepareSetRequest(a *sqliteDBAccess, tx *sql.Tx, req *state.SetRequest) (*s
 	}
 	value := string(bt)
 
+	metadata, err := a.persistedMetadata(req.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
 	return &setRequest{
-		tx:        tx,
-		tableName: a.tableName,
+		tx:    tx,
+		stmts: a.stmts,
 
 		key:         req.Key,
 		value:       value,
 		concurrency: &req.Options.Concurrency,
 		ttlSeconds:  ttlSeconds,
+		slidingTTL:  slidingTTL,
 		isBinary:    isBinary,
 		etag:        req.ETag,
+		softDelete:  a.softDeleteGracePeriod > 0,
+		metadata:    metadata,
+
+		expireAt:     expireAt,
+		noExpiration: req.Metadata[metadataTTLKey] == "-1",
+		ttlLimits:    a.ttlLimitsFor(req.Key),
 	}, nil
 }
 
-func (req *setRequest) setValue() (bool, error) {
-	etagObj, err := uuid.NewRandom()
-	if err != nil {
-		return false, err
+func (req *setRequest) setValue(ctx context.Context) (bool, error) {
+	if req.newEtag == "" {
+		etagObj, err := uuid.NewRandom()
+		if err != nil {
+			return false, err
+		}
+		req.newEtag = etagObj.String()
 	}
-	newEtag := etagObj.String()
+	newEtag := req.newEtag
+
+	var err error
 
 	// Only check for etag if FirstWrite specified (ref oracledatabaseaccess)
 	var res sql.Result
+	ts := req.timestamp()
 	if req.etag == nil || *req.etag == "" {
 		// Reset expiration time in case of an update
-		var expiration string
-		if req.ttlSeconds != nil {
-			expiration = fmt.Sprintf(expirationTpl, *req.ttlSeconds)
-		} else {
-			expiration = "NULL"
+		var expiration *int64
+		expiration, err = req.expiration()
+		if err != nil {
+			return false, err
 		}
-		// Sprintf is required for table name because sql.DB does not substitute parameters for table names.
-		// And the same is for DATETIME function's seconds parameter (which is from an integer anyways).
-		stmt := fmt.Sprintf(setValueTpl, req.tableName, expiration, req.tableName)
-		res, err = req.tx.Exec(stmt, req.key, req.value, req.isBinary, newEtag, req.key)
+		stmt := req.stmts.bind(ctx, req.tx, req.stmts.set)
+		res, err = stmt.Exec(req.key, req.value, req.isBinary, newEtag, req.metadata, req.slidingTTL, ts, expiration, req.key, ts)
 	} else {
 		// First write, existing record has to be updated
-		var expiration string
-		if req.ttlSeconds != nil {
-			expiration = fmt.Sprintf(expirationTpl, *req.ttlSeconds)
-		} else {
-			expiration = "NULL"
+		var expiration *int64
+		keepExpiration := req.keepExpiration && req.ttlSeconds == nil && req.expireAt == nil
+		if !keepExpiration {
+			expiration, err = req.expiration()
+			if err != nil {
+				return false, err
+			}
 		}
-		// Sprintf is required for table name because sql.DB does not substitute parameters for table names.
-		// And the same is for DATETIME function's seconds parameter (which is from an integer anyways).
-		stmt := fmt.Sprintf(setValueWithETagTpl, req.tableName, expiration)
-		res, err = req.tx.Exec(stmt, req.value, newEtag, req.isBinary, req.key, *req.etag)
+		stmt := req.stmts.bind(ctx, req.tx, req.stmts.setWithETag)
+		res, err = stmt.Exec(req.value, newEtag, req.isBinary, ts, keepExpiration, expiration, req.metadata, req.keepMetadata, req.slidingTTL, keepExpiration, req.key, *req.etag)
 	}
 
 	if err != nil {
@@ -0,0 +1,295 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dapr/components-contrib/state"
+	"github.com/dapr/kit/logger"
+)
+
+// shardedDBAccess implements DBAccess by distributing keys between multiple SQLite databases.
+// Each shard is a sqliteDBAccess object with its own connection pool and write lock, so writes to different shards run in parallel.
+type shardedDBAccess struct {
+	logger logger.Logger
+	shards []*sqliteDBAccess
+	ring   *hashRing
+}
+
+func newShardedDBAccess(logger logger.Logger) *shardedDBAccess {
+	return &shardedDBAccess{
+		logger: logger,
+	}
+}
+
+// Returns the number of shards in the metadata, or 0 if sharding is disabled.
+func parseShards(metadata state.Metadata) (int, error) {
+	s := metadata.Properties[shardsKey]
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("illegal %s value: %s", shardsKey, s)
+	}
+	return n, nil
+}
+
+// Init opens all shards.
+// The "{shard}" placeholder in metadata properties (such as the connection string) is replaced with the index of the shard.
+func (s *shardedDBAccess) Init(metadata state.Metadata) error {
+	n, err := parseShards(metadata)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("missing %s", shardsKey)
+	}
+
+	inMemory, err := parseMode(metadata)
+	if err != nil {
+		return err
+	}
+	if !inMemory && !strings.Contains(metadata.Properties[connectionStringKey], shardPlaceholder) {
+		return fmt.Errorf("the connection string must contain %s when using multiple shards", shardPlaceholder)
+	}
+
+	s.shards = make([]*sqliteDBAccess, n)
+	for i := range s.shards {
+		shard := newSqliteDBAccess(s.logger)
+		shard.name = "shard-" + strconv.Itoa(i)
+		err = shard.Init(replacePlaceholder(metadata, shardPlaceholder, strconv.Itoa(i)))
+		if err != nil {
+			shard.Close()
+			s.Close()
+			return fmt.Errorf("failed to initialize shard %d: %w", i, err)
+		}
+		s.shards[i] = shard
+	}
+	s.ring = newHashRing(n, defaultShardVirtualNodes)
+
+	s.logger.Infof("Distributing keys between %d shards", n)
+	return nil
+}
+
+// Returns a copy of the metadata with a placeholder replaced in all properties.
+func replacePlaceholder(metadata state.Metadata, placeholder string, value string) state.Metadata {
+	res := metadata
+	res.Properties = make(map[string]string, len(metadata.Properties))
+	for k, v := range metadata.Properties {
+		res.Properties[k] = strings.ReplaceAll(v, placeholder, value)
+	}
+	return res
+}
+
+func (s *shardedDBAccess) shardFor(key string) *sqliteDBAccess {
+	return s.shards[s.ring.get(key)]
+}
+
+func (s *shardedDBAccess) Ping(ctx context.Context) error {
+	for i, shard := range s.shards {
+		err := shard.Ping(ctx)
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (s *shardedDBAccess) Get(ctx context.Context, req *state.GetRequest) (*state.GetResponse, error) {
+	return s.shardFor(req.Key).Get(ctx, req)
+}
+
+func (s *shardedDBAccess) Set(ctx context.Context, req *state.SetRequest) error {
+	return s.shardFor(req.Key).Set(ctx, req)
+}
+
+func (s *shardedDBAccess) Delete(ctx context.Context, req *state.DeleteRequest) error {
+	return s.shardFor(req.Key).Delete(ctx, req)
+}
+
+// ExecuteMulti executes a transaction on the shard that contains all of its keys.
+// Transactions that span multiple shards are rejected, as SQLite can't commit them atomically.
+func (s *shardedDBAccess) ExecuteMulti(ctx context.Context, reqs []state.TransactionalStateOperation) error {
+	groups, err := s.groupByShard(reqs)
+	if err != nil {
+		return err
+	}
+	switch len(groups) {
+	case 0:
+		return nil
+	case 1:
+		for shard, ops := range groups {
+			err = s.shards[shard].ExecuteMulti(ctx, ops)
+		}
+		return err
+	default:
+		return errors.New("the transaction contains keys stored in different shards")
+	}
+}
+
+// executeBulk executes bulk operations, which don't need to be atomic, as one transaction per shard.
+// Shards are written to in parallel.
+func (s *shardedDBAccess) executeBulk(ctx context.Context, reqs []state.TransactionalStateOperation) error {
+	groups, err := s.groupByShard(reqs)
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		errs []error
+	)
+	for shard, ops := range groups {
+		wg.Add(1)
+		go func(shard int, ops []state.TransactionalStateOperation) {
+			defer wg.Done()
+			err := s.shards[shard].ExecuteMulti(ctx, ops)
+			if err != nil {
+				lock.Lock()
+				errs = append(errs, fmt.Errorf("shard %d: %w", shard, err))
+				lock.Unlock()
+			}
+		}(shard, ops)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// Groups operations by the shard of their key.
+func (s *shardedDBAccess) groupByShard(reqs []state.TransactionalStateOperation) (map[int][]state.TransactionalStateOperation, error) {
+	groups := map[int][]state.TransactionalStateOperation{}
+	for _, req := range reqs {
+		key, ok := operationKey(req)
+		if !ok {
+			switch req.Operation {
+			case state.Upsert, state.Delete, OperationPatch, OperationIncrement:
+				return nil, fmt.Errorf("expecting set, delete, patch or increment request")
+			}
+			// Do nothing
+			continue
+		}
+		shard := s.ring.get(key)
+		groups[shard] = append(groups[shard], req)
+	}
+	return groups, nil
+}
+
+// Close implements io.Close.
+func (s *shardedDBAccess) Close() error {
+	var err error
+	for i, shard := range s.shards {
+		if shard == nil {
+			continue
+		}
+		closeErr := shard.Close()
+		if closeErr != nil && err == nil {
+			err = fmt.Errorf("shard %d: %w", i, closeErr)
+		}
+	}
+	return err
+}
+
+func (s *shardedDBAccess) stats(ctx context.Context) ([]DatabaseStats, error) {
+	res := make([]DatabaseStats, 0, len(s.shards))
+	for _, shard := range s.shards {
+		stats, err := shard.stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, stats...)
+	}
+	return res, nil
+}
+
+func (s *shardedDBAccess) backup(ctx context.Context, dir string) ([]string, error) {
+	res := make([]string, 0, len(s.shards))
+	for _, shard := range s.shards {
+		files, err := shard.backup(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, files...)
+	}
+	return res, nil
+}
+
+// hashRing maps keys to shards with consistent hashing.
+// Each shard has multiple points on the ring, and a key belongs to the shard of the first point that follows the key's hash.
+type hashRing struct {
+	points []uint64
+	shards map[uint64]int
+}
+
+func newHashRing(shards int, virtualNodes int) *hashRing {
+	r := &hashRing{
+		points: make([]uint64, 0, shards*virtualNodes),
+		shards: make(map[uint64]int, shards*virtualNodes),
+	}
+	for shard := 0; shard < shards; shard++ {
+		for v := 0; v < virtualNodes; v++ {
+			h := hashKey("shard-" + strconv.Itoa(shard) + "-" + strconv.Itoa(v))
+			if _, ok := r.shards[h]; ok {
+				// Collisions are extremely unlikely; the first shard keeps the point
+				continue
+			}
+			r.points = append(r.points, h)
+			r.shards[h] = shard
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+	return r
+}
+
+// Returns the shard of the key.
+func (r *hashRing) get(key string) int {
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.shards[r.points[i]]
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+
+	// FNV alone doesn't spread similar strings (like the names of the points) evenly, so mix the bits with the SplitMix64 finalizer
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// Returns the fraction of the sliding expiration window that must pass before a read renews it.
+func parseSlidingTTLRefresh(metadata state.Metadata) (float64, error) {
+	s, ok := metadata.Properties[slidingTTLRefreshKey]
+	if !ok || s == "" {
+		return defaultSlidingTTLRefresh, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("illegal %s value: %s", slidingTTLRefreshKey, s)
+	}
+	return f, nil
+}
+
+// Returns the sliding TTL of a write, in seconds, or nil if it has none.
+func parseSlidingTTL(requestMetadata map[string]string) (*int64, error) {
+	val, ok := requestMetadata[metadataSlidingTTLKey]
+	if !ok || val == "" {
+		return nil, nil
+	}
+	if requestMetadata[metadataTTLKey] != "" {
+		return nil, fmt.Errorf("%s and %s can't be used together", metadataTTLKey, metadataSlidingTTLKey)
+	}
+
+	ttl, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("incorrect value for %s: %s", metadataSlidingTTLKey, val)
+	}
+	return &ttl, nil
+}
+
+// Returns true if a read should renew the expiration of a row with a sliding TTL.
+// To limit writes, that only happens once a.slidingTTLRefresh of the window has passed since it was last renewed.
+func (a *sqliteDBAccess) needsExpirationRefresh(slidingTTL sql.NullInt64, expiration sql.NullTime, now time.Time) bool {
+	if a.readOnly || !slidingTTL.Valid || !expiration.Valid {
+		return false
+	}
+	window := time.Duration(slidingTTL.Int64) * time.Second
+	elapsed := window - expiration.Time.Sub(now)
+	return elapsed >= time.Duration(float64(window)*a.slidingTTLRefresh)
+}
+
+// Pushes the expiration of a row with a sliding TTL forward, unless it was changed after it was read.
+func (a *sqliteDBAccess) refreshExpiration(parentCtx context.Context, key string, etag string, wc writeContext) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	now := wc.now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	a.invalidateCachedRow(key)
+	return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec(fmt.Sprintf(refreshExpirationTpl, a.tableName), now.Unix(), key, etag)
+		return err
+	})
+}
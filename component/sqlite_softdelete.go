@@ -0,0 +1,169 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/dapr/components-contrib/state"
+)
+
+// undeleteDBAccess is implemented by DBAccess objects that can restore soft-deleted rows.
+type undeleteDBAccess interface {
+	undelete(ctx context.Context, key string) (string, error)
+}
+
+// Returns the grace period of deleted rows, or 0 if soft delete is disabled.
+func parseSoftDelete(metadata state.Metadata) (time.Duration, error) {
+	enabled, err := parseBool(metadata, softDeleteKey)
+	if err != nil || !enabled {
+		return 0, err
+	}
+	return parseDurationProperty(metadata, softDeleteGracePeriodKey, defaultSoftDeleteGracePeriod)
+}
+
+// Adds the deletion_time column to state tables created before soft delete was enabled.
+func (a *sqliteDBAccess) ensureDeletionTimeColumn(parentCtx context.Context) error {
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	exists, err := columnExists(ctx, a.db, a.tableName, "deletion_time")
+	if err != nil {
+		return err
+	}
+
+	return a.executeInTransaction(ctx, func(tx *sql.Tx) error {
+		if !exists {
+			a.logger.Infof("Adding the deletion_time column to the state table '%s'", a.tableName)
+			_, err := tx.Exec(fmt.Sprintf(addDeletionTimeColumnTpl, a.tableName))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(fmt.Sprintf(createTableDeletionTimeIdx, a.tableName, a.tableName))
+		return err
+	})
+}
+
+// Check if a column exists in a table.
+func columnExists(ctx context.Context, db *sql.DB, tableName string, column string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, columnExistsStmt, tableName, column).Scan(&count)
+	return count > 0, err
+}
+
+// Removes the rows that were deleted before the grace period, and returns how many were removed.
+func (a *sqliteDBAccess) purgeDeleted(tx *sql.Tx, now time.Time) (int64, error) {
+	if a.softDeleteGracePeriod == 0 {
+		return 0, nil
+	}
+
+	res, err := tx.Exec(fmt.Sprintf(purgeDeletedTpl, a.tableName), now.Add(-a.softDeleteGracePeriod).Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge deleted rows: %w", err)
+	}
+	purged, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count affected rows: %w", err)
+	}
+	return purged, nil
+}
+
+func (a *sqliteDBAccess) undelete(parentCtx context.Context, key string) (string, error) {
+	etag, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	wc := writeContext{newETag: etag.String()}
+	return wc.newETag, a.undeleteWithContext(parentCtx, key, wc)
+}
+
+// Restores a soft-deleted row, giving it the ETag in wc.
+func (a *sqliteDBAccess) undeleteWithContext(parentCtx context.Context, key string, wc writeContext) error {
+	if a.readOnly {
+		return NewStoreError(StoreErrorReadOnly, errors.New(errReadOnly))
+	}
+	if a.softDeleteGracePeriod == 0 {
+		return errors.New("soft delete is not enabled")
+	}
+
+	return a.executeWrite(parentCtx, func(tx *sql.Tx) error {
+		var (
+			value    string
+			isBinary bool
+		)
+		err := tx.QueryRow(fmt.Sprintf(undeleteValueTpl, a.tableName), wc.newETag, key).
+			Scan(&value, &isBinary)
+		if errors.Is(err, sql.ErrNoRows) {
+			return NewStoreError(StoreErrorConflict, fmt.Errorf("key '%s' is not deleted, or it has been purged", key))
+		} else if err != nil {
+			return err
+		}
+		a.markWritten(key, true)
+
+		if a.history != nil {
+			err = a.appendHistory(tx, key, &value, isBinary, wc.newETag, wc.now)
+			if err != nil {
+				return err
+			}
+		}
+		if a.audit != nil {
+			return a.appendAudit(tx, key, auditOperationUndelete, nil, &wc.newETag, nil, wc.now)
+		}
+		return nil
+	})
+}
+
+func (s *shardedDBAccess) undelete(ctx context.Context, key string) (string, error) {
+	return s.shardFor(key).undelete(ctx, key)
+}
+
+func (t *tenantDBAccess) undelete(ctx context.Context, key string) (etag string, err error) {
+	err = t.withTenant(key, func(a *sqliteDBAccess) error {
+		etag, err = a.undelete(ctx, key)
+		return err
+	})
+	return etag, err
+}
+
+func (r *raftDBAccess) undelete(ctx context.Context, key string) (string, error) {
+	etag, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	op := &raftOperation{
+		Key:     key,
+		NewETag: etag.String(),
+	}
+	return op.NewETag, r.propose(ctx, raftCommand{Undelete: op})
+}
+
+// Undelete restores a key that was deleted while soft delete is enabled, if its grace period hasn't ended yet.
+// The key gets a new ETag, which is returned.
+func (s *SQLiteStore) Undelete(ctx context.Context, key string) (string, error) {
+	u, ok := s.dbaccess.(undeleteDBAccess)
+	if !ok {
+		return "", errors.New("undelete is not supported")
+	}
+	if key == "" {
+		return "", errors.New("missing key")
+	}
+	return u.undelete(ctx, key)
+}
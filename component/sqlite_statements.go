@@ -0,0 +1,83 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// preparedStatements are the statements used by Get, Set and Delete, prepared once for the state table at Init.
+// Otherwise, they would be formatted and parsed again for every request, because sql.DB does not substitute parameters for table names.
+type preparedStatements struct {
+	get *sql.Stmt
+	// Nil in read-only mode.
+	set            *sql.Stmt
+	setWithETag    *sql.Stmt
+	delete         *sql.Stmt
+	deleteWithETag *sql.Stmt
+}
+
+// Prepares the statements for the state table, whose schema must be up to date.
+func (a *sqliteDBAccess) prepareStatements(ctx context.Context) error {
+	getTpl := getValueTpl
+	setWithETagTpl := setValueWithETagTpl
+	delTpl, delWithETagTpl := delValueTpl, delValueWithETagTpl
+	if a.softDeleteGracePeriod > 0 {
+		// Soft-deleted rows can't be read or updated, and they're marked as deleted instead of being removed
+		getTpl = getValueSoftDeleteTpl
+		setWithETagTpl = setValueWithETagSoftDeleteTpl
+		delTpl, delWithETagTpl = softDelValueTpl, softDelValueWithETagTpl
+	}
+
+	s := &preparedStatements{}
+	queries := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.get, fmt.Sprintf(getTpl, a.tableName, a.valueColumns())},
+		{&s.set, fmt.Sprintf(setValueTpl, a.tableName)},
+		{&s.setWithETag, fmt.Sprintf(setWithETagTpl, a.tableName)},
+		{&s.delete, fmt.Sprintf(delTpl, a.tableName)},
+		{&s.deleteWithETag, fmt.Sprintf(delWithETagTpl, a.tableName)},
+	}
+	if a.readOnly {
+		queries = queries[:1]
+	}
+	for _, q := range queries {
+		var err error
+		*q.stmt, err = a.db.PrepareContext(ctx, q.query)
+		if err != nil {
+			s.close()
+			return fmt.Errorf("failed to prepare statements: %w", err)
+		}
+	}
+	a.stmts = s
+	return nil
+}
+
+// Returns the statement bound to a transaction.
+// ctx is the context of the request, which is used if the statement must be prepared again on the connection of the transaction.
+func (s *preparedStatements) bind(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt) *sql.Stmt {
+	return tx.StmtContext(ctx, stmt)
+}
+
+func (s *preparedStatements) close() {
+	for _, stmt := range []*sql.Stmt{s.get, s.set, s.setWithETag, s.delete, s.deleteWithETag} {
+		if stmt != nil {
+			_ = stmt.Close()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DatabaseStats contains statistics about one of the databases used by the state store.
+type DatabaseStats struct {
+	// Name of the database, which is empty unless the store uses multiple databases.
+	Name string
+	// Path of the database file, which is empty for in-memory databases.
+	Path string
+	// Number of rows in the state table, including expired ones that haven't been deleted yet.
+	Rows int64
+	// Number of expired rows that haven't been deleted yet.
+	ExpiredRows int64
+	// Size of the database, in bytes.
+	SizeBytes int64
+}
+
+// adminDBAccess is implemented by DBAccess objects that can report statistics and take backups of their databases.
+type adminDBAccess interface {
+	stats(ctx context.Context) ([]DatabaseStats, error)
+	backup(ctx context.Context, dir string) ([]string, error)
+}
+
+// Stats returns statistics about each database used by the state store.
+func (s *SQLiteStore) Stats(ctx context.Context) ([]DatabaseStats, error) {
+	a, ok := s.dbaccess.(adminDBAccess)
+	if !ok {
+		return nil, errors.New("stats are not supported")
+	}
+	return a.stats(ctx)
+}
+
+// Backup copies each database used by the state store to a file in dir, and returns the paths of the files.
+// Backups are consistent snapshots taken with the SQLite backup API.
+func (s *SQLiteStore) Backup(ctx context.Context, dir string) ([]string, error) {
+	a, ok := s.dbaccess.(adminDBAccess)
+	if !ok {
+		return nil, errors.New("backups are not supported")
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return a.backup(ctx, dir)
+}
+
+func (a *sqliteDBAccess) stats(parentCtx context.Context) ([]DatabaseStats, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, a.timeout)
+	defer cancel()
+
+	res := DatabaseStats{
+		Name: a.name,
+	}
+	if !a.inMemory {
+		res.Path = dbFilePath(a.connectionString)
+	}
+
+	err := a.db.QueryRowContext(ctx, fmt.Sprintf(statsTpl, a.tableName)).
+		Scan(&res.Rows, &res.ExpiredRows)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+
+	var pageCount, pageSize int64
+	err = a.db.QueryRowContext(ctx, "PRAGMA page_count").Scan(&pageCount)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	err = a.db.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	res.SizeBytes = pageCount * pageSize
+
+	return []DatabaseStats{res}, nil
+}
+
+func (a *sqliteDBAccess) backup(ctx context.Context, dir string) ([]string, error) {
+	name := a.name
+	if name == "" {
+		name = "state"
+	}
+	dest := filepath.Join(dir, name+".db")
+
+	// Replace any previous backup
+	err := os.Remove(dest)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	err = a.backupToFile(ctx, dest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to back up database: %w", err)
+	}
+	return []string{dest}, nil
+}
+
+func (r *raftDBAccess) stats(ctx context.Context) ([]DatabaseStats, error) {
+	return r.local.stats(ctx)
+}
+
+func (r *raftDBAccess) backup(ctx context.Context, dir string) ([]string, error) {
+	return r.local.backup(ctx, dir)
+}
@@ -0,0 +1,579 @@
+/*
+Copyright 2022 The Dapr Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package component
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dapr/components-contrib/state"
+	"github.com/dapr/kit/logger"
+)
+
+// tenantDBAccess implements DBAccess by storing the keys of each tenant in a separate database.
+// The tenant is a segment of the key: by default, the app ID in keys like "appid||key".
+// Databases are opened when they're first used, and closed after they've been idle for some time.
+type tenantDBAccess struct {
+	logger      logger.Logger
+	metadata    state.Metadata
+	separator   string
+	segment     int
+	idleTimeout time.Duration
+	// Maximum size of the database of each tenant in bytes, or 0 for no limit.
+	maxSize int64
+	// Interval of the cleanup of the tenants whose database is closed, or nil if disabled.
+	cleanupInterval *time.Duration
+	inMemory        bool
+	// Path of the files of the tenants, with the placeholder: the databases, or the persist files in memory mode.
+	// It's empty if tenants are in memory and never persisted.
+	filePattern string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+
+	// Protects tenants, closing and expirationHandler.
+	lock    sync.Mutex
+	tenants map[string]*tenantDB
+	// Tenants whose database is being closed, with a channel that is closed once it's done.
+	closing map[string]chan struct{}
+	// Handler of expired keys, which is set on the databases of tenants when they're opened.
+	expirationHandler ExpirationHandler
+}
+
+// Database of a tenant, which is open or being opened.
+type tenantDB struct {
+	// Set once the database is open.
+	access   *sqliteDBAccess
+	refs     int
+	lastUsed time.Time
+
+	// Closed when the database is open, or when opening it failed with err.
+	ready chan struct{}
+	err   error
+}
+
+func newTenantDBAccess(logger logger.Logger) *tenantDBAccess {
+	return &tenantDBAccess{
+		logger:  logger,
+		tenants: map[string]*tenantDB{},
+		closing: map[string]chan struct{}{},
+	}
+}
+
+func (t *tenantDBAccess) Init(metadata state.Metadata) (err error) {
+	t.metadata = metadata
+
+	t.separator = metadata.Properties[tenantKeySeparatorKey]
+	if t.separator == "" {
+		t.separator = defaultTenantKeySeparator
+	}
+	if s := metadata.Properties[tenantKeySegmentKey]; s != "" {
+		t.segment, err = strconv.Atoi(s)
+		if err != nil || t.segment < 0 {
+			return fmt.Errorf("illegal %s value: %s", tenantKeySegmentKey, s)
+		}
+	}
+	t.idleTimeout, err = parseDurationProperty(metadata, tenantIdleTimeoutKey, defaultTenantIdleTimeout)
+	if err != nil {
+		return err
+	}
+	t.cleanupInterval, err = parseCleanupInterval(metadata)
+	if err != nil {
+		return err
+	}
+	t.maxSize, err = parseLimitProperty(metadata, tenantMaxSizeKey)
+	if err != nil {
+		return err
+	}
+
+	t.inMemory, err = parseMode(metadata)
+	if err != nil {
+		return err
+	}
+	if !t.inMemory {
+		t.filePattern = dbFilePath(metadata.Properties[connectionStringKey])
+		if !strings.Contains(t.filePattern, tenantPlaceholder) {
+			return fmt.Errorf("the connection string must contain %s when using tenant isolation", tenantPlaceholder)
+		}
+	} else if persistFile := metadata.Properties[persistFileKey]; persistFile != "" {
+		// Otherwise, the databases of all tenants would be persisted to the same file
+		if !strings.Contains(persistFile, tenantPlaceholder) {
+			return fmt.Errorf("the persist file must contain %s when using tenant isolation", tenantPlaceholder)
+		}
+		t.filePattern = persistFile
+	}
+
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.scheduleCloseIdle()
+	t.scheduleCleanupClosed()
+
+	t.logger.Infof("Storing each tenant in its own database; tenants are segment %d of keys separated by '%s'", t.segment, t.separator)
+	return nil
+}
+
+// Returns the tenant a key belongs to.
+func (t *tenantDBAccess) tenantOf(key string) (string, error) {
+	parts := strings.SplitN(key, t.separator, t.segment+2)
+	if len(parts) < t.segment+2 {
+		return "", fmt.Errorf("key '%s' does not contain a tenant", key)
+	}
+
+	tenant := parts[t.segment]
+	if !validTenant(tenant) {
+		return "", fmt.Errorf("invalid tenant in key '%s': %s", key, tenant)
+	}
+	return tenant, nil
+}
+
+// Tenants are used in file names, so they can only contain letters, digits, and the characters "_", "-" and ".".
+func validTenant(tenant string) bool {
+	if tenant == "" || tenant == "." || tenant == ".." {
+		return false
+	}
+	for _, c := range []byte(tenant) {
+		if (c >= '0' && c <= '9') ||
+			(c >= 'a' && c <= 'z') ||
+			(c >= 'A' && c <= 'Z') ||
+			c == '_' || c == '-' || c == '.' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// Returns the database of a tenant, opening it if needed.
+// The database is not closed until release is invoked.
+// The lock is only held to look up the tenant, so opening a database doesn't block the requests of other tenants; requests of the same tenant wait until it's open.
+func (t *tenantDBAccess) acquire(tenant string) (*sqliteDBAccess, error) {
+	t.lock.Lock()
+	db, ok := t.tenants[tenant]
+	if !ok {
+		db = &tenantDB{ready: make(chan struct{})}
+		t.tenants[tenant] = db
+	}
+	db.refs++
+	t.lock.Unlock()
+
+	if !ok {
+		t.open(tenant, db)
+	}
+	<-db.ready
+	if db.err != nil {
+		return nil, db.err
+	}
+	return db.access, nil
+}
+
+// Opens the database of a tenant, and signals that it's ready.
+// If it fails, the tenant is removed, so the next request tries again.
+func (t *tenantDBAccess) open(tenant string, db *tenantDB) {
+	defer close(db.ready)
+
+	t.waitClosed(tenant)
+	access := newSqliteDBAccess(t.logger)
+	access.name = tenant
+	access.maxSize = t.maxSize
+	err := access.Init(replacePlaceholder(t.metadata, tenantPlaceholder, tenant))
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err == nil && t.ctx.Err() != nil {
+		err = errStoreClosed
+	}
+	if err == nil && t.expirationHandler != nil {
+		err = access.onExpiration(t.expirationHandler)
+	}
+	if err != nil {
+		access.Close()
+		db.err = fmt.Errorf("failed to open database of tenant %s: %w", tenant, err)
+		if t.tenants[tenant] == db {
+			delete(t.tenants, tenant)
+		}
+		return
+	}
+	t.logger.Debugf("Opened database of tenant %s", tenant)
+	db.access = access
+}
+
+func (t *tenantDBAccess) release(tenant string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if db, ok := t.tenants[tenant]; ok {
+		db.refs--
+		db.lastUsed = time.Now()
+	}
+}
+
+// Runs fn with the database of the tenant that key belongs to.
+func (t *tenantDBAccess) withTenant(key string, fn func(a *sqliteDBAccess) error) error {
+	tenant, err := t.tenantOf(key)
+	if err != nil {
+		return err
+	}
+	a, err := t.acquire(tenant)
+	if err != nil {
+		return err
+	}
+	defer t.release(tenant)
+
+	return fn(a)
+}
+
+func (t *tenantDBAccess) Ping(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for tenant, db := range t.tenants {
+		if db.access == nil {
+			continue
+		}
+		err := db.access.Ping(ctx)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant, err)
+		}
+	}
+	return nil
+}
+
+func (t *tenantDBAccess) Get(ctx context.Context, req *state.GetRequest) (res *state.GetResponse, err error) {
+	if req.Key == "" {
+		return nil, errors.New("missing key in get operation")
+	}
+	err = t.withTenant(req.Key, func(a *sqliteDBAccess) error {
+		res, err = a.Get(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+func (t *tenantDBAccess) Set(ctx context.Context, req *state.SetRequest) error {
+	if req.Key == "" {
+		return errors.New("missing key in set option")
+	}
+	return t.withTenant(req.Key, func(a *sqliteDBAccess) error {
+		return a.Set(ctx, req)
+	})
+}
+
+func (t *tenantDBAccess) Delete(ctx context.Context, req *state.DeleteRequest) error {
+	if req.Key == "" {
+		return fmt.Errorf("missing key in delete operation")
+	}
+	return t.withTenant(req.Key, func(a *sqliteDBAccess) error {
+		return a.Delete(ctx, req)
+	})
+}
+
+// ExecuteMulti executes a transaction in the database of the tenant that all of its keys belong to.
+func (t *tenantDBAccess) ExecuteMulti(ctx context.Context, reqs []state.TransactionalStateOperation) error {
+	var key, tenant string
+	for _, req := range reqs {
+		k, ok := operationKey(req)
+		if !ok {
+			continue
+		}
+
+		kt, err := t.tenantOf(k)
+		if err != nil {
+			return err
+		}
+		if tenant == "" {
+			key, tenant = k, kt
+		} else if kt != tenant {
+			return errors.New("the transaction contains keys of different tenants")
+		}
+	}
+	if tenant == "" {
+		return nil
+	}
+
+	return t.withTenant(key, func(a *sqliteDBAccess) error {
+		return a.ExecuteMulti(ctx, reqs)
+	})
+}
+
+// Close implements io.Close.
+func (t *tenantDBAccess) Close() error {
+	if t.cancel != nil {
+		t.cancel()
+	}
+	t.wg.Wait()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Databases that are being opened are closed when they're ready, since the context is canceled
+	var err error
+	for tenant, db := range t.tenants {
+		if db.access == nil {
+			delete(t.tenants, tenant)
+			continue
+		}
+		closeErr := db.access.Close()
+		if closeErr != nil && err == nil {
+			err = fmt.Errorf("tenant %s: %w", tenant, closeErr)
+		}
+		delete(t.tenants, tenant)
+	}
+	return err
+}
+
+func (t *tenantDBAccess) scheduleCloseIdle() {
+	d := t.idleTimeout / 2
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.closeIdle()
+			case <-t.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Open databases remove their expired rows themselves, but those that are closed must be opened to be cleaned up.
+func (t *tenantDBAccess) scheduleCleanupClosed() {
+	if t.cleanupInterval == nil || t.filePattern == "" {
+		return
+	}
+
+	d := *t.cleanupInterval
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.cleanupClosed()
+			case <-t.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Removes the expired rows of the tenants whose database is closed.
+// Their databases are opened for the cleanup, and they're closed again when they're idle.
+func (t *tenantDBAccess) cleanupClosed() {
+	tenants, err := t.listTenants()
+	if err != nil {
+		t.logger.Errorf("Error listing tenants to remove expired data: %v", err)
+		return
+	}
+
+	for _, tenant := range tenants {
+		if t.ctx.Err() != nil {
+			return
+		}
+		t.lock.Lock()
+		_, open := t.tenants[tenant]
+		t.lock.Unlock()
+		if open {
+			continue
+		}
+
+		a, err := t.acquire(tenant)
+		if err != nil {
+			t.logger.Errorf("Error removing expired data of tenant %s: %v", tenant, err)
+			continue
+		}
+		a.cleanupTimeout()
+		t.release(tenant)
+	}
+}
+
+// Closes the databases that haven't been used for longer than the idle timeout.
+// In-memory databases that aren't persisted are never closed, because their data would be lost.
+// Closing a database may take time, such as to persist it, so it's done without holding the lock.
+func (t *tenantDBAccess) closeIdle() {
+	if t.filePattern == "" {
+		return
+	}
+
+	idle := map[string]*sqliteDBAccess{}
+	t.lock.Lock()
+	for tenant, db := range t.tenants {
+		if db.refs > 0 || time.Since(db.lastUsed) < t.idleTimeout {
+			continue
+		}
+		idle[tenant] = db.access
+		delete(t.tenants, tenant)
+		t.closing[tenant] = make(chan struct{})
+	}
+	t.lock.Unlock()
+
+	for tenant, access := range idle {
+		err := access.Close()
+		if err != nil {
+			t.logger.Errorf("Error closing database of tenant %s: %v", tenant, err)
+		} else {
+			t.logger.Debugf("Closed idle database of tenant %s", tenant)
+		}
+
+		t.lock.Lock()
+		close(t.closing[tenant])
+		delete(t.closing, tenant)
+		t.lock.Unlock()
+	}
+}
+
+// Waits until the database of a tenant is closed, if it's being closed, so it's not opened again before its files are written.
+func (t *tenantDBAccess) waitClosed(tenant string) {
+	t.lock.Lock()
+	closing := t.closing[tenant]
+	t.lock.Unlock()
+	if closing != nil {
+		<-closing
+	}
+}
+
+// Returns all tenants: those whose database is open, and those that have a database file (or persist file in memory mode).
+func (t *tenantDBAccess) listTenants() ([]string, error) {
+	found := map[string]struct{}{}
+
+	t.lock.Lock()
+	for tenant := range t.tenants {
+		found[tenant] = struct{}{}
+	}
+	t.lock.Unlock()
+
+	if t.filePattern != "" {
+		prefix, suffix, _ := strings.Cut(t.filePattern, tenantPlaceholder)
+		matches, err := filepath.Glob(strings.ReplaceAll(t.filePattern, tenantPlaceholder, "*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			tenant := strings.TrimSuffix(strings.TrimPrefix(m, prefix), suffix)
+			if validTenant(tenant) {
+				found[tenant] = struct{}{}
+			}
+		}
+	}
+
+	res := make([]string, 0, len(found))
+	for tenant := range found {
+		res = append(res, tenant)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (t *tenantDBAccess) stats(ctx context.Context) ([]DatabaseStats, error) {
+	tenants, err := t.listTenants()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]DatabaseStats, 0, len(tenants))
+	for _, tenant := range tenants {
+		a, err := t.acquire(tenant)
+		if err != nil {
+			return nil, err
+		}
+		stats, err := a.stats(ctx)
+		t.release(tenant)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, stats...)
+	}
+	return res, nil
+}
+
+func (t *tenantDBAccess) backup(ctx context.Context, dir string) ([]string, error) {
+	tenants, err := t.listTenants()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, len(tenants))
+	for _, tenant := range tenants {
+		a, err := t.acquire(tenant)
+		if err != nil {
+			return nil, err
+		}
+		files, err := a.backup(ctx, dir)
+		t.release(tenant)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, files...)
+	}
+	return res, nil
+}
+
+// Closes the database of a tenant and deletes its files.
+func (t *tenantDBAccess) deleteTenant(tenant string) error {
+	if !validTenant(tenant) {
+		return fmt.Errorf("invalid tenant: %s", tenant)
+	}
+
+	t.waitClosed(tenant)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if db, ok := t.tenants[tenant]; ok {
+		if db.refs > 0 {
+			return NewStoreError(StoreErrorUnavailable, fmt.Errorf("the database of tenant %s is in use", tenant))
+		}
+		err := db.access.Close()
+		if err != nil {
+			return err
+		}
+		delete(t.tenants, tenant)
+	}
+
+	if t.filePattern == "" {
+		return nil
+	}
+	path := strings.ReplaceAll(t.filePattern, tenantPlaceholder, tenant)
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err := os.Remove(path + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	t.logger.Infof("Deleted database of tenant %s", tenant)
+	return nil
+}
+
+// DeleteTenant deletes the database of a tenant, when tenant isolation is enabled.
+func (s *SQLiteStore) DeleteTenant(tenant string) error {
+	t, ok := s.dbaccess.(*tenantDBAccess)
+	if !ok {
+		return errors.New("tenant isolation is not enabled")
+	}
+	return t.deleteTenant(tenant)
+}
@@ -15,10 +15,15 @@ package component
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/dapr/components-contrib/metadata"
 	"github.com/dapr/components-contrib/state"
@@ -123,6 +128,53 @@ func TestValidMultiDeleteRequest(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestClassifyError(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		err       error
+		kind      StoreErrorKind
+		code      codes.Code
+		retryable bool
+	}{
+		{name: "busy", err: sqlite3.Error{Code: sqlite3.ErrBusy}, kind: StoreErrorUnavailable, code: codes.Unavailable, retryable: true},
+		{name: "locked", err: sqlite3.Error{Code: sqlite3.ErrLocked}, kind: StoreErrorUnavailable, code: codes.Unavailable, retryable: true},
+		{name: "disk full", err: sqlite3.Error{Code: sqlite3.ErrFull}, kind: StoreErrorResourceExhausted, code: codes.ResourceExhausted},
+		{name: "read-only", err: sqlite3.Error{Code: sqlite3.ErrReadonly}, kind: StoreErrorReadOnly, code: codes.FailedPrecondition},
+		{name: "constraint", err: sqlite3.Error{Code: sqlite3.ErrConstraint}, kind: StoreErrorConflict, code: codes.Aborted},
+		{name: "I/O error", err: sqlite3.Error{Code: sqlite3.ErrIoErr}, kind: StoreErrorIO, code: codes.Internal},
+		{name: "can't open", err: sqlite3.Error{Code: sqlite3.ErrCantOpen}, kind: StoreErrorIO, code: codes.Internal},
+		{name: "wrapped", err: fmt.Errorf("wrapped: %w", sqlite3.Error{Code: sqlite3.ErrBusy}), kind: StoreErrorUnavailable, code: codes.Unavailable, retryable: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyError(tt.err)
+
+			var storeErr *StoreError
+			if assert.ErrorAs(t, err, &storeErr) {
+				assert.Equal(t, tt.kind, storeErr.Kind())
+				assert.Equal(t, tt.retryable, IsRetryableError(err))
+				assert.Equal(t, tt.code, status.Code(err))
+				assert.ErrorIs(t, err, tt.err)
+			}
+		})
+	}
+
+	t.Run("not classified", func(t *testing.T) {
+		assert.Nil(t, classifyError(nil))
+
+		err := errors.New("some error")
+		assert.Equal(t, err, classifyError(err))
+
+		etagErr := state.NewETagError(state.ETagMismatch, nil)
+		assert.Equal(t, etagErr, classifyError(etagErr))
+
+		corruptErr := sqlite3.Error{Code: sqlite3.ErrCorrupt}
+		assert.Equal(t, corruptErr, classifyError(corruptErr))
+	})
+}
+
 func createSetRequest() state.SetRequest {
 	return state.SetRequest{
 		Key:   randomKey(),
@@ -187,3 +239,33 @@ type fakeItem struct {
 func randomJSON() *fakeItem {
 	return &fakeItem{Color: randomKey()}
 }
+
+func TestHashRing(t *testing.T) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = randomKey()
+	}
+
+	ring := newHashRing(4, defaultShardVirtualNodes)
+	counts := make([]int, 4)
+	for _, key := range keys {
+		shard := ring.get(key)
+		assert.Equal(t, shard, ring.get(key))
+		counts[shard]++
+	}
+	for _, c := range counts {
+		// Each shard gets roughly a quarter of the keys
+		assert.InDelta(t, len(keys)/4, c, float64(len(keys))/10)
+	}
+
+	// Adding a shard moves only the keys that now belong to the new shard
+	grown := newHashRing(5, defaultShardVirtualNodes)
+	moved := 0
+	for _, key := range keys {
+		if before, after := ring.get(key), grown.get(key); before != after {
+			assert.Equal(t, 4, after)
+			moved++
+		}
+	}
+	assert.InDelta(t, len(keys)/5, moved, float64(len(keys))/10)
+}